@@ -0,0 +1,293 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+)
+
+var (
+	// Defined in 'api-integrations/servicenow.json'. The operation posts the raw request body to
+	// /api/now/attachment/file and takes the file name and the record to attach to as query parameters.
+	pluginOpIDServiceNowCreateAttachment = "create_attachment"
+)
+
+const (
+	// DefaultMaxAttachmentBytes is the largest decoded attachment accepted by /add_attachment
+	DefaultMaxAttachmentBytes = 5 * 1024 * 1024
+
+	// DefaultAttachmentFileNameTemplate is used when the request does not provide a file name template
+	DefaultAttachmentFileNameTemplate = "{{.EntityID}}_{{.Name}}.{{.Extension}}"
+
+	ContentEncodingText   = "text"
+	ContentEncodingBase64 = "base64"
+)
+
+// attachmentExtensions maps content types onto file extensions. Only text can be uploaded, so binary
+// formats such as images, PDFs or archives are not listed; other content types get the "bin" extension.
+var attachmentExtensions = map[string]string{
+	"application/json": "json",
+	"text/plain":       "txt",
+	"text/html":        "html",
+	"text/xml":         "xml",
+	"text/csv":         "csv",
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// AddAttachmentRequest represents the request body for attaching content to the ticket mapped to an entity
+type AddAttachmentRequest struct {
+	ConfigID         string `json:"config_id"`
+	EntityID         string `json:"entity_id"`
+	ExternalSystemID string `json:"external_system_id"`
+
+	Name             string `json:"name"`
+	Content          string `json:"content"`
+	ContentEncoding  string `json:"content_encoding"`
+	ContentType      string `json:"content_type"`
+	FileNameTemplate string `json:"file_name_template"`
+}
+
+// AddAttachmentResponse represents the response body for attaching content to a ticket
+type AddAttachmentResponse struct {
+	TicketID     string `json:"ticket_id"`
+	AttachmentID string `json:"attachment_id"`
+	FileName     string `json:"file_name"`
+	ContentType  string `json:"content_type"`
+	SizeBytes    int    `json:"size_bytes"`
+	Uploaded     bool   `json:"uploaded"`
+}
+
+// attachmentFileNameData holds the values available to file name templates
+type attachmentFileNameData struct {
+	EntityID  string
+	TicketID  string
+	Name      string
+	Extension string
+	Timestamp string
+}
+
+// decodeAttachmentContent returns the raw bytes of the attachment content
+func decodeAttachmentContent(content, encoding string) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "", ContentEncodingText:
+		return []byte(content), nil
+	case ContentEncodingBase64:
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(content))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 content: %w", err)
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s (must be one of: %s, %s)", encoding, ContentEncodingText, ContentEncodingBase64)
+	}
+}
+
+// detectAttachmentContentType returns the MIME type of the attachment content
+func detectAttachmentContentType(data []byte) string {
+	if json.Valid(data) {
+		trimmed := bytes.TrimSpace(data)
+		if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+			return "application/json"
+		}
+	}
+
+	contentType := http.DetectContentType(data)
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+
+	return contentType
+}
+
+// renderAttachmentFileName renders the file name template and strips characters ServiceNow may reject
+func renderAttachmentFileName(fileNameTemplate string, data attachmentFileNameData) (string, error) {
+	if fileNameTemplate == "" {
+		fileNameTemplate = DefaultAttachmentFileNameTemplate
+	}
+
+	tmpl, err := template.New("file_name").Option("missingkey=error").Parse(fileNameTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid file name template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("invalid file name template: %w", err)
+	}
+
+	fileName := unsafeFileNameChars.ReplaceAllString(buf.String(), "_")
+	if strings.Trim(fileName, "._") == "" {
+		return "", fmt.Errorf("file name template rendered an empty file name")
+	}
+
+	return fileName, nil
+}
+
+// HandleAddAttachment handles the /add_attachment endpoint
+func (h *Handler) HandleAddAttachment(ctx context.Context, r fdk.RequestOf[AddAttachmentRequest], wrkCtx fdk.WorkflowCtx) fdk.Response {
+	ctx = withHandlerPath(ctx, "/add_attachment")
+	h.logger.Info("Adding attachment", "trace_id", r.TraceID, "wrk_ctx", wrkCtx)
+
+	externalSystemID := r.Body.ExternalSystemID
+	if externalSystemID == "" {
+		externalSystemID = ExternalSystemIDServiceNowIncident
+	}
+
+	ticketOps, ok := serviceNowTicketOpsBySystem[externalSystemID]
+	if !ok {
+		errMsg := fmt.Sprintf("unsupported external system ID: %s", externalSystemID)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: errMsg})
+	}
+
+	data, err := decodeAttachmentContent(r.Body.Content, r.Body.ContentEncoding)
+	if err != nil {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: err.Error()})
+	}
+
+	if len(data) == 0 {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: "attachment content is empty"})
+	}
+
+	maxBytes := h.maxAttachmentBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxAttachmentBytes
+	}
+	if len(data) > maxBytes {
+		errMsg := fmt.Sprintf("attachment size %d bytes exceeds the limit of %d bytes", len(data), maxBytes)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusRequestEntityTooLarge, Message: errMsg})
+	}
+
+	// The API integration takes the request body as a JSON string, which can't carry arbitrary bytes
+	if !utf8.Valid(data) {
+		errMsg := "binary attachment content is not supported, the decoded content must be valid UTF-8 text"
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusUnsupportedMediaType, Message: errMsg})
+	}
+
+	contentType := r.Body.ContentType
+	if contentType == "" {
+		contentType = detectAttachmentContentType(data)
+	}
+
+	extension, ok := attachmentExtensions[contentType]
+	if !ok {
+		extension = "bin"
+	}
+
+	name := r.Body.Name
+	if name == "" {
+		name = "evidence"
+	}
+
+	falconClient, _, err := h.falconClientFunc(r.AccessToken, h.logger)
+	if err != nil {
+		errMsg := fmt.Sprintf("error creating Falcon client: %v", err)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: errMsg})
+	}
+
+	exists, extRecord, err := storage.CheckExternalEntityExists(ctx, falconClient.CustomStorage, h.logger, r.Body.EntityID, externalSystemID)
+	if err != nil {
+		errMsg := fmt.Sprintf("failed to check if ticket exists: %v", err)
+		return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: errMsg})
+	}
+
+	if !exists {
+		errMsg := fmt.Sprintf("no %s ticket is mapped to entity %s", externalSystemID, r.Body.EntityID)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusNotFound, Message: errMsg})
+	}
+
+	fileName, err := renderAttachmentFileName(r.Body.FileNameTemplate, attachmentFileNameData{
+		EntityID:  r.Body.EntityID,
+		TicketID:  extRecord.ExternalEntityID,
+		Name:      name,
+		Extension: extension,
+		Timestamp: timeNow().UTC().Format("20060102T150405Z"),
+	})
+	if err != nil {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: err.Error()})
+	}
+
+	contentHash := sha256.Sum256(data)
+	contentHashHex := hex.EncodeToString(contentHash[:])
+
+	// Re-runs of the same workflow must not upload the same content twice
+	if attachment, ok := extRecord.FindAttachment(contentHashHex); ok {
+		h.logger.Info("attachment already uploaded", "ticket_id", extRecord.ExternalEntityID, "attachment_id", attachment.AttachmentID)
+		return fdk.Response{
+			Code: http.StatusOK,
+			Body: fdk.JSON(AddAttachmentResponse{
+				TicketID:     extRecord.ExternalEntityID,
+				AttachmentID: attachment.AttachmentID,
+				FileName:     attachment.FileName,
+				ContentType:  contentType,
+				SizeBytes:    len(data),
+				Uploaded:     false,
+			}),
+		}
+	}
+
+	result, err := h.executeServiceNowRecordCommand(ctx, falconClient, r.Body.ConfigID, pluginOpIDServiceNowCreateAttachment, &models.DomainRequest{
+		Data: string(data),
+		Params: &models.DomainParams{
+			Header: map[string]string{"Content-Type": contentType},
+			Query: map[string]string{
+				"file_name":    fileName,
+				"table_name":   ticketOps.TicketType,
+				"table_sys_id": extRecord.ExternalEntityID,
+			},
+		},
+	})
+	if err != nil {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: err.Error()})
+	}
+
+	attachmentID, _ := result["sys_id"].(string)
+	if attachmentID == "" {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: "failed to upload attachment - no sys_id in response"})
+	}
+
+	attachment := storage.AttachmentRecord{
+		ContentHash:  contentHashHex,
+		FileName:     fileName,
+		AttachmentID: attachmentID,
+		UploadedAt:   timeNow().UTC().Unix(),
+	}
+
+	// Apply onto the latest mapping rather than the one read before the upload
+	if _, err := h.updateEntityMapping(ctx, falconClient, extRecord, func(record *storage.ExternalEntityRecord) error {
+		if _, ok := record.FindAttachment(contentHashHex); !ok {
+			record.Attachments = append(record.Attachments, attachment)
+		}
+		return nil
+	}); err != nil {
+		return h.mappingErrResp(err)
+	}
+
+	h.logger.Info("uploaded attachment", "ticket_id", extRecord.ExternalEntityID, "attachment_id", attachmentID, "file_name", fileName)
+
+	return fdk.Response{
+		Code: http.StatusCreated,
+		Body: fdk.JSON(AddAttachmentResponse{
+			TicketID:     extRecord.ExternalEntityID,
+			AttachmentID: attachmentID,
+			FileName:     fileName,
+			ContentType:  contentType,
+			SizeBytes:    len(data),
+			Uploaded:     true,
+		}),
+	}
+}
@@ -0,0 +1,281 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+	"github.com/crowdstrike/gofalcon/falcon/client"
+	"github.com/crowdstrike/gofalcon/falcon/client/api_integrations"
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+)
+
+// TestHandleAddAttachment tests the Handler.HandleAddAttachment method
+func (s *HandlerTestSuite) TestHandleAddAttachment() {
+	alertJSON := `{"composite_id":"abc:ind:123","severity":70}`
+	alertHash := sha256.Sum256([]byte(alertJSON))
+
+	tests := []struct {
+		name              string
+		request           AddAttachmentRequest
+		maxBytes          int
+		storedAttachments []storage.AttachmentRecord
+		wantUpload        *models.DomainRequest
+		wantCode          int
+		wantBody          map[string]interface{}
+		wantErrors        []fdk.APIError
+	}{
+		{
+			name: "Upload raw alert JSON",
+			request: AddAttachmentRequest{
+				ConfigID: "config123",
+				EntityID: "entity123",
+				Name:     "alert",
+				Content:  alertJSON,
+			},
+			wantUpload: &models.DomainRequest{
+				Data: alertJSON,
+				Params: &models.DomainParams{
+					Header: map[string]string{"Content-Type": "application/json"},
+					Query: map[string]string{
+						"file_name":    "entity123_alert.json",
+						"table_name":   "incident",
+						"table_sys_id": "sys123",
+					},
+				},
+			},
+			wantCode: 201,
+			wantBody: map[string]interface{}{
+				"ticket_id":     "sys123",
+				"attachment_id": "att123",
+				"file_name":     "entity123_alert.json",
+				"content_type":  "application/json",
+				"uploaded":      true,
+			},
+		},
+		{
+			name: "Upload base64 blob to SIR incident with file name template",
+			request: AddAttachmentRequest{
+				ConfigID:         "config123",
+				EntityID:         "entity:123",
+				ExternalSystemID: ExternalSystemIDServiceNowSIRIncident,
+				Name:             "process tree",
+				Content:          base64.StdEncoding.EncodeToString([]byte("explorer.exe\n  cmd.exe\n")),
+				ContentEncoding:  ContentEncodingBase64,
+				FileNameTemplate: "{{.TicketID}}-{{.Name}}.{{.Extension}}",
+			},
+			wantUpload: &models.DomainRequest{
+				Data: "explorer.exe\n  cmd.exe\n",
+				Params: &models.DomainParams{
+					Header: map[string]string{"Content-Type": "text/plain"},
+					Query: map[string]string{
+						"file_name":    "sys123-process_tree.txt",
+						"table_name":   "sn_si_incident",
+						"table_sys_id": "sys123",
+					},
+				},
+			},
+			wantCode: 201,
+			wantBody: map[string]interface{}{
+				"file_name": "sys123-process_tree.txt",
+				"uploaded":  true,
+			},
+		},
+		{
+			name: "Explicit CSV content type",
+			request: AddAttachmentRequest{
+				ConfigID:    "config123",
+				EntityID:    "entity123",
+				Name:        "hosts",
+				Content:     "hostname,ip\nhost1,10.0.0.1\n",
+				ContentType: "text/csv",
+			},
+			wantUpload: &models.DomainRequest{
+				Data: "hostname,ip\nhost1,10.0.0.1\n",
+				Params: &models.DomainParams{
+					Header: map[string]string{"Content-Type": "text/csv"},
+					Query: map[string]string{
+						"file_name":    "entity123_hosts.csv",
+						"table_name":   "incident",
+						"table_sys_id": "sys123",
+					},
+				},
+			},
+			wantCode: 201,
+			wantBody: map[string]interface{}{
+				"file_name":    "entity123_hosts.csv",
+				"content_type": "text/csv",
+				"uploaded":     true,
+			},
+		},
+		{
+			name: "Same content already uploaded",
+			request: AddAttachmentRequest{
+				ConfigID: "config123",
+				EntityID: "entity123",
+				Name:     "alert",
+				Content:  alertJSON,
+			},
+			storedAttachments: []storage.AttachmentRecord{
+				{ContentHash: hex.EncodeToString(alertHash[:]), FileName: "entity123_alert.json", AttachmentID: "att-existing"},
+			},
+			wantCode: 200,
+			wantBody: map[string]interface{}{
+				"attachment_id": "att-existing",
+				"uploaded":      false,
+			},
+		},
+		{
+			name: "Content exceeds size limit",
+			request: AddAttachmentRequest{
+				ConfigID: "config123",
+				EntityID: "entity123",
+				Content:  strings.Repeat("a", 11),
+			},
+			maxBytes: 10,
+			wantCode: 413,
+			wantErrors: []fdk.APIError{
+				{Code: 413, Message: "attachment size 11 bytes exceeds the limit of 10 bytes"},
+			},
+		},
+		{
+			name: "Invalid base64 content",
+			request: AddAttachmentRequest{
+				ConfigID:        "config123",
+				EntityID:        "entity123",
+				Content:         "not base64!",
+				ContentEncoding: ContentEncodingBase64,
+			},
+			wantCode: 400,
+			wantErrors: []fdk.APIError{
+				{Code: 400, Message: "invalid base64 content: illegal base64 data at input byte 3"},
+			},
+		},
+		{
+			name: "Binary content",
+			request: AddAttachmentRequest{
+				ConfigID:        "config123",
+				EntityID:        "entity123",
+				Content:         base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")),
+				ContentEncoding: ContentEncodingBase64,
+			},
+			wantCode: 415,
+			wantErrors: []fdk.APIError{
+				{Code: 415, Message: "binary attachment content is not supported, the decoded content must be valid UTF-8 text"},
+			},
+		},
+		{
+			name: "Invalid file name template",
+			request: AddAttachmentRequest{
+				ConfigID:         "config123",
+				EntityID:         "entity123",
+				Content:          "text",
+				FileNameTemplate: "{{.Unknown}}",
+			},
+			wantCode: 400,
+		},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+
+			systemID := tc.request.ExternalSystemID
+			if systemID == "" {
+				systemID = ExternalSystemIDServiceNowIncident
+			}
+
+			s.mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+				json.NewEncoder(writer).Encode(storage.ExternalEntityRecord{
+					InternalEntityID: tc.request.EntityID,
+					ExternalEntityID: "sys123",
+					ExternalSystemID: systemID,
+					Attachments:      tc.storedAttachments,
+				})
+				return &custom_storage.GetObjectOK{}, nil
+			}
+
+			stored := new(bytes.Buffer)
+			s.mockStorage.PutObjectFunc = func(params *custom_storage.PutObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.PutObjectOK, error) {
+				io.Copy(stored, params.Body)
+				return &custom_storage.PutObjectOK{}, nil
+			}
+
+			uploads := 0
+			s.mockAPIIntegrations.ExecuteCommandFunc = func(params *api_integrations.ExecuteCommandParams, opts ...api_integrations.ClientOption) (*api_integrations.ExecuteCommandOK, error) {
+				uploads++
+				resource := params.Body.Resources[0]
+				s.Equal(pluginOpIDServiceNowCreateAttachment, *resource.OperationID)
+				s.Equal(tc.wantUpload, resource.Request)
+
+				return &api_integrations.ExecuteCommandOK{
+					Payload: &models.DomainExecuteCommandResultsV1{
+						Resources: []*models.DomainExecuteCommandResultV1{
+							{ResponseBody: map[string]interface{}{"result": map[string]interface{}{"sys_id": "att123"}}},
+						},
+					},
+				}, nil
+			}
+
+			handler := &Handler{
+				logger: s.logger,
+				falconClientFunc: func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+					mockClient := &client.CrowdStrikeAPISpecification{}
+					mockClient.CustomStorage = s.mockStorage
+					mockClient.APIIntegrations = s.mockAPIIntegrations
+					return mockClient, "us-1", nil
+				},
+				maxAttachmentBytes: tc.maxBytes,
+			}
+
+			response := handler.HandleAddAttachment(context.Background(), fdk.RequestOf[AddAttachmentRequest]{
+				Body:        tc.request,
+				AccessToken: "test-token",
+			}, fdk.WorkflowCtx{})
+			s.Equal(tc.wantCode, response.Code, "Response code should match expected value")
+
+			if tc.wantCode >= 400 {
+				s.Nil(response.Body, "Response body should be nil for error responses")
+				s.Zero(uploads, "Nothing should be uploaded for rejected requests")
+				for i, wantErr := range tc.wantErrors {
+					s.Equal(wantErr.Code, response.Errors[i].Code, "Error code should match expected value")
+					s.Equal(wantErr.Message, response.Errors[i].Message, "Error message should match expected value")
+				}
+				return
+			}
+
+			jsonBytes, err := json.Marshal(response.Body)
+			s.NoError(err, "Failed to marshal JSON body")
+
+			var actual map[string]interface{}
+			s.NoError(json.Unmarshal(jsonBytes, &actual), "Failed to unmarshal JSON body")
+
+			for k, v := range tc.wantBody {
+				actualVal, exists := actual[k]
+				s.True(exists, "Expected key %q not found in response", k)
+				s.Equal(v, actualVal, "For key %q, expected value should match actual value", k)
+			}
+
+			if tc.wantUpload == nil {
+				s.Zero(uploads, "Duplicate content must not be uploaded again")
+				s.Zero(stored.Len(), "Mapping should not be rewritten for duplicates")
+				return
+			}
+
+			var record storage.ExternalEntityRecord
+			s.NoError(json.Unmarshal(stored.Bytes(), &record), "Failed to unmarshal stored record")
+			s.Require().Len(record.Attachments, 1)
+			s.Equal("att123", record.Attachments[0].AttachmentID, "Attachment sys_id should be recorded on the mapping")
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+)
+
+// Falcon alert resolutions accepted by the /close_ticket endpoint
+const (
+	ResolutionTruePositive  = "true_positive"
+	ResolutionFalsePositive = "false_positive"
+	ResolutionIgnored       = "ignored"
+)
+
+// TicketCloseCodes describes how a ticket tracked under one external system ID is closed.
+// CloseCodes maps a Falcon resolution to a value from the get_incident_close_code or
+// get_sn_si_incident_close_code choice list.
+type TicketCloseCodes struct {
+	ResolvedState string            `json:"resolved_state"`
+	ClosedStates  []string          `json:"closed_states"`
+	CloseCodes    map[string]string `json:"close_codes"`
+}
+
+// CloseCodeTable maps an external system ID to its close code configuration
+type CloseCodeTable map[string]TicketCloseCodes
+
+// DefaultCloseCodes returns the close code mapping for the out-of-the-box ServiceNow choice lists
+func DefaultCloseCodes() CloseCodeTable {
+	return CloseCodeTable{
+		ExternalSystemIDServiceNowIncident: {
+			// 6 = Resolved, 7 = Closed, 8 = Canceled
+			ResolvedState: "6",
+			ClosedStates:  []string{"6", "7", "8"},
+			CloseCodes: map[string]string{
+				ResolutionTruePositive:  "Solution provided",
+				ResolutionFalsePositive: "No resolution provided",
+				ResolutionIgnored:       "No resolution provided",
+			},
+		},
+		ExternalSystemIDServiceNowSIRIncident: {
+			// 3 = Closed, 7 = Cancelled
+			ResolvedState: "3",
+			ClosedStates:  []string{"3", "7"},
+			CloseCodes: map[string]string{
+				ResolutionTruePositive:  "Confirmed",
+				ResolutionFalsePositive: "False Positive",
+				ResolutionIgnored:       "Invalid",
+			},
+		},
+	}
+}
+
+// Merge returns a copy of the table with the non-empty values of overrides applied on top
+func (t CloseCodeTable) Merge(overrides CloseCodeTable) CloseCodeTable {
+	merged := make(CloseCodeTable, len(t))
+	for systemID, codes := range t {
+		codes.ClosedStates = slices.Clone(codes.ClosedStates)
+		codes.CloseCodes = maps.Clone(codes.CloseCodes)
+		merged[systemID] = codes
+	}
+
+	for systemID, override := range overrides {
+		codes := merged[systemID]
+		if override.ResolvedState != "" {
+			codes.ResolvedState = override.ResolvedState
+		}
+		if len(override.ClosedStates) > 0 {
+			codes.ClosedStates = slices.Clone(override.ClosedStates)
+		}
+		if codes.CloseCodes == nil {
+			codes.CloseCodes = map[string]string{}
+		}
+		for resolution, closeCode := range override.CloseCodes {
+			codes.CloseCodes[resolution] = closeCode
+		}
+		merged[systemID] = codes
+	}
+
+	return merged
+}
+
+// Validate checks that every configured system has a resolved state and at least one close code
+func (t CloseCodeTable) Validate() error {
+	for systemID, codes := range t {
+		if codes.ResolvedState == "" {
+			return fmt.Errorf("close codes for %s: resolved_state is required", systemID)
+		}
+		if len(codes.CloseCodes) == 0 {
+			return fmt.Errorf("close codes for %s: at least one close code is required", systemID)
+		}
+	}
+
+	return nil
+}
+
+// IsClosed reports whether a ticket state is one of the configured closed states
+func (c TicketCloseCodes) IsClosed(state string) bool {
+	return state != "" && slices.Contains(c.ClosedStates, state)
+}
+
+// CloseTicketRequest represents the request body for closing the ticket mapped to an entity
+type CloseTicketRequest struct {
+	ConfigID         string `json:"config_id"`
+	EntityID         string `json:"entity_id"`
+	ExternalSystemID string `json:"external_system_id"`
+	Resolution       string `json:"resolution"`
+	CloseNotes       string `json:"close_notes"`
+}
+
+// CloseTicketResponse represents the response body for closing a ticket
+type CloseTicketResponse struct {
+	TicketID      string `json:"ticket_id"`
+	TicketType    string `json:"ticket_type"`
+	AlreadyClosed bool   `json:"already_closed"`
+	CloseCode     string `json:"close_code,omitempty"`
+	State         string `json:"state"`
+}
+
+// HandleCloseTicket handles the /close_ticket endpoint
+func (h *Handler) HandleCloseTicket(ctx context.Context, r fdk.RequestOf[CloseTicketRequest], wrkCtx fdk.WorkflowCtx) fdk.Response {
+	ctx = withHandlerPath(ctx, "/close_ticket")
+	h.logger.Info("Closing ticket", "trace_id", r.TraceID, "wrk_ctx", wrkCtx)
+
+	externalSystemID := r.Body.ExternalSystemID
+	if externalSystemID == "" {
+		externalSystemID = ExternalSystemIDServiceNowIncident
+	}
+
+	ticketOps, ok := serviceNowTicketOpsBySystem[externalSystemID]
+	if !ok {
+		errMsg := fmt.Sprintf("unsupported external system ID: %s", externalSystemID)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: errMsg})
+	}
+
+	closeCodes := h.closeCodes
+	if closeCodes == nil {
+		closeCodes = DefaultCloseCodes()
+	}
+	systemCloseCodes := closeCodes[externalSystemID]
+
+	resolution := strings.ToLower(strings.TrimSpace(r.Body.Resolution))
+	closeCode, ok := systemCloseCodes.CloseCodes[resolution]
+	if !ok {
+		errMsg := fmt.Sprintf("unsupported resolution: %s (must be one of: %s)",
+			r.Body.Resolution, strings.Join(slices.Sorted(maps.Keys(systemCloseCodes.CloseCodes)), ", "))
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: errMsg})
+	}
+
+	falconClient, _, err := h.falconClientFunc(r.AccessToken, h.logger)
+	if err != nil {
+		errMsg := fmt.Sprintf("error creating Falcon client: %v", err)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: errMsg})
+	}
+
+	exists, extRecord, err := storage.CheckExternalEntityExists(ctx, falconClient.CustomStorage, h.logger, r.Body.EntityID, externalSystemID)
+	if err != nil {
+		errMsg := fmt.Sprintf("failed to check if ticket exists: %v", err)
+		return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: errMsg})
+	}
+
+	if !exists {
+		errMsg := fmt.Sprintf("no %s ticket is mapped to entity %s", externalSystemID, r.Body.EntityID)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusNotFound, Message: errMsg})
+	}
+
+	// The ticket may have been closed in ServiceNow directly, so look at its current state first
+	currentState := extRecord.ExternalLastKnownStatus
+	if !systemCloseCodes.IsClosed(currentState) {
+		records, err := h.executeServiceNowListCommand(ctx, falconClient, r.Body.ConfigID, ticketOps.GetOpID, &models.DomainRequest{
+			Params: &models.DomainParams{
+				Query: map[string]string{"sysparm_query": "sys_id=" + extRecord.ExternalEntityID},
+			},
+		})
+		if err != nil {
+			return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: err.Error()})
+		}
+
+		if len(records) > 0 {
+			if state, ok := records[0]["state"].(string); ok {
+				currentState = state
+			}
+		}
+	}
+
+	if systemCloseCodes.IsClosed(currentState) {
+		h.logger.Info("ticket is already closed", "entity_id", r.Body.EntityID, "ticket_id", extRecord.ExternalEntityID, "state", currentState)
+
+		if extRecord.ExternalLastKnownStatus != currentState {
+			updateTime := timeNow().UTC().Unix()
+			if _, err := h.updateEntityMapping(ctx, falconClient, extRecord, func(record *storage.ExternalEntityRecord) error {
+				record.ExternalLastKnownStatus = currentState
+				record.ExternalLastUpdateTime = updateTime
+				return nil
+			}); err != nil {
+				return h.mappingErrResp(err)
+			}
+		}
+
+		return fdk.Response{
+			Code: http.StatusOK,
+			Body: fdk.JSON(CloseTicketResponse{
+				TicketID:      extRecord.ExternalEntityID,
+				TicketType:    ticketOps.TicketType,
+				AlreadyClosed: true,
+				State:         currentState,
+			}),
+		}
+	}
+
+	closeNotes := r.Body.CloseNotes
+	if closeNotes == "" {
+		closeNotes = fmt.Sprintf("Closed by CrowdStrike Falcon (resolution: %s)", resolution)
+	}
+
+	result, err := h.executeServiceNowRecordCommand(ctx, falconClient, r.Body.ConfigID, ticketOps.UpdateOpID, &models.DomainRequest{
+		JSON: map[string]interface{}{
+			"state":       systemCloseCodes.ResolvedState,
+			"close_code":  closeCode,
+			"close_notes": closeNotes,
+		},
+		Params: &models.DomainParams{
+			Path: map[string]string{"sys_id": extRecord.ExternalEntityID},
+		},
+	})
+	if err != nil {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: err.Error()})
+	}
+
+	state, _ := result["state"].(string)
+	if state == "" {
+		state = systemCloseCodes.ResolvedState
+	}
+
+	updateTime := parseServiceNowTime(result["sys_updated_on"])
+	if _, err := h.updateEntityMapping(ctx, falconClient, extRecord, func(record *storage.ExternalEntityRecord) error {
+		record.ExternalLastKnownStatus = state
+		record.ExternalLastUpdateTime = updateTime
+		return nil
+	}); err != nil {
+		return h.mappingErrResp(err)
+	}
+
+	h.logger.Info("closed ticket in ITSM", "ticket_id", extRecord.ExternalEntityID, "close_code", closeCode, "state", state)
+
+	return fdk.Response{
+		Code: http.StatusOK,
+		Body: fdk.JSON(CloseTicketResponse{
+			TicketID:   extRecord.ExternalEntityID,
+			TicketType: ticketOps.TicketType,
+			CloseCode:  closeCode,
+			State:      state,
+		}),
+	}
+}
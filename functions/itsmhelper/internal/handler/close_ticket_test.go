@@ -0,0 +1,281 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+	"github.com/crowdstrike/gofalcon/falcon/client"
+	"github.com/crowdstrike/gofalcon/falcon/client/api_integrations"
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+	"github.com/go-openapi/runtime"
+)
+
+// TestHandleCloseTicket tests the Handler.HandleCloseTicket method
+func (s *HandlerTestSuite) TestHandleCloseTicket() {
+	mappedRecord := func(systemID, status string) func(*custom_storage.GetObjectParams, io.Writer, ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+		return func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+			json.NewEncoder(writer).Encode(storage.ExternalEntityRecord{
+				InternalEntityID:        "entity123",
+				ExternalEntityID:        "sys123",
+				ExternalSystemID:        systemID,
+				ExternalLastKnownStatus: status,
+			})
+			return &custom_storage.GetObjectOK{}, nil
+		}
+	}
+
+	tests := []struct {
+		name          string
+		request       CloseTicketRequest
+		closeCodes    CloseCodeTable
+		storedRecord  func(*custom_storage.GetObjectParams, io.Writer, ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error)
+		currentState  string
+		wantOps       []string
+		wantPatch     map[string]interface{}
+		wantCode      int
+		wantBody      map[string]interface{}
+		wantStoredSet bool
+		wantStatus    string
+		wantErrors    []fdk.APIError
+	}{
+		{
+			name: "Resolve incident as true positive",
+			request: CloseTicketRequest{
+				ConfigID:   "config123",
+				EntityID:   "entity123",
+				Resolution: ResolutionTruePositive,
+				CloseNotes: "Host contained",
+			},
+			storedRecord: mappedRecord(ExternalSystemIDServiceNowIncident, "2"),
+			currentState: "2",
+			wantOps:      []string{pluginOpIDServiceNowGetIncident, pluginOpIDServiceNowUpdateIncident},
+			wantPatch: map[string]interface{}{
+				"state":       "6",
+				"close_code":  "Solution provided",
+				"close_notes": "Host contained",
+			},
+			wantCode: 200,
+			wantBody: map[string]interface{}{
+				"ticket_id":      "sys123",
+				"ticket_type":    "incident",
+				"already_closed": false,
+				"close_code":     "Solution provided",
+				"state":          "6",
+			},
+			wantStoredSet: true,
+			wantStatus:    "6",
+		},
+		{
+			name: "Resolve SIR incident with configured close codes",
+			request: CloseTicketRequest{
+				ConfigID:         "config123",
+				EntityID:         "entity123",
+				ExternalSystemID: ExternalSystemIDServiceNowSIRIncident,
+				Resolution:       "False_Positive",
+			},
+			closeCodes: DefaultCloseCodes().Merge(CloseCodeTable{
+				ExternalSystemIDServiceNowSIRIncident: {
+					CloseCodes: map[string]string{ResolutionFalsePositive: "Benign"},
+				},
+			}),
+			storedRecord: mappedRecord(ExternalSystemIDServiceNowSIRIncident, ""),
+			currentState: "18",
+			wantOps:      []string{pluginOpIDServiceNowGetSIRIncident, pluginOpIDServiceNowUpdateSIRIncident},
+			wantPatch: map[string]interface{}{
+				"state":       "3",
+				"close_code":  "Benign",
+				"close_notes": "Closed by CrowdStrike Falcon (resolution: false_positive)",
+			},
+			wantCode: 200,
+			wantBody: map[string]interface{}{
+				"ticket_type":    "sn_si_incident",
+				"already_closed": false,
+				"close_code":     "Benign",
+				"state":          "3",
+			},
+			wantStoredSet: true,
+			wantStatus:    "3",
+		},
+		{
+			name: "Ticket already closed in ServiceNow",
+			request: CloseTicketRequest{
+				ConfigID:   "config123",
+				EntityID:   "entity123",
+				Resolution: ResolutionFalsePositive,
+			},
+			storedRecord: mappedRecord(ExternalSystemIDServiceNowIncident, "2"),
+			currentState: "7",
+			wantOps:      []string{pluginOpIDServiceNowGetIncident},
+			wantCode:     200,
+			wantBody: map[string]interface{}{
+				"ticket_id":      "sys123",
+				"already_closed": true,
+				"state":          "7",
+			},
+			wantStoredSet: true,
+			wantStatus:    "7",
+		},
+		{
+			name: "Ticket already known to be closed",
+			request: CloseTicketRequest{
+				ConfigID:   "config123",
+				EntityID:   "entity123",
+				Resolution: ResolutionIgnored,
+			},
+			storedRecord: mappedRecord(ExternalSystemIDServiceNowIncident, "6"),
+			wantCode:     200,
+			wantBody: map[string]interface{}{
+				"already_closed": true,
+				"state":          "6",
+			},
+		},
+		{
+			name: "Unsupported resolution",
+			request: CloseTicketRequest{
+				ConfigID:   "config123",
+				EntityID:   "entity123",
+				Resolution: "maybe",
+			},
+			wantCode: 400,
+			wantErrors: []fdk.APIError{
+				{Code: 400, Message: "unsupported resolution: maybe (must be one of: false_positive, ignored, true_positive)"},
+			},
+		},
+		{
+			name: "No ticket mapped to entity",
+			request: CloseTicketRequest{
+				ConfigID:   "config123",
+				EntityID:   "entity123",
+				Resolution: ResolutionTruePositive,
+			},
+			storedRecord: func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+				return nil, runtime.NewAPIError("GetObject", nil, 404)
+			},
+			wantCode: 404,
+			wantErrors: []fdk.APIError{
+				{Code: 404, Message: "no servicenow_incident ticket is mapped to entity entity123"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+
+			stored := new(bytes.Buffer)
+			s.mockStorage.GetObjectFunc = tc.storedRecord
+			s.mockStorage.PutObjectFunc = func(params *custom_storage.PutObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.PutObjectOK, error) {
+				io.Copy(stored, params.Body)
+				return &custom_storage.PutObjectOK{}, nil
+			}
+
+			var calledOps []string
+			s.mockAPIIntegrations.ExecuteCommandFunc = func(params *api_integrations.ExecuteCommandParams, opts ...api_integrations.ClientOption) (*api_integrations.ExecuteCommandOK, error) {
+				resource := params.Body.Resources[0]
+				calledOps = append(calledOps, *resource.OperationID)
+
+				var body map[string]interface{}
+				switch *resource.OperationID {
+				case pluginOpIDServiceNowGetIncident, pluginOpIDServiceNowGetSIRIncident:
+					s.Equal(map[string]string{"sysparm_query": "sys_id=sys123"}, resource.Request.Params.Query)
+					body = map[string]interface{}{"result": []interface{}{
+						map[string]interface{}{"sys_id": "sys123", "state": tc.currentState},
+					}}
+				default:
+					s.Equal(map[string]string{"sys_id": "sys123"}, resource.Request.Params.Path)
+					s.Equal(tc.wantPatch, resource.Request.JSON)
+					body = map[string]interface{}{"result": map[string]interface{}{
+						"sys_id":         "sys123",
+						"state":          tc.wantPatch["state"],
+						"sys_updated_on": "2025-04-28 14:45:22",
+					}}
+				}
+
+				return &api_integrations.ExecuteCommandOK{
+					Payload: &models.DomainExecuteCommandResultsV1{
+						Resources: []*models.DomainExecuteCommandResultV1{{ResponseBody: body}},
+					},
+				}, nil
+			}
+
+			mockClientBuilder := func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+				mockClient := &client.CrowdStrikeAPISpecification{}
+				mockClient.CustomStorage = s.mockStorage
+				mockClient.APIIntegrations = s.mockAPIIntegrations
+				return mockClient, "us-1", nil
+			}
+
+			handler := &Handler{
+				logger:           s.logger,
+				falconClientFunc: mockClientBuilder,
+				closeCodes:       tc.closeCodes,
+			}
+
+			response := handler.HandleCloseTicket(context.Background(), fdk.RequestOf[CloseTicketRequest]{
+				Body:        tc.request,
+				AccessToken: "test-token",
+			}, fdk.WorkflowCtx{})
+			s.Equal(tc.wantCode, response.Code, "Response code should match expected value")
+			s.Equal(tc.wantOps, calledOps, "ServiceNow operations should match expected sequence")
+
+			if len(tc.wantErrors) > 0 {
+				s.Nil(response.Body, "Response body should be nil for error responses")
+				s.Len(response.Errors, len(tc.wantErrors), "Response should have the expected number of errors")
+				for i, wantErr := range tc.wantErrors {
+					s.Equal(wantErr.Code, response.Errors[i].Code, "Error code should match expected value")
+					s.Equal(wantErr.Message, response.Errors[i].Message, "Error message should match expected value")
+				}
+				return
+			}
+
+			jsonBytes, err := json.Marshal(response.Body)
+			s.NoError(err, "Failed to marshal JSON body")
+
+			var actual map[string]interface{}
+			s.NoError(json.Unmarshal(jsonBytes, &actual), "Failed to unmarshal JSON body")
+
+			for k, v := range tc.wantBody {
+				actualVal, exists := actual[k]
+				s.True(exists, "Expected key %q not found in response", k)
+				s.Equal(v, actualVal, "For key %q, expected value should match actual value", k)
+			}
+
+			if !tc.wantStoredSet {
+				s.Zero(stored.Len(), "Mapping should not be rewritten")
+				return
+			}
+
+			var record storage.ExternalEntityRecord
+			s.NoError(json.Unmarshal(stored.Bytes(), &record), "Failed to unmarshal stored record")
+			s.Equal(tc.wantStatus, record.ExternalLastKnownStatus, "Stored mapping should be marked as closed")
+		})
+	}
+}
+
+// TestCloseCodeTableMerge tests the CloseCodeTable.Merge method
+func (s *HandlerTestSuite) TestCloseCodeTableMerge() {
+	defaults := DefaultCloseCodes()
+	merged := defaults.Merge(CloseCodeTable{
+		ExternalSystemIDServiceNowIncident: {
+			ResolvedState: "7",
+			CloseCodes:    map[string]string{ResolutionIgnored: "Duplicate"},
+		},
+	})
+
+	incident := merged[ExternalSystemIDServiceNowIncident]
+	s.Equal("7", incident.ResolvedState)
+	s.Equal("Duplicate", incident.CloseCodes[ResolutionIgnored])
+	s.Equal("Solution provided", incident.CloseCodes[ResolutionTruePositive], "unset resolutions should keep their defaults")
+	s.Equal([]string{"6", "7", "8"}, incident.ClosedStates, "unset closed states should keep their defaults")
+	s.Equal("No resolution provided", defaults[ExternalSystemIDServiceNowIncident].CloseCodes[ResolutionIgnored], "defaults must not be modified")
+	s.NoError(merged.Validate())
+
+	s.Error(CloseCodeTable{"custom_system": {CloseCodes: map[string]string{ResolutionIgnored: "x"}}}.Validate())
+}
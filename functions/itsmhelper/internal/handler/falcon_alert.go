@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/crowdstrike/gofalcon/falcon/client"
+	"github.com/crowdstrike/gofalcon/falcon/client/alerts"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+)
+
+// FalconAlertTagPrefix prefixes the ticket number in the tag added to a Falcon alert
+const FalconAlertTagPrefix = "servicenow:"
+
+// Alert update actions of the Falcon Alerts API
+const (
+	alertActionAppendComment = "append_comment"
+	alertActionAddTag        = "add_tag"
+)
+
+// WithServiceNowInstanceURL sets the base URL of the ServiceNow instance, e.g. https://example.service-now.com,
+// used to link tickets from Falcon alert comments. Without it, comments carry the ticket number only.
+func WithServiceNowInstanceURL(instanceURL string) Option {
+	return func(h *Handler) {
+		h.serviceNowInstanceURL = strings.TrimRight(instanceURL, "/")
+	}
+}
+
+// ticketURL returns the link to a ticket on the ServiceNow instance, or "" when no instance URL is configured
+func (h *Handler) ticketURL(table, sysID string) string {
+	if h.serviceNowInstanceURL == "" || table == "" || sysID == "" {
+		return ""
+	}
+	return h.serviceNowInstanceURL + "/nav_to.do?uri=" + url.QueryEscape(table+".do?sys_id="+sysID)
+}
+
+// updateFalconAlert comments on the Falcon alert a ticket was created for and tags it with the ticket number
+func (h *Handler) updateFalconAlert(
+	ctx context.Context,
+	falconClient *client.CrowdStrikeAPISpecification,
+	body CreateIncidentRequest,
+	ticketNumber string,
+	ticketURL string,
+) error {
+	var actions []*models.MsaspecActionParameter
+	if body.CommentOnFalconAlert {
+		comment := fmt.Sprintf("ServiceNow ticket %s was created for this alert", ticketNumber)
+		if ticketURL != "" {
+			comment += ": " + ticketURL
+		}
+		actions = append(actions, alertAction(alertActionAppendComment, comment))
+	}
+	if body.TagFalconAlert {
+		actions = append(actions, alertAction(alertActionAddTag, FalconAlertTagPrefix+ticketNumber))
+	}
+	if len(actions) == 0 {
+		return nil
+	}
+
+	resp, err := falconClient.Alerts.UpdateV3(&alerts.UpdateV3Params{
+		Body: &models.DetectsapiPatchEntitiesAlertsV3Request{
+			CompositeIds:     []string{body.EntityID},
+			ActionParameters: actions,
+		},
+		Context: ctx,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update Falcon alert %s: %w", body.EntityID, err)
+	}
+	if resp != nil && resp.Payload != nil {
+		if err := alertAPIErrors(resp.Payload.Errors); err != nil {
+			return fmt.Errorf("failed to update Falcon alert %s: %w", body.EntityID, err)
+		}
+	}
+
+	h.logger.Info("updated Falcon alert with ticket", "entity_id", body.EntityID, "ticket_number", ticketNumber)
+	return nil
+}
+
+// alertAction returns an update action of the Falcon Alerts API
+func alertAction(name, value string) *models.MsaspecActionParameter {
+	return &models.MsaspecActionParameter{Name: &name, Value: &value}
+}
+
+// alertAPIErrors joins the errors reported in the body of a successful Falcon Alerts API response
+func alertAPIErrors(apiErrors []*models.MsaAPIError) error {
+	var errs []error
+	for _, apiErr := range apiErrors {
+		if apiErr == nil || apiErr.Message == nil {
+			continue
+		}
+		errs = append(errs, errors.New(*apiErr.Message))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,227 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+	"github.com/crowdstrike/gofalcon/falcon/client"
+	"github.com/crowdstrike/gofalcon/falcon/client/alerts"
+	"github.com/crowdstrike/gofalcon/falcon/client/api_integrations"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+	"github.com/go-openapi/runtime"
+)
+
+// TestCreateIncidentUpdatesFalconAlert tests commenting on and tagging the Falcon alert of a new ticket
+func (s *HandlerTestSuite) TestCreateIncidentUpdatesFalconAlert() {
+	apiErrMsg := "alert not found"
+
+	tests := []struct {
+		name         string
+		body         CreateIncidentRequest
+		instanceURL  string
+		updateResp   *alerts.UpdateV3OK
+		updateErr    error
+		wantCode     int
+		wantActions  map[string]string
+		wantResponse CreateIncidentResponse
+		wantError    string
+	}{
+		{
+			name:        "Comment and tag",
+			body:        CreateIncidentRequest{CommentOnFalconAlert: true, TagFalconAlert: true},
+			instanceURL: "https://example.service-now.com/",
+			wantCode:    201,
+			wantActions: map[string]string{
+				alertActionAppendComment: "ServiceNow ticket INC0012345 was created for this alert: https://example.service-now.com/nav_to.do?uri=incident.do%3Fsys_id%3Dsys1",
+				alertActionAddTag:        "servicenow:INC0012345",
+			},
+			wantResponse: CreateIncidentResponse{
+				TicketID:           "sys1",
+				TicketType:         "incident",
+				TicketNumber:       "INC0012345",
+				TicketURL:          "https://example.service-now.com/nav_to.do?uri=incident.do%3Fsys_id%3Dsys1",
+				FalconAlertUpdated: true,
+			},
+		},
+		{
+			name:     "Comment without an instance URL",
+			body:     CreateIncidentRequest{InternalEntityType: "alert", CommentOnFalconAlert: true},
+			wantCode: 201,
+			wantActions: map[string]string{
+				alertActionAppendComment: "ServiceNow ticket INC0012345 was created for this alert",
+			},
+			wantResponse: CreateIncidentResponse{TicketID: "sys1", TicketType: "incident", TicketNumber: "INC0012345", FalconAlertUpdated: true},
+		},
+		{
+			name:         "Alert not updated unless requested",
+			body:         CreateIncidentRequest{},
+			wantCode:     201,
+			wantResponse: CreateIncidentResponse{TicketID: "sys1", TicketType: "incident", TicketNumber: "INC0012345"},
+		},
+		{
+			name:        "Alerts API failure keeps the ticket",
+			body:        CreateIncidentRequest{TagFalconAlert: true},
+			updateErr:   alerts.NewUpdateV3Forbidden(),
+			wantCode:    201,
+			wantActions: map[string]string{alertActionAddTag: "servicenow:INC0012345"},
+			wantResponse: CreateIncidentResponse{
+				TicketID:         "sys1",
+				TicketType:       "incident",
+				TicketNumber:     "INC0012345",
+				FalconAlertError: "failed to update Falcon alert alert1: [PATCH /alerts/entities/alerts/v3][403] updateV3Forbidden  <nil>",
+			},
+		},
+		{
+			name:        "Alerts API reports errors",
+			body:        CreateIncidentRequest{TagFalconAlert: true},
+			updateResp:  &alerts.UpdateV3OK{Payload: &models.DetectsapiResponseFields{Errors: []*models.MsaAPIError{{Message: &apiErrMsg}}}},
+			wantCode:    201,
+			wantActions: map[string]string{alertActionAddTag: "servicenow:INC0012345"},
+			wantResponse: CreateIncidentResponse{
+				TicketID:         "sys1",
+				TicketType:       "incident",
+				TicketNumber:     "INC0012345",
+				FalconAlertError: "failed to update Falcon alert alert1: alert not found",
+			},
+		},
+		{
+			name:      "Entity is not an alert",
+			body:      CreateIncidentRequest{InternalEntityType: "host", CommentOnFalconAlert: true},
+			wantCode:  400,
+			wantError: "comment_on_falcon_alert and tag_falcon_alert require an alert entity, got internal_entity_type host",
+		},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+
+			s.mockAPIIntegrations.ExecuteCommandFunc = func(params *api_integrations.ExecuteCommandParams, opts ...api_integrations.ClientOption) (*api_integrations.ExecuteCommandOK, error) {
+				return &api_integrations.ExecuteCommandOK{
+					Payload: &models.DomainExecuteCommandResultsV1{
+						Resources: []*models.DomainExecuteCommandResultV1{{
+							ResponseBody: map[string]interface{}{
+								"result": map[string]interface{}{"sys_id": "sys1", "number": "INC0012345", "sys_class_name": "incident", "state": "1"},
+							},
+						}},
+					},
+				}, nil
+			}
+
+			var updates []*alerts.UpdateV3Params
+			mockAlerts := &MockAlertsService{
+				UpdateV3Func: func(params *alerts.UpdateV3Params, opts ...alerts.ClientOption) (*alerts.UpdateV3OK, error) {
+					updates = append(updates, params)
+					if tc.updateErr != nil {
+						return nil, tc.updateErr
+					}
+					if tc.updateResp != nil {
+						return tc.updateResp, nil
+					}
+					return &alerts.UpdateV3OK{Payload: &models.DetectsapiResponseFields{}}, nil
+				},
+			}
+
+			memStorage := storage.NewMemoryStorageService()
+			handler := NewHandler(s.logger, func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+				mockClient := &client.CrowdStrikeAPISpecification{}
+				mockClient.CustomStorage = memStorage
+				mockClient.APIIntegrations = s.mockAPIIntegrations
+				mockClient.Alerts = mockAlerts
+				return mockClient, "us-1", nil
+			}, WithServiceNowInstanceURL(tc.instanceURL))
+
+			body := tc.body
+			body.ConfigID = "config123"
+			body.EntityID = "alert1"
+			body.ShortDescription = "Test incident"
+			response := handler.HandleCreateIncident(context.Background(), fdk.RequestOf[CreateIncidentRequest]{Body: body, AccessToken: "test-token"}, fdk.WorkflowCtx{})
+
+			s.Equal(tc.wantCode, response.Code)
+			if tc.wantError != "" {
+				s.Require().Len(response.Errors, 1)
+				s.Equal(tc.wantError, response.Errors[0].Message)
+				s.Empty(updates)
+				return
+			}
+
+			jsonBytes, err := json.Marshal(response.Body)
+			s.Require().NoError(err)
+			var got CreateIncidentResponse
+			s.Require().NoError(json.Unmarshal(jsonBytes, &got))
+			s.Equal(tc.wantResponse, got)
+
+			// The mapping is stored whether or not the alert was updated
+			exists, record, err := storage.CheckExternalEntityExists(context.Background(), memStorage, s.logger, "alert1", ExternalSystemIDServiceNowIncident)
+			s.Require().NoError(err)
+			s.True(exists)
+			s.Equal("sys1", record.ExternalEntityID)
+
+			if tc.wantActions == nil {
+				s.Empty(updates)
+				return
+			}
+			s.Require().Len(updates, 1)
+			s.Equal([]string{"alert1"}, updates[0].Body.CompositeIds)
+			actions := make(map[string]string)
+			for _, action := range updates[0].Body.ActionParameters {
+				actions[*action.Name] = *action.Value
+			}
+			s.Equal(tc.wantActions, actions)
+		})
+	}
+}
+
+// MockAlertsService implements the Falcon Alerts service for testing
+type MockAlertsService struct {
+	UpdateV3Func func(*alerts.UpdateV3Params, ...alerts.ClientOption) (*alerts.UpdateV3OK, error)
+}
+
+func (m *MockAlertsService) GetAggregateV2(params *alerts.GetAggregateV2Params, opts ...alerts.ClientOption) (*alerts.GetAggregateV2OK, error) {
+	panic("not implemented")
+}
+
+func (m *MockAlertsService) GetQueriesAlertsV1(params *alerts.GetQueriesAlertsV1Params, opts ...alerts.ClientOption) (*alerts.GetQueriesAlertsV1OK, error) {
+	panic("not implemented")
+}
+
+func (m *MockAlertsService) GetV2(params *alerts.GetV2Params, opts ...alerts.ClientOption) (*alerts.GetV2OK, error) {
+	panic("not implemented")
+}
+
+func (m *MockAlertsService) PatchEntitiesAlertsV2(params *alerts.PatchEntitiesAlertsV2Params, opts ...alerts.ClientOption) (*alerts.PatchEntitiesAlertsV2OK, error) {
+	panic("not implemented")
+}
+
+func (m *MockAlertsService) PostAggregatesAlertsV1(params *alerts.PostAggregatesAlertsV1Params, opts ...alerts.ClientOption) (*alerts.PostAggregatesAlertsV1OK, error) {
+	panic("not implemented")
+}
+
+func (m *MockAlertsService) PostCombinedAlertsV1(params *alerts.PostCombinedAlertsV1Params, opts ...alerts.ClientOption) (*alerts.PostCombinedAlertsV1OK, error) {
+	panic("not implemented")
+}
+
+func (m *MockAlertsService) PostEntitiesAlertsV1(params *alerts.PostEntitiesAlertsV1Params, opts ...alerts.ClientOption) (*alerts.PostEntitiesAlertsV1OK, error) {
+	panic("not implemented")
+}
+
+func (m *MockAlertsService) QueryV2(params *alerts.QueryV2Params, opts ...alerts.ClientOption) (*alerts.QueryV2OK, error) {
+	panic("not implemented")
+}
+
+// UpdateV3 implements the UpdateV3 method for the mock
+func (m *MockAlertsService) UpdateV3(params *alerts.UpdateV3Params, opts ...alerts.ClientOption) (*alerts.UpdateV3OK, error) {
+	if m.UpdateV3Func != nil {
+		return m.UpdateV3Func(params, opts...)
+	}
+	return nil, nil
+}
+
+// SetTransport implements the SetTransport method for the mock
+func (m *MockAlertsService) SetTransport(transport runtime.ClientTransport) {
+	// No-op for the mock
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+)
+
+// GCDedupStoreRequest represents the request body for collecting expired dedup records
+type GCDedupStoreRequest struct {
+	Cursor    string `json:"cursor,omitempty"`
+	MaxScan   int    `json:"max_scan,omitempty"`
+	BatchSize int    `json:"batch_size,omitempty"`
+}
+
+// GCDedupStoreResponse represents the response body for collecting expired dedup records
+type GCDedupStoreResponse struct {
+	Scanned    int    `json:"scanned"`
+	Deleted    int    `json:"deleted"`
+	NextCursor string `json:"next_cursor"`
+	Completed  bool   `json:"completed"`
+}
+
+// HandleGCDedupStore handles the /gc_dedup_store endpoint
+func (h *Handler) HandleGCDedupStore(ctx context.Context, r fdk.RequestOf[GCDedupStoreRequest]) fdk.Response {
+	if r.Body.MaxScan < 0 || r.Body.BatchSize < 0 {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: "max_scan and batch_size must not be negative"})
+	}
+
+	falconClient, _, err := h.falconClientFunc(r.AccessToken, h.logger)
+	if err != nil {
+		errMsg := fmt.Sprintf("error creating Falcon client: %v", err)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: errMsg})
+	}
+
+	result, err := storage.CollectExpiredDedupRecords(ctx, falconClient.CustomStorage, h.logger, storage.GCOptions{
+		Cursor:    r.Body.Cursor,
+		MaxScan:   r.Body.MaxScan,
+		BatchSize: r.Body.BatchSize,
+	})
+	if err != nil {
+		h.logger.Error("dedup store garbage collection failed", "error", err, "scanned", result.Scanned, "deleted", result.Deleted)
+		return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: err.Error()})
+	}
+
+	return fdk.Response{
+		Code: http.StatusOK,
+		Body: fdk.JSON(GCDedupStoreResponse{
+			Scanned:    result.Scanned,
+			Deleted:    result.Deleted,
+			NextCursor: result.NextCursor,
+			Completed:  result.NextCursor == "",
+		}),
+	}
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+	"github.com/crowdstrike/gofalcon/falcon/client"
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+)
+
+// TestHandleGCDedupStore tests the Handler.HandleGCDedupStore method
+func (s *HandlerTestSuite) TestHandleGCDedupStore() {
+	tests := []struct {
+		name      string
+		request   GCDedupStoreRequest
+		listErr   error
+		wantCode  int
+		wantBody  GCDedupStoreResponse
+		wantError string
+	}{
+		{
+			name:     "Expired records are deleted",
+			wantCode: 200,
+			wantBody: GCDedupStoreResponse{Scanned: 2, Deleted: 1, Completed: true},
+		},
+		{
+			name:     "Run is bounded",
+			request:  GCDedupStoreRequest{MaxScan: 1},
+			wantCode: 200,
+			wantBody: GCDedupStoreResponse{Scanned: 1, Deleted: 1, NextCursor: "expired"},
+		},
+		{
+			name:      "Negative bounds",
+			request:   GCDedupStoreRequest{MaxScan: -1},
+			wantCode:  400,
+			wantError: "max_scan and batch_size must not be negative",
+		},
+		{
+			name:      "Storage rate limited",
+			listErr:   custom_storage.NewListObjectsTooManyRequests(),
+			wantCode:  429,
+			wantError: "failed to list dedup records",
+		},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+
+			records := map[string]string{
+				"expired": `{"time_bucket":"5 minutes","expires_at":1}`,
+				"forever": `{"time_bucket":"forever"}`,
+			}
+			s.mockStorage.ListObjectsFunc = func(params *custom_storage.ListObjectsParams, opts ...custom_storage.ClientOption) (*custom_storage.ListObjectsOK, error) {
+				if tc.listErr != nil {
+					return nil, tc.listErr
+				}
+				keys := []string{"expired", "forever"}
+				if params.Limit < int64(len(keys)) {
+					keys = keys[:params.Limit]
+				}
+				return &custom_storage.ListObjectsOK{Payload: &models.CustomStorageObjectKeys{Resources: keys}}, nil
+			}
+			s.mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+				_, err := io.Copy(writer, strings.NewReader(records[params.ObjectKey]))
+				return &custom_storage.GetObjectOK{}, err
+			}
+			var deleted []string
+			s.mockStorage.DeleteFunc = func(params *custom_storage.DeleteObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.DeleteObjectOK, error) {
+				deleted = append(deleted, params.ObjectKey)
+				return &custom_storage.DeleteObjectOK{}, nil
+			}
+
+			handler := &Handler{
+				logger: s.logger,
+				falconClientFunc: func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+					mockClient := &client.CrowdStrikeAPISpecification{}
+					mockClient.CustomStorage = s.mockStorage
+					return mockClient, "us-1", nil
+				},
+			}
+
+			response := handler.HandleGCDedupStore(context.Background(), fdk.RequestOf[GCDedupStoreRequest]{
+				Body:        tc.request,
+				AccessToken: "test-token",
+			})
+
+			s.Equal(tc.wantCode, response.Code)
+			if tc.wantError != "" {
+				s.Require().Len(response.Errors, 1)
+				s.Contains(response.Errors[0].Message, tc.wantError)
+				return
+			}
+
+			jsonBytes, err := json.Marshal(response.Body)
+			s.Require().NoError(err)
+			var body GCDedupStoreResponse
+			s.Require().NoError(json.Unmarshal(jsonBytes, &body))
+			s.Equal(tc.wantBody, body)
+			s.Equal([]string{"expired"}, deleted)
+		})
+	}
+}
@@ -2,10 +2,16 @@ package handler
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 
 	"itsmhelper/internal/storage"
 
@@ -26,23 +32,52 @@ var (
 
 	pluginOpIDServiceNowCreateIncident    = "create_incident"
 	pluginOpIDServiceNowCreateSIRIncident = "create_sn_si_incident"
+	pluginOpIDServiceNowUpdateIncident    = "update_incident"
+	pluginOpIDServiceNowUpdateSIRIncident = "update_sn_si_incident"
+	pluginOpIDServiceNowGetIncident       = "get_incident"
+	pluginOpIDServiceNowGetSIRIncident    = "get_sn_si_incident"
 )
 
+// serviceNowTicketOps describes the ServiceNow table and plugin operations behind an external system ID
+type serviceNowTicketOps struct {
+	TicketType string
+	GetOpID    string
+	UpdateOpID string
+}
+
+var serviceNowTicketOpsBySystem = map[string]serviceNowTicketOps{
+	ExternalSystemIDServiceNowIncident: {
+		TicketType: "incident",
+		GetOpID:    pluginOpIDServiceNowGetIncident,
+		UpdateOpID: pluginOpIDServiceNowUpdateIncident,
+	},
+	ExternalSystemIDServiceNowSIRIncident: {
+		TicketType: "sn_si_incident",
+		GetOpID:    pluginOpIDServiceNowGetSIRIncident,
+		UpdateOpID: pluginOpIDServiceNowUpdateSIRIncident,
+	},
+}
+
 type CheckIfExtExistsReq struct {
 	InternalEntityID string `json:"internal_entity_id"`
 	ExternalSystemID string `json:"external_system_id"`
 }
 
 type CreateEntityMappingReq struct {
-	InternalEntityID string `json:"internal_entity_id"`
-	ExternalEntityID string `json:"external_entity_id"`
-	ExternalSystemID string `json:"external_system_id"`
+	InternalEntityID   string `json:"internal_entity_id"`
+	InternalEntityType string `json:"internal_entity_type,omitempty"`
+	ExternalEntityID   string `json:"external_entity_id"`
+	ExternalSystemID   string `json:"external_system_id"`
+	// Reason is recorded in the mapping history when the entity was mapped to another ticket before
+	Reason string `json:"reason,omitempty"`
 }
 
 // CreateIncidentRequest represents the request body for creating an incident
 type CreateIncidentRequest struct {
 	ConfigID string `json:"config_id"`
 	EntityID string `json:"entity_id"`
+	// InternalEntityType is the kind of entity_id stored on the mapping, e.g. "alert"
+	InternalEntityType string `json:"internal_entity_type,omitempty"`
 
 	AssignmentGroup  string `json:"assignment_group"`
 	Category         string `json:"category"`
@@ -54,6 +89,18 @@ type CreateIncidentRequest struct {
 	Urgency          string `json:"urgency"`
 	WorkNotes        string `json:"work_notes"`
 	CustomFields     string `json:"custom_fields"`
+
+	// OverrideCoreFields allows custom_fields to set the fields above, e.g. short_description
+	OverrideCoreFields bool `json:"override_core_fields"`
+
+	// Context is the data that short_description, description, work_notes and custom field values are
+	// rendered against as Go templates, e.g. the alert from the workflow trigger
+	Context map[string]interface{} `json:"context,omitempty"`
+
+	// CommentOnFalconAlert posts the ticket number and link as a comment on the alert entity_id refers to
+	CommentOnFalconAlert bool `json:"comment_on_falcon_alert,omitempty"`
+	// TagFalconAlert tags the alert entity_id refers to with FalconAlertTagPrefix and the ticket number
+	TagFalconAlert bool `json:"tag_falcon_alert,omitempty"`
 }
 
 // CreateIncidentResponse represents the response body for creating an incident
@@ -61,6 +108,13 @@ type CreateIncidentResponse struct {
 	Exists     bool   `json:"exists"`
 	TicketID   string `json:"ticket_id"`
 	TicketType string `json:"ticket_type"`
+
+	TicketNumber string `json:"ticket_number,omitempty"`
+	TicketURL    string `json:"ticket_url,omitempty"`
+	// FalconAlertUpdated is set once the Falcon alert was commented on or tagged
+	FalconAlertUpdated bool `json:"falcon_alert_updated,omitempty"`
+	// FalconAlertError is set when the Falcon alert could not be updated; the ticket is kept either way
+	FalconAlertError string `json:"falcon_alert_error,omitempty"`
 }
 
 // ThrottleFunctionRequest represents the schema for deduplication requests
@@ -68,7 +122,76 @@ type ThrottleFunctionRequest struct {
 	InternalEntityID string `json:"internal_entity_id"`
 	DedupObjType     string `json:"dedup_obj_type"`
 	DedupObjID       string `json:"dedup_obj_id"`
-	TimeBucket       string `json:"time_bucket"`
+	// KeyFields identify the action instead of the ids above, e.g. tactic, technique, host and user
+	KeyFields  map[string]string `json:"key_fields,omitempty"`
+	TimeBucket string            `json:"time_bucket"`
+	// Mode is "fixed" (the default) or "sliding"
+	Mode string `json:"mode,omitempty"`
+	// MaxAllowed is the number of calls allowed per window, 1 if not set
+	MaxAllowed int `json:"max_allowed,omitempty"`
+	// Peek reports whether the call would be allowed without recording it
+	Peek bool `json:"peek,omitempty"`
+	// OnStorageError overrides the function's throttle failure policy for this call
+	OnStorageError ThrottleFailurePolicy `json:"on_storage_error,omitempty"`
+}
+
+// ThrottleFailurePolicy decides the outcome of /throttle when the dedup store is unavailable or rate limited
+type ThrottleFailurePolicy string
+
+const (
+	// ThrottleFailError responds with an error, stopping the workflow
+	ThrottleFailError ThrottleFailurePolicy = "error"
+	// ThrottleFailOpen allows the call
+	ThrottleFailOpen ThrottleFailurePolicy = "open"
+	// ThrottleFailClosed suppresses the call
+	ThrottleFailClosed ThrottleFailurePolicy = "closed"
+)
+
+// Validate checks that the policy is one of the supported values; empty means the default
+func (p ThrottleFailurePolicy) Validate() error {
+	switch p {
+	case "", ThrottleFailError, ThrottleFailOpen, ThrottleFailClosed:
+		return nil
+	}
+	return fmt.Errorf("unsupported throttle failure policy: %s (must be one of: %s, %s, %s)", p, ThrottleFailError, ThrottleFailOpen, ThrottleFailClosed)
+}
+
+// ThrottleResetRequest represents the request body for resetting a throttle
+type ThrottleResetRequest struct {
+	InternalEntityID string            `json:"internal_entity_id"`
+	DedupObjType     string            `json:"dedup_obj_type"`
+	DedupObjID       string            `json:"dedup_obj_id"`
+	KeyFields        map[string]string `json:"key_fields,omitempty"`
+	TimeBucket       string            `json:"time_bucket"`
+}
+
+// throttleParams returns the params identifying a throttled action, validating that it is identified
+// either by its ids or by key fields
+func throttleParams(internalEntityID, dedupObjType, dedupObjID string, keyFields map[string]string, timeBucket string) (storage.ThrottleParams, error) {
+	params := storage.ThrottleParams{
+		InternalEntityID: internalEntityID,
+		DedupObjType:     dedupObjType,
+		DedupObjID:       dedupObjID,
+		TimeBucket:       timeBucket,
+	}
+
+	if len(keyFields) == 0 {
+		if internalEntityID == "" || dedupObjType == "" || dedupObjID == "" {
+			return params, errors.New("internal_entity_id, dedup_obj_type and dedup_obj_id are required unless key_fields is set")
+		}
+		return params, nil
+	}
+
+	if internalEntityID != "" || dedupObjType != "" || dedupObjID != "" {
+		return params, errors.New("key_fields cannot be combined with internal_entity_id, dedup_obj_type or dedup_obj_id, add them to key_fields instead")
+	}
+	normalized, err := storage.NormalizeKeyFields(keyFields)
+	if err != nil {
+		return params, err
+	}
+	params.KeyFields = normalized
+
+	return params, nil
 }
 
 // FalconClientBuilder is a function type for creating Falcon clients
@@ -76,16 +199,87 @@ type FalconClientBuilder func(token string, logger *slog.Logger) (*client.CrowdS
 
 // Handler contains all the handler functions and dependencies
 type Handler struct {
-	logger           *slog.Logger
-	falconClientFunc FalconClientBuilder
+	logger             *slog.Logger
+	falconClientFunc   FalconClientBuilder
+	closeCodes         CloseCodeTable
+	maxAttachmentBytes int
+	creationLease      storage.LeaseOptions
+
+	retryPolicy          RetryPolicy
+	handlerRetryPolicies map[string]RetryPolicy
+
+	throttleFailurePolicy ThrottleFailurePolicy
+	legacyDedupKeysUntil  time.Time
+
+	webhookSecret         string
+	serviceNowInstanceURL string
+}
+
+// Option configures optional Handler behaviour
+type Option func(*Handler)
+
+// WithCloseCodes overrides the default Falcon resolution to ServiceNow close code mapping.
+// Entries are merged on top of DefaultCloseCodes, so only the differences need to be configured.
+func WithCloseCodes(closeCodes CloseCodeTable) Option {
+	return func(h *Handler) {
+		h.closeCodes = DefaultCloseCodes().Merge(closeCodes)
+	}
+}
+
+// WithMaxAttachmentBytes overrides DefaultMaxAttachmentBytes for the /add_attachment endpoint
+func WithMaxAttachmentBytes(maxBytes int) Option {
+	return func(h *Handler) {
+		if maxBytes > 0 {
+			h.maxAttachmentBytes = maxBytes
+		}
+	}
+}
+
+// WithCreationLease overrides the timings of the lease that serialises concurrent ticket creation for an entity
+func WithCreationLease(opts storage.LeaseOptions) Option {
+	return func(h *Handler) {
+		h.creationLease = opts.WithDefaults()
+	}
+}
+
+// WithThrottleFailurePolicy sets how /throttle responds when the dedup store is unavailable or rate limited
+func WithThrottleFailurePolicy(policy ThrottleFailurePolicy) Option {
+	return func(h *Handler) {
+		if policy != "" {
+			h.throttleFailurePolicy = policy
+		}
+	}
+}
+
+// WithLegacyDedupKeysUntil ends the migration window in which dedup records are also looked up under
+// their legacy md5 keys. Without it, legacy keys are read indefinitely.
+func WithLegacyDedupKeysUntil(until time.Time) Option {
+	return func(h *Handler) {
+		h.legacyDedupKeysUntil = until
+	}
+}
+
+// readLegacyDedupKeys reports whether the legacy dedup key migration window is still open
+func (h *Handler) readLegacyDedupKeys() bool {
+	return h.legacyDedupKeysUntil.IsZero() || timeNow().Before(h.legacyDedupKeysUntil)
 }
 
 // NewHandler creates a new Handler with the given logger
-func NewHandler(logger *slog.Logger, falconClientBuilder FalconClientBuilder) *Handler {
-	return &Handler{
-		logger:           logger,
-		falconClientFunc: falconClientBuilder,
+func NewHandler(logger *slog.Logger, falconClientBuilder FalconClientBuilder, opts ...Option) *Handler {
+	h := &Handler{
+		logger:             logger,
+		falconClientFunc:   falconClientBuilder,
+		closeCodes:         DefaultCloseCodes(),
+		maxAttachmentBytes: DefaultMaxAttachmentBytes,
+		creationLease:      storage.DefaultLeaseOptions(),
+		retryPolicy:        DefaultRetryPolicy(),
+	}
+
+	for _, opt := range opts {
+		opt(h)
 	}
+
+	return h
 }
 
 // HandleCheckIfExtEntityExists handles the /check_if_ext_entity_exists endpoint
@@ -105,7 +299,7 @@ func (h *Handler) HandleCheckIfExtEntityExists(ctx context.Context, r fdk.Reques
 	exists, extRecord, err := storage.CheckExternalEntityExists(ctx, falconClient.CustomStorage, h.logger, internalEntityID, externalSystemID)
 	if err != nil {
 		errMsg := fmt.Sprintf("failed to check if ticket exists: %v", err)
-		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: errMsg})
+		return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: errMsg})
 	}
 
 	if !exists {
@@ -120,9 +314,12 @@ func (h *Handler) HandleCheckIfExtEntityExists(ctx context.Context, r fdk.Reques
 	return fdk.Response{
 		Code: http.StatusOK,
 		Body: fdk.JSON(map[string]any{
-			"exists":        true,
-			"ext_id":        extRecord.ExternalEntityID,
-			"ext_system_id": extRecord.ExternalSystemID,
+			"exists":                     true,
+			"ext_id":                     extRecord.ExternalEntityID,
+			"ext_system_id":              extRecord.ExternalSystemID,
+			"internal_entity_type":       extRecord.InternalEntityType,
+			"external_last_known_status": extRecord.ExternalLastKnownStatus,
+			"external_last_update_time":  extRecord.ExternalLastUpdateTime,
 		}),
 	}
 }
@@ -139,14 +336,29 @@ func (h *Handler) HandleCreateEntityMapping(ctx context.Context, r fdk.RequestOf
 	_ = cloud
 
 	entityRecord := storage.ExternalEntityRecord{
-		InternalEntityID: r.Body.InternalEntityID,
-		ExternalEntityID: r.Body.ExternalEntityID,
-		ExternalSystemID: r.Body.ExternalSystemID,
+		InternalEntityID:   r.Body.InternalEntityID,
+		InternalEntityType: r.Body.InternalEntityType,
+		ExternalEntityID:   r.Body.ExternalEntityID,
+		ExternalSystemID:   r.Body.ExternalSystemID,
 	}
 
-	err = storage.CreateOrUpdateExternalEntityMapping(ctx, falconClient.CustomStorage, h.logger, entityRecord)
+	err = storage.ReplaceExternalEntityMapping(ctx, falconClient.CustomStorage, h.logger, entityRecord, r.Body.Reason)
 	if err != nil {
-		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: err.Error()})
+		return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: err.Error()})
+	}
+
+	// A ServiceNow mapping of the entity in another system, e.g. the incident of an entity escalated to a SIR
+	// incident, records that the entity moved. Repeating the request does not record the move twice.
+	if _, ok := serviceNowTicketOpsBySystem[entityRecord.ExternalSystemID]; ok {
+		for fromSystemID := range serviceNowTicketOpsBySystem {
+			if fromSystemID == entityRecord.ExternalSystemID {
+				continue
+			}
+			if _, err := storage.RecordExternalSystemMove(ctx, falconClient.CustomStorage, h.logger, fromSystemID, entityRecord, r.Body.Reason); err != nil {
+				errMsg := fmt.Sprintf("failed to record the move from %s: %v", fromSystemID, err)
+				return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: errMsg})
+			}
+		}
 	}
 
 	return fdk.Response{
@@ -155,8 +367,67 @@ func (h *Handler) HandleCreateEntityMapping(ctx context.Context, r fdk.RequestOf
 	}
 }
 
+// parseCustomFields parses the custom_fields JSON object and checks that it fits ServiceNow's flat field model
+func parseCustomFields(raw string) (map[string]interface{}, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	var customFields map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &customFields); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line, column := jsonPosition(raw, syntaxErr.Offset)
+			return nil, fmt.Errorf("invalid custom_fields JSON at line %d, column %d (offset %d): %v", line, column, syntaxErr.Offset, err)
+		}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("custom_fields must be a JSON object, got %s", typeErr.Value)
+		}
+		return nil, fmt.Errorf("invalid custom_fields JSON: %v", err)
+	}
+
+	keys := make([]string, 0, len(customFields))
+	for key := range customFields {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		if strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("custom_fields must not contain an empty field name")
+		}
+
+		switch customFields[key].(type) {
+		case string, float64, bool, nil:
+		default:
+			return nil, fmt.Errorf("custom_fields.%s: nested objects and arrays are not supported, ServiceNow fields take a single value (use a comma-separated string for list fields)", key)
+		}
+	}
+
+	return customFields, nil
+}
+
+// jsonPosition converts a byte offset reported by encoding/json into a 1-based line and column.
+// The offset points just past the offending byte, so the position returned is that of the byte itself.
+func jsonPosition(raw string, offset int64) (int, int) {
+	offset = min(max(offset-1, 0), int64(len(raw)))
+	before := raw[:offset]
+	line := strings.Count(before, "\n") + 1
+	column := len(before) - strings.LastIndex(before, "\n")
+	return line, column
+}
+
 // buildRequestPayload creates the request payload from the incident request
-func buildRequestPayload(body CreateIncidentRequest) map[string]interface{} {
+func buildRequestPayload(body CreateIncidentRequest) (map[string]interface{}, error) {
+	customFields, err := parseCustomFields(body.CustomFields)
+	if err != nil {
+		return nil, err
+	}
+	if err := renderIncidentTemplates(&body, customFields); err != nil {
+		return nil, err
+	}
+
 	requestPayload := map[string]interface{}{
 		"short_description": body.ShortDescription,
 	}
@@ -187,16 +458,197 @@ func buildRequestPayload(body CreateIncidentRequest) map[string]interface{} {
 		requestPayload["work_notes"] = body.WorkNotes
 	}
 
-	if body.CustomFields != "" {
-		var customFields map[string]interface{}
-		if err := json.Unmarshal([]byte(body.CustomFields), &customFields); err == nil {
-			for key, value := range customFields {
-				requestPayload[key] = value
+	keys := make([]string, 0, len(customFields))
+	for key := range customFields {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	// Custom fields may fill in core fields left empty, but only overwrite ones set in the request when allowed
+	for _, key := range keys {
+		if value, ok := requestPayload[key].(string); ok && value != "" && !body.OverrideCoreFields {
+			return nil, fmt.Errorf("custom_fields.%s would overwrite a core field, set override_core_fields to allow it", key)
+		}
+		requestPayload[key] = customFields[key]
+	}
+
+	return requestPayload, nil
+}
+
+// executeServiceNowCommand runs a ServiceNow plugin operation and returns its response body
+func (h *Handler) executeServiceNowCommand(
+	ctx context.Context,
+	falconClient *client.CrowdStrikeAPISpecification,
+	configID string,
+	operationID string,
+	request *models.DomainRequest,
+) (map[string]interface{}, error) {
+	execCmdParams := &api_integrations.ExecuteCommandParams{
+		Body: &models.DomainExecuteCommandRequestV1{Resources: []*models.DomainExecuteCommandV1{
+			{
+				DefinitionID: &pluginDefIDServiceNow,
+				OperationID:  &operationID,
+				ConfigID:     &configID,
+				Request:      request,
+			},
+		}},
+		Context: ctx,
+	}
+
+	policy := h.retryPolicyFor(ctx)
+
+	var execResp *api_integrations.ExecuteCommandOK
+	var err error
+	for attempt := 1; ; attempt++ {
+		execResp, err = falconClient.APIIntegrations.ExecuteCommand(execCmdParams)
+
+		failure := classifyExecuteCommandFailure(execResp, err)
+		if attempt >= policy.MaxAttempts || !policy.shouldRetry(failure, operationID, request) {
+			break
+		}
+
+		delay, ok := policy.backoff(attempt, failure.RetryAfter)
+		if !ok {
+			h.logger.Warn("ServiceNow asked to retry later than the retry policy allows, giving up",
+				"operation_id", operationID, "status_code", failure.StatusCode, "retry_after", failure.RetryAfter)
+			break
+		}
+		h.logger.Warn("transient ServiceNow failure, retrying",
+			"operation_id", operationID, "status_code", failure.StatusCode, "attempt", attempt, "delay", delay)
+		if !waitForRetry(ctx, delay) {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute command: %v", err)
+	}
+
+	if execResp == nil {
+		return nil, fmt.Errorf("failed to execute command - nil response")
+	}
+
+	h.logger.Info("plugin execution completed", "operation_id", operationID, "status_code", execResp.Code())
+	if execResp.Payload == nil {
+		return nil, fmt.Errorf("failed to execute command - empty response")
+	}
+
+	resources := execResp.Payload.Resources
+	if len(resources) == 0 {
+		return nil, fmt.Errorf("failed to execute command - empty resources in response payload")
+	}
+
+	resourceRespBody, _ := resources[0].ResponseBody.(map[string]interface{})
+
+	// Check if there's an error field in the response
+	if errorField, ok := resourceRespBody["error"]; ok {
+		var errorText string
+		// Convert the error field to a string
+		if errorStr, ok := errorField.(string); ok {
+			errorText = errorStr
+		} else {
+			// If it's not a string, try to convert it to JSON
+			if errorBytes, err := json.Marshal(errorField); err == nil {
+				errorText = string(errorBytes)
+			} else {
+				errorText = fmt.Sprintf("Error field present but could not be parsed: %v", errorField)
 			}
 		}
+
+		return nil, fmt.Errorf("failed to execute command: ServiceNow Error: %s", errorText)
+	}
+
+	if statusCode := resources[0].StatusCode; statusCode != nil && *statusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("failed to execute command: ServiceNow returned status %d", *statusCode)
+	}
+
+	return resourceRespBody, nil
+}
+
+// executeServiceNowRecordCommand runs a ServiceNow plugin operation that returns a single record
+// and returns the "result" object of its response body
+func (h *Handler) executeServiceNowRecordCommand(
+	ctx context.Context,
+	falconClient *client.CrowdStrikeAPISpecification,
+	configID string,
+	operationID string,
+	request *models.DomainRequest,
+) (map[string]interface{}, error) {
+	respBody, err := h.executeServiceNowCommand(ctx, falconClient, configID, operationID, request)
+	if err != nil {
+		return nil, err
+	}
+
+	result, _ := respBody["result"].(map[string]interface{})
+	return result, nil
+}
+
+// executeServiceNowListCommand runs a ServiceNow plugin operation that returns a list of records
+// and returns the "result" array of its response body
+func (h *Handler) executeServiceNowListCommand(
+	ctx context.Context,
+	falconClient *client.CrowdStrikeAPISpecification,
+	configID string,
+	operationID string,
+	request *models.DomainRequest,
+) ([]map[string]interface{}, error) {
+	respBody, err := h.executeServiceNowCommand(ctx, falconClient, configID, operationID, request)
+	if err != nil {
+		return nil, err
+	}
+
+	items, _ := respBody["result"].([]interface{})
+	records := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		if record, ok := item.(map[string]interface{}); ok {
+			records = append(records, record)
+		}
 	}
 
-	return requestPayload
+	return records, nil
+}
+
+// newLeaseOwner returns an identifier that is unique to this creation attempt
+func newLeaseOwner(traceID string) string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	if traceID == "" {
+		return hex.EncodeToString(b)
+	}
+	return traceID + "-" + hex.EncodeToString(b)
+}
+
+// updateEntityMapping re-reads the mapping of extRecord, applies update and stores it, retrying on concurrent writes
+func (h *Handler) updateEntityMapping(ctx context.Context, falconClient *client.CrowdStrikeAPISpecification, extRecord *storage.ExternalEntityRecord, update func(record *storage.ExternalEntityRecord) error) (*storage.ExternalEntityRecord, error) {
+	return storage.UpdateExternalEntityMapping(ctx, falconClient.CustomStorage, h.logger, extRecord.InternalEntityID, extRecord.ExternalSystemID, update)
+}
+
+// mappingErrResp converts an error from storing an entity mapping into a response
+func (h *Handler) mappingErrResp(err error) fdk.Response {
+	h.logger.Error("failed to store entity mapping", "error", err)
+	return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: err.Error()})
+}
+
+// storageErrCode returns the HTTP status code for a failed storage operation, so that callers can
+// tell retryable failures (rate limiting, outages, concurrent writes) apart from other errors
+func storageErrCode(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, storage.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, storage.ErrConflict):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// releaseCreationLease gives up the creation lease after a failed attempt so that the next execution can retry immediately
+func (h *Handler) releaseCreationLease(ctx context.Context, falconClient *client.CrowdStrikeAPISpecification, entityID, externalSystemID, owner string) {
+	if err := storage.ReleaseExternalEntityCreation(ctx, falconClient.CustomStorage, h.logger, entityID, externalSystemID, owner); err != nil {
+		h.logger.Error("failed to release creation lease", "entity_id", entityID, "error", err)
+	}
 }
 
 // createIncident handles the common logic for creating both regular and SIR incidents
@@ -211,6 +663,17 @@ func (h *Handler) createIncident(
 	h.logger.Info("Creating incident", "type", ticketType, "trace_id", r.TraceID, "wrk_ctx", wrkCtx)
 	accessToken := r.AccessToken
 
+	// Prepare the request payload using the input parameters, rejecting invalid custom fields up front
+	requestPayload, err := buildRequestPayload(r.Body)
+	if err != nil {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: err.Error()})
+	}
+	updateAlert := r.Body.CommentOnFalconAlert || r.Body.TagFalconAlert
+	if updateAlert && r.Body.InternalEntityType != "" && r.Body.InternalEntityType != "alert" {
+		errMsg := fmt.Sprintf("comment_on_falcon_alert and tag_falcon_alert require an alert entity, got internal_entity_type %s", r.Body.InternalEntityType)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: errMsg})
+	}
+
 	falconClient, cloud, err := h.falconClientFunc(accessToken, h.logger)
 	if err != nil {
 		errMsg := fmt.Sprintf("error creating Falcon client: %v", err)
@@ -222,7 +685,7 @@ func (h *Handler) createIncident(
 	exists, extRecord, err := storage.CheckExternalEntityExists(ctx, falconClient.CustomStorage, h.logger, r.Body.EntityID, externalSystemID)
 	if err != nil {
 		errMsg := fmt.Sprintf("failed to check if ticket exists: %v", err)
-		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: errMsg})
+		return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: errMsg})
 	}
 
 	// If the entity has an existing ticket with the specified external system ID, return it
@@ -238,107 +701,91 @@ func (h *Handler) createIncident(
 		}
 	}
 
-	// If no existing ticket, proceed with creating a new one
-	// Prepare the request payload using the input parameters
-	requestPayload := buildRequestPayload(r.Body)
-
-	configID := r.Body.ConfigID
-	execCmdParams := &api_integrations.ExecuteCommandParams{
-		Body: &models.DomainExecuteCommandRequestV1{Resources: []*models.DomainExecuteCommandV1{
-			{
-				DefinitionID: &pluginDefIDServiceNow,
-				OperationID:  &operationID,
-				ConfigID:     &configID,
-				Request: &models.DomainRequest{
-					JSON: requestPayload,
-				},
-			},
-		}},
-		Context: ctx,
+	// Claim the creation lease so that concurrent executions for the same entity create a single ticket
+	leaseOwner := newLeaseOwner(r.TraceID)
+	claim, err := storage.ClaimExternalEntityCreation(ctx, falconClient.CustomStorage, h.logger, r.Body.EntityID, externalSystemID, leaseOwner, h.creationLease)
+	if errors.Is(err, storage.ErrLeaseWaitTimeout) {
+		errMsg := fmt.Sprintf("ticket creation for entity %s is already in progress: %v", r.Body.EntityID, err)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusConflict, Message: errMsg})
 	}
-
-	execResp, err := falconClient.APIIntegrations.ExecuteCommand(execCmdParams)
 	if err != nil {
-		errMsg := fmt.Sprintf("failed to execute command: %v", err)
-		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: errMsg})
-	}
-
-	if execResp == nil {
-		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: "failed to execute command - nil response"})
-	}
-
-	h.logger.Info("plugin execution completed", "status_code", execResp.Code())
-	if execResp.Payload == nil {
-		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: "failed to execute command - empty response"})
+		errMsg := fmt.Sprintf("failed to claim ticket creation: %v", err)
+		return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: errMsg})
 	}
 
-	resources := execResp.Payload.Resources
-	if len(resources) == 0 {
-		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: "failed to execute command - empty resources in response payload"})
-	}
-
-	resource := resources[0]
-	resourceRespBody := resource.ResponseBody
-
-	snowSysClassName := ""
-	snowSysID := ""
-	errorText := ""
-
-	if result, ok := resourceRespBody.(map[string]interface{})["result"]; ok {
-		if resultMap, ok := result.(map[string]interface{}); ok {
-			// Try to get sys_class_name
-			if sysClassName, ok := resultMap["sys_class_name"].(string); ok {
-				snowSysClassName = sysClassName
-			}
-
-			// Try to get sys_id
-			if sysID, ok := resultMap["sys_id"].(string); ok {
-				snowSysID = sysID
-			}
+	// Another execution created the ticket while we were waiting for the lease
+	if !claim.Acquired {
+		h.logger.Info("ticket created concurrently for entity", "entity_id", r.Body.EntityID, "ticket_id", claim.Record.ExternalEntityID)
+		return fdk.Response{
+			Code: http.StatusOK,
+			Body: fdk.JSON(CreateIncidentResponse{
+				Exists:     true,
+				TicketID:   claim.Record.ExternalEntityID,
+				TicketType: ticketType,
+			}),
 		}
 	}
 
-	// Check if there's an error field in the response
-	if errorField, ok := resourceRespBody.(map[string]interface{})["error"]; ok {
-		// Convert the error field to a string
-		if errorStr, ok := errorField.(string); ok {
-			errorText = errorStr
-		} else {
-			// If it's not a string, try to convert it to JSON
-			if errorBytes, err := json.Marshal(errorField); err == nil {
-				errorText = string(errorBytes)
-			} else {
-				errorText = fmt.Sprintf("Error field present but could not be parsed: %v", errorField)
-			}
-		}
+	// If no existing ticket, proceed with creating a new one
+	result, err := h.executeServiceNowRecordCommand(ctx, falconClient, r.Body.ConfigID, operationID, &models.DomainRequest{
+		JSON: requestPayload,
+	})
+	if err != nil {
+		h.releaseCreationLease(ctx, falconClient, r.Body.EntityID, externalSystemID, leaseOwner)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: err.Error()})
+	}
 
-		errMsg := fmt.Sprintf("failed to execute command: ServiceNow Error: %s", errorText)
-		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: errMsg})
+	snowSysClassName, _ := result["sys_class_name"].(string)
+	snowSysID, _ := result["sys_id"].(string)
+	snowNumber, _ := result["number"].(string)
+	status, _ := result["state"].(string)
+	if status == "" {
+		status = r.Body.State
 	}
 
-	h.logger.Info("received response from ITSM", "ticket_id", snowSysID, "ticket_type", snowSysClassName)
+	h.logger.Info("received response from ITSM", "ticket_id", snowSysID, "ticket_type", snowSysClassName, "status", status)
 
 	// If we successfully created a ticket, store the mapping
 	if snowSysID != "" {
 		// Create the entity mapping record with the specific external system ID
 		entityRecord := storage.ExternalEntityRecord{
-			InternalEntityID: r.Body.EntityID,
-			ExternalEntityID: snowSysID,
-			ExternalSystemID: externalSystemID,
+			InternalEntityID:        r.Body.EntityID,
+			InternalEntityType:      r.Body.InternalEntityType,
+			ExternalEntityID:        snowSysID,
+			ExternalSystemID:        externalSystemID,
+			ExternalLastKnownStatus: status,
+			ExternalLastUpdateTime:  parseServiceNowTime(result["sys_updated_on"]),
 		}
 
-		// Store the mapping using the reusable function
+		// Store the mapping using the reusable function, which also replaces the creation lease
 		err := storage.CreateOrUpdateExternalEntityMapping(ctx, falconClient.CustomStorage, h.logger, entityRecord)
 		if err != nil {
-			h.logger.Error("failed to store entity mapping", "error", err)
-			return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: err.Error()})
+			return h.mappingErrResp(err)
 		}
+	} else {
+		h.releaseCreationLease(ctx, falconClient, r.Body.EntityID, externalSystemID, leaseOwner)
 	}
 
 	response := CreateIncidentResponse{
-		TicketID:   snowSysID,
-		TicketType: snowSysClassName,
-		Exists:     false,
+		TicketID:     snowSysID,
+		TicketType:   snowSysClassName,
+		Exists:       false,
+		TicketNumber: snowNumber,
+		TicketURL:    h.ticketURL(ticketType, snowSysID),
+	}
+
+	// The ticket and its mapping are kept when the alert can't be updated, the failure is only reported
+	if updateAlert && snowSysID != "" {
+		ticketRef := snowNumber
+		if ticketRef == "" {
+			ticketRef = snowSysID
+		}
+		if err := h.updateFalconAlert(ctx, falconClient, r.Body, ticketRef, response.TicketURL); err != nil {
+			h.logger.Error("failed to update Falcon alert", "entity_id", r.Body.EntityID, "ticket_id", snowSysID, "error", err)
+			response.FalconAlertError = err.Error()
+		} else {
+			response.FalconAlertUpdated = true
+		}
 	}
 
 	return fdk.Response{
@@ -349,12 +796,12 @@ func (h *Handler) createIncident(
 
 // HandleCreateIncident handles the /create_incident endpoint
 func (h *Handler) HandleCreateIncident(ctx context.Context, r fdk.RequestOf[CreateIncidentRequest], wrkCtx fdk.WorkflowCtx) fdk.Response {
-	return h.createIncident(ctx, r, wrkCtx, pluginOpIDServiceNowCreateIncident, "incident", ExternalSystemIDServiceNowIncident)
+	return h.createIncident(withHandlerPath(ctx, "/create_incident"), r, wrkCtx, pluginOpIDServiceNowCreateIncident, "incident", ExternalSystemIDServiceNowIncident)
 }
 
 // HandleCreateSIRIncident handles the /create_sir_incident endpoint
 func (h *Handler) HandleCreateSIRIncident(ctx context.Context, r fdk.RequestOf[CreateIncidentRequest], wrkCtx fdk.WorkflowCtx) fdk.Response {
-	return h.createIncident(ctx, r, wrkCtx, pluginOpIDServiceNowCreateSIRIncident, "sn_si_incident", ExternalSystemIDServiceNowSIRIncident)
+	return h.createIncident(withHandlerPath(ctx, "/create_sir_incident"), r, wrkCtx, pluginOpIDServiceNowCreateSIRIncident, "sn_si_incident", ExternalSystemIDServiceNowSIRIncident)
 }
 
 // handleThrottle handles the /throttle endpoint
@@ -367,22 +814,111 @@ func (h *Handler) HandleThrottle(ctx context.Context, r fdk.RequestOf[ThrottleFu
 		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: errMsg})
 	}
 
-	internalEntityID := r.Body.InternalEntityID
-	dedupObjType := r.Body.DedupObjType
-	dedupObjId := r.Body.DedupObjID
-	timeBucket := r.Body.TimeBucket
+	params, err := throttleParams(r.Body.InternalEntityID, r.Body.DedupObjType, r.Body.DedupObjID, r.Body.KeyFields, r.Body.TimeBucket)
+	if err != nil {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: err.Error()})
+	}
+
+	if _, err := storage.TimeBucket(params.TimeBucket).Window(); err != nil {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: fmt.Sprintf("unsupported time bucket value: %v", err)})
+	}
+
+	mode := storage.ThrottleMode(r.Body.Mode)
+	if mode != "" && mode != storage.ThrottleModeFixed && mode != storage.ThrottleModeSliding {
+		errMsg := fmt.Sprintf("unsupported throttle mode: %s (must be one of: %s, %s)", r.Body.Mode, storage.ThrottleModeFixed, storage.ThrottleModeSliding)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: errMsg})
+	}
+	if r.Body.MaxAllowed < 0 {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: "max_allowed must not be negative"})
+	}
+	if err := r.Body.OnStorageError.Validate(); err != nil {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: err.Error()})
+	}
+
+	params.Mode = mode
+	params.MaxAllowed = r.Body.MaxAllowed
+	params.Peek = r.Body.Peek
+	params.ReadLegacyKeys = h.readLegacyDedupKeys()
 
 	// Check throttling store for deduplication
-	isDuplicate, err := storage.CheckThrottlingStore(ctx, falconClient.CustomStorage, h.logger, internalEntityID, dedupObjType, dedupObjId, timeBucket)
+	result, err := storage.Throttle(ctx, falconClient.CustomStorage, h.logger, params)
+	if err != nil && !errors.Is(err, storage.ErrUnavailable) && !errors.Is(err, storage.ErrRateLimited) {
+		return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: err.Error()})
+	}
 	if err != nil {
-		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: err.Error()})
+		// The failure policy only covers the dedup store being unreachable
+		policy := r.Body.OnStorageError
+		if policy == "" {
+			policy = h.throttleFailurePolicy
+		}
+		if policy == "" || policy == ThrottleFailError {
+			return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: err.Error()})
+		}
+
+		// Decide without the dedup store rather than stopping the workflow
+		allowed := policy == ThrottleFailOpen
+		key, _ := storage.ThrottleKey(params)
+		h.logger.Warn("throttle decision degraded, dedup store unavailable or rate limited",
+			"policy", policy,
+			"allowed", allowed,
+			"status_code", storageErrCode(err),
+			"error", err,
+			"key", key,
+			"internal_entity_id", params.InternalEntityID,
+			"dedup_obj_type", params.DedupObjType,
+			"dedup_obj_id", params.DedupObjID,
+			"key_fields", params.KeyFields,
+			"time_bucket", params.TimeBucket,
+		)
+		return fdk.Response{
+			Code: http.StatusOK,
+			Body: fdk.JSON(map[string]any{
+				"allowed":  allowed,
+				"key":      key,
+				"degraded": true,
+			}),
+		}
+	}
+
+	// If the limit of the window is reached, don't allow the action
+	return fdk.Response{
+		Code: http.StatusOK,
+		Body: fdk.JSON(map[string]any{
+			"allowed":    result.Allowed,
+			"count":      result.Count,
+			"suppressed": result.Suppressed,
+			"key":        result.Key,
+			"degraded":   false,
+		}),
+	}
+}
+
+// HandleThrottleReset handles the /throttle_reset endpoint
+func (h *Handler) HandleThrottleReset(ctx context.Context, r fdk.RequestOf[ThrottleResetRequest]) fdk.Response {
+	params, err := throttleParams(r.Body.InternalEntityID, r.Body.DedupObjType, r.Body.DedupObjID, r.Body.KeyFields, r.Body.TimeBucket)
+	if err != nil {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: err.Error()})
+	}
+	if _, err := storage.TimeBucket(params.TimeBucket).Window(); err != nil {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: fmt.Sprintf("unsupported time bucket value: %v", err)})
+	}
+
+	falconClient, _, err := h.falconClientFunc(r.AccessToken, h.logger)
+	if err != nil {
+		errMsg := fmt.Sprintf("error creating Falcon client: %v", err)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: errMsg})
+	}
+
+	params.ReadLegacyKeys = h.readLegacyDedupKeys()
+	reset, err := storage.ResetThrottle(ctx, falconClient.CustomStorage, h.logger, params)
+	if err != nil {
+		return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: err.Error()})
 	}
 
-	// If it's a duplicate, don't allow the action
 	return fdk.Response{
 		Code: http.StatusOK,
 		Body: fdk.JSON(map[string]any{
-			"allowed": !isDuplicate,
+			"reset": reset,
 		}),
 	}
 }
@@ -1,12 +1,16 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"itsmhelper/internal/storage"
 
@@ -65,7 +69,7 @@ func (s *HandlerTestSuite) TestHandleCheckIfExtEntityExists() {
 						return nil, err
 					}
 					s.Equal(expectedKey, params.ObjectKey, "ObjectKey should match expected value")
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 			},
 			setupMockClient: func() (*client.CrowdStrikeAPISpecification, string, error) {
@@ -217,6 +221,42 @@ func (s *HandlerTestSuite) TestHandleCheckIfExtEntityExists() {
 				},
 			},
 		},
+		{
+			name: "Entity exists with type and ticket state",
+			request: fdk.RequestOf[CheckIfExtExistsReq]{
+				Body: CheckIfExtExistsReq{
+					InternalEntityID: "entity123",
+					ExternalSystemID: ExternalSystemIDServiceNowIncident,
+				},
+				AccessToken: "test-token",
+			},
+			setupMockStore: func(mockStorage *storage.MockStorageService) {
+				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+					record := storage.ExternalEntityRecord{
+						InternalEntityID:        "entity123",
+						InternalEntityType:      "alert",
+						ExternalEntityID:        "ext123",
+						ExternalSystemID:        ExternalSystemIDServiceNowIncident,
+						ExternalLastKnownStatus: "6",
+						ExternalLastUpdateTime:  1745851522,
+					}
+					json.NewEncoder(writer).Encode(record)
+					return &custom_storage.GetObjectOK{}, nil
+				}
+			},
+			setupMockClient: func() (*client.CrowdStrikeAPISpecification, string, error) {
+				mockClient := &client.CrowdStrikeAPISpecification{}
+				return mockClient, "us-1", nil
+			},
+			wantCode: 200,
+			wantBody: map[string]interface{}{
+				"exists":                     true,
+				"ext_id":                     "ext123",
+				"internal_entity_type":       "alert",
+				"external_last_known_status": "6",
+				"external_last_update_time":  float64(1745851522),
+			},
+		},
 		{
 			name: "Invalid JSON response",
 			request: fdk.RequestOf[CheckIfExtExistsReq]{
@@ -459,7 +499,7 @@ func (s *HandlerTestSuite) TestHandleThrottle() {
 			},
 			setupMockStore: func(mockStorage *storage.MockStorageService) {
 				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 				mockStorage.PutObjectFunc = func(params *custom_storage.PutObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.PutObjectOK, error) {
 					return &custom_storage.PutObjectOK{}, nil
@@ -503,6 +543,146 @@ func (s *HandlerTestSuite) TestHandleThrottle() {
 				"allowed": false,
 			},
 		},
+		{
+			name: "Count-based throttling reports suppressed calls",
+			request: fdk.RequestOf[ThrottleFunctionRequest]{
+				Body: ThrottleFunctionRequest{
+					InternalEntityID: "entity123",
+					DedupObjType:     "Host",
+					DedupObjID:       "host123",
+					TimeBucket:       "1h",
+					MaxAllowed:       3,
+				},
+				AccessToken: "test-token",
+			},
+			setupMockStore: func(mockStorage *storage.MockStorageService) {
+				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+					record := storage.DedupStoreRecord{
+						TimeBucket: "1h",
+						Count:      44,
+					}
+					json.NewEncoder(writer).Encode(record)
+					return &custom_storage.GetObjectOK{}, nil
+				}
+			},
+			setupMockClient: func() (*client.CrowdStrikeAPISpecification, string, error) {
+				mockClient := &client.CrowdStrikeAPISpecification{}
+				return mockClient, "us-1", nil
+			},
+			wantCode: 200,
+			wantBody: map[string]interface{}{
+				"allowed":    false,
+				"count":      float64(45),
+				"suppressed": float64(42),
+			},
+		},
+		{
+			name: "Negative max allowed",
+			request: fdk.RequestOf[ThrottleFunctionRequest]{
+				Body: ThrottleFunctionRequest{
+					InternalEntityID: "entity123",
+					DedupObjType:     "Host",
+					DedupObjID:       "host123",
+					TimeBucket:       "1h",
+					MaxAllowed:       -1,
+				},
+				AccessToken: "test-token",
+			},
+			setupMockStore: func(mockStorage *storage.MockStorageService) {},
+			setupMockClient: func() (*client.CrowdStrikeAPISpecification, string, error) {
+				mockClient := &client.CrowdStrikeAPISpecification{}
+				return mockClient, "us-1", nil
+			},
+			wantCode: 400,
+			wantErrors: []fdk.APIError{
+				{
+					Code:    400,
+					Message: "max_allowed must not be negative",
+				},
+			},
+		},
+		{
+			name: "Throttling by key fields",
+			request: fdk.RequestOf[ThrottleFunctionRequest]{
+				Body: ThrottleFunctionRequest{
+					KeyFields: map[string]string{
+						"Tactic":    " Credential Access",
+						"technique": "T1003",
+						"host":      "HOST1",
+					},
+					TimeBucket: "forever",
+				},
+				AccessToken: "test-token",
+			},
+			setupMockStore: func(mockStorage *storage.MockStorageService) {
+				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
+				}
+				mockStorage.PutObjectFunc = func(params *custom_storage.PutObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.PutObjectOK, error) {
+					return &custom_storage.PutObjectOK{}, nil
+				}
+			},
+			setupMockClient: func() (*client.CrowdStrikeAPISpecification, string, error) {
+				mockClient := &client.CrowdStrikeAPISpecification{}
+				return mockClient, "us-1", nil
+			},
+			wantCode: 200,
+			wantBody: map[string]interface{}{
+				"allowed": true,
+				"key": func() string {
+					key, _ := storage.ThrottleKey(storage.ThrottleParams{
+						KeyFields:  map[string]string{"host": "host1", "tactic": "credential access", "technique": "t1003"},
+						TimeBucket: "forever",
+					})
+					return key
+				}(),
+			},
+		},
+		{
+			name: "Key fields combined with ids",
+			request: fdk.RequestOf[ThrottleFunctionRequest]{
+				Body: ThrottleFunctionRequest{
+					InternalEntityID: "entity123",
+					KeyFields:        map[string]string{"host": "host1"},
+					TimeBucket:       "forever",
+				},
+				AccessToken: "test-token",
+			},
+			setupMockStore: func(mockStorage *storage.MockStorageService) {},
+			setupMockClient: func() (*client.CrowdStrikeAPISpecification, string, error) {
+				mockClient := &client.CrowdStrikeAPISpecification{}
+				return mockClient, "us-1", nil
+			},
+			wantCode: 400,
+			wantErrors: []fdk.APIError{
+				{
+					Code:    400,
+					Message: "key_fields cannot be combined with internal_entity_id, dedup_obj_type or dedup_obj_id, add them to key_fields instead",
+				},
+			},
+		},
+		{
+			name: "Missing ids",
+			request: fdk.RequestOf[ThrottleFunctionRequest]{
+				Body: ThrottleFunctionRequest{
+					InternalEntityID: "entity123",
+					TimeBucket:       "forever",
+				},
+				AccessToken: "test-token",
+			},
+			setupMockStore: func(mockStorage *storage.MockStorageService) {},
+			setupMockClient: func() (*client.CrowdStrikeAPISpecification, string, error) {
+				mockClient := &client.CrowdStrikeAPISpecification{}
+				return mockClient, "us-1", nil
+			},
+			wantCode: 400,
+			wantErrors: []fdk.APIError{
+				{
+					Code:    400,
+					Message: "internal_entity_id, dedup_obj_type and dedup_obj_id are required unless key_fields is set",
+				},
+			},
+		},
 		{
 			name: "Falcon client creation error",
 			request: fdk.RequestOf[ThrottleFunctionRequest]{
@@ -546,11 +726,38 @@ func (s *HandlerTestSuite) TestHandleThrottle() {
 				mockClient := &client.CrowdStrikeAPISpecification{}
 				return mockClient, "us-1", nil
 			},
-			wantCode: 500,
+			wantCode: 400,
 			wantErrors: []fdk.APIError{
 				{
-					Code:    500,
-					Message: "unsupported time bucket value: invalid_bucket (must be one of: forever, 5 minutes, 30 minutes)",
+					Code:    400,
+					Message: "unsupported time bucket value: \"invalid_bucket\" is not a valid window, use forever, a duration such as 4h or 7d, or an ISO-8601 period such as PT4H",
+				},
+			},
+		},
+		{
+			name: "Invalid mode",
+			request: fdk.RequestOf[ThrottleFunctionRequest]{
+				Body: ThrottleFunctionRequest{
+					InternalEntityID: "entity123",
+					DedupObjType:     "alert",
+					DedupObjID:       "alert123",
+					TimeBucket:       "5 minutes",
+					Mode:             "rolling",
+				},
+				AccessToken: "test-token",
+			},
+			setupMockStore: func(mockStorage *storage.MockStorageService) {
+				// No specific setup needed as the validation will fail before storage is used
+			},
+			setupMockClient: func() (*client.CrowdStrikeAPISpecification, string, error) {
+				mockClient := &client.CrowdStrikeAPISpecification{}
+				return mockClient, "us-1", nil
+			},
+			wantCode: 400,
+			wantErrors: []fdk.APIError{
+				{
+					Code:    400,
+					Message: "unsupported throttle mode: rolling (must be one of: fixed, sliding)",
 				},
 			},
 		},
@@ -671,6 +878,229 @@ func (m *MockAPIIntegrationsService) SetTransport(transport runtime.ClientTransp
 	// No-op for the mock
 }
 
+// TestHandleThrottleReset tests the Handler.HandleThrottleReset method
+func (s *HandlerTestSuite) TestHandleThrottleReset() {
+	tests := []struct {
+		name                 string
+		timeBucket           string
+		legacyDedupKeysUntil time.Time
+		deleteErr            error
+		wantCode             int
+		wantReset            bool
+		wantDeleted          int
+		wantError            string
+	}{
+		{name: "Throttle reset", timeBucket: "1h", wantCode: 200, wantReset: true, wantDeleted: 4},
+		{name: "Throttle reset after the legacy key migration", timeBucket: "1h", legacyDedupKeysUntil: time.Now().Add(-time.Hour), wantCode: 200, wantReset: true, wantDeleted: 2},
+		{name: "Nothing to reset", timeBucket: "forever", deleteErr: runtime.NewAPIError("DeleteObject", nil, 404), wantCode: 200},
+		{name: "Invalid time bucket", timeBucket: "soon", wantCode: 400, wantError: "unsupported time bucket value"},
+		{name: "Storage outage", timeBucket: "1h", deleteErr: custom_storage.NewDeleteObjectInternalServerError(), wantCode: 503, wantError: "failed to delete dedup record"},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+
+			var deletedKeys []string
+			s.mockStorage.DeleteFunc = func(params *custom_storage.DeleteObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.DeleteObjectOK, error) {
+				s.Equal(storage.CollectionNameDedupStore, params.CollectionName)
+				if tc.deleteErr != nil {
+					return nil, tc.deleteErr
+				}
+				deletedKeys = append(deletedKeys, params.ObjectKey)
+				return &custom_storage.DeleteObjectOK{}, nil
+			}
+
+			handler := &Handler{
+				logger: s.logger,
+				falconClientFunc: func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+					mockClient := &client.CrowdStrikeAPISpecification{}
+					mockClient.CustomStorage = s.mockStorage
+					return mockClient, "us-1", nil
+				},
+				legacyDedupKeysUntil: tc.legacyDedupKeysUntil,
+			}
+
+			response := handler.HandleThrottleReset(context.Background(), fdk.RequestOf[ThrottleResetRequest]{
+				Body: ThrottleResetRequest{
+					InternalEntityID: "entity123",
+					DedupObjType:     "Host",
+					DedupObjID:       "host123",
+					TimeBucket:       tc.timeBucket,
+				},
+				AccessToken: "test-token",
+			})
+
+			s.Equal(tc.wantCode, response.Code)
+			if tc.wantError != "" {
+				s.Require().Len(response.Errors, 1)
+				s.Contains(response.Errors[0].Message, tc.wantError)
+				return
+			}
+
+			jsonBytes, err := json.Marshal(response.Body)
+			s.Require().NoError(err)
+			var body map[string]interface{}
+			s.Require().NoError(json.Unmarshal(jsonBytes, &body))
+			s.Equal(tc.wantReset, body["reset"])
+			if tc.wantReset {
+				s.Len(deletedKeys, tc.wantDeleted, "the fixed and sliding records, and their legacy ones during the migration, should be deleted")
+			}
+		})
+	}
+}
+
+// TestHandleThrottleLegacyKeyMigration tests that legacy md5 dedup records are only found while the migration window is open
+func (s *HandlerTestSuite) TestHandleThrottleLegacyKeyMigration() {
+	originalTimeNow := timeNow
+	defer func() { timeNow = originalTimeNow }()
+
+	until := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		now         time.Time
+		wantReads   int
+		wantAllowed bool
+	}{
+		{name: "Window open", now: until.Add(-time.Second), wantReads: 2, wantAllowed: false},
+		{name: "Window closes at the configured time", now: until, wantReads: 1, wantAllowed: true},
+		{name: "Window closed", now: until.Add(24 * time.Hour), wantReads: 1, wantAllowed: true},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+			timeNow = func() time.Time { return tc.now }
+
+			// Only the legacy md5 key (32 hex characters) holds a record
+			var readKeys []string
+			s.mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+				readKeys = append(readKeys, params.ObjectKey)
+				if len(params.ObjectKey) != 32 {
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
+				}
+				json.NewEncoder(writer).Encode(storage.DedupStoreRecord{TimeBucket: storage.TimeBucketForever})
+				return &custom_storage.GetObjectOK{}, nil
+			}
+
+			handler := &Handler{
+				logger: s.logger,
+				falconClientFunc: func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+					mockClient := &client.CrowdStrikeAPISpecification{}
+					mockClient.CustomStorage = s.mockStorage
+					return mockClient, "us-1", nil
+				},
+				legacyDedupKeysUntil: until,
+			}
+
+			response := handler.HandleThrottle(context.Background(), fdk.RequestOf[ThrottleFunctionRequest]{
+				Body: ThrottleFunctionRequest{
+					InternalEntityID: "entity123",
+					DedupObjType:     "alert",
+					DedupObjID:       "alert123",
+					TimeBucket:       "forever",
+				},
+				AccessToken: "test-token",
+			})
+			s.Equal(200, response.Code)
+			s.Len(readKeys, tc.wantReads, "the legacy key should only be read while the migration window is open")
+
+			jsonBytes, err := json.Marshal(response.Body)
+			s.Require().NoError(err)
+			var body map[string]interface{}
+			s.Require().NoError(json.Unmarshal(jsonBytes, &body))
+			s.Equal(tc.wantAllowed, body["allowed"])
+		})
+	}
+}
+
+// TestHandleThrottleFailurePolicy tests the throttle decision when the dedup store is unavailable or rate limited
+func (s *HandlerTestSuite) TestHandleThrottleFailurePolicy() {
+	tests := []struct {
+		name           string
+		handlerPolicy  ThrottleFailurePolicy
+		requestPolicy  ThrottleFailurePolicy
+		getErr         error
+		wantCode       int
+		wantAllowed    bool
+		wantError      string
+		wantDegradeLog bool
+		wantLogCode    int
+	}{
+		{name: "Default policy returns the storage error", wantCode: 503, wantError: "failed to check dedup record"},
+		{name: "Error policy returns the storage error", handlerPolicy: ThrottleFailError, wantCode: 503, wantError: "failed to check dedup record"},
+		{name: "Function fails open", handlerPolicy: ThrottleFailOpen, wantCode: 200, wantAllowed: true, wantDegradeLog: true},
+		{name: "Function fails closed", handlerPolicy: ThrottleFailClosed, wantCode: 200, wantAllowed: false, wantDegradeLog: true},
+		{name: "Request overrides the function policy", handlerPolicy: ThrottleFailClosed, requestPolicy: ThrottleFailOpen, wantCode: 200, wantAllowed: true, wantDegradeLog: true},
+		{name: "Request asks for the error", handlerPolicy: ThrottleFailOpen, requestPolicy: ThrottleFailError, wantCode: 503, wantError: "failed to check dedup record"},
+		{name: "Invalid request policy", requestPolicy: "ignore", wantCode: 400, wantError: "unsupported throttle failure policy: ignore"},
+		{name: "Function fails open when rate limited", handlerPolicy: ThrottleFailOpen, getErr: custom_storage.NewGetObjectTooManyRequests(), wantCode: 200, wantAllowed: true, wantDegradeLog: true, wantLogCode: 429},
+		{name: "Other storage errors are returned", handlerPolicy: ThrottleFailOpen, getErr: custom_storage.NewGetObjectForbidden(), wantCode: 500, wantError: "failed to check dedup record"},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+
+			s.mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+				if tc.getErr != nil {
+					return nil, tc.getErr
+				}
+				return nil, custom_storage.NewGetObjectInternalServerError()
+			}
+
+			logs := new(bytes.Buffer)
+			handler := &Handler{
+				logger: slog.New(slog.NewJSONHandler(logs, nil)),
+				falconClientFunc: func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+					mockClient := &client.CrowdStrikeAPISpecification{}
+					mockClient.CustomStorage = s.mockStorage
+					return mockClient, "us-1", nil
+				},
+				throttleFailurePolicy: tc.handlerPolicy,
+			}
+
+			response := handler.HandleThrottle(context.Background(), fdk.RequestOf[ThrottleFunctionRequest]{
+				Body: ThrottleFunctionRequest{
+					InternalEntityID: "entity123",
+					DedupObjType:     "Host",
+					DedupObjID:       "host123",
+					TimeBucket:       "1h",
+					OnStorageError:   tc.requestPolicy,
+				},
+				AccessToken: "test-token",
+			})
+
+			s.Equal(tc.wantCode, response.Code)
+			if tc.wantError != "" {
+				s.Require().Len(response.Errors, 1)
+				s.Contains(response.Errors[0].Message, tc.wantError)
+				s.NotContains(logs.String(), "throttle decision degraded")
+				return
+			}
+
+			jsonBytes, err := json.Marshal(response.Body)
+			s.Require().NoError(err)
+			var body map[string]interface{}
+			s.Require().NoError(json.Unmarshal(jsonBytes, &body))
+			s.Equal(tc.wantAllowed, body["allowed"])
+			s.Equal(true, body["degraded"])
+
+			var entry map[string]interface{}
+			s.Require().NoError(json.Unmarshal(logs.Bytes(), &entry))
+			s.Equal("WARN", entry["level"])
+			s.Contains(entry["msg"], "throttle decision degraded")
+			wantLogCode := tc.wantLogCode
+			if wantLogCode == 0 {
+				wantLogCode = 503
+			}
+			s.Equal(float64(wantLogCode), entry["status_code"])
+			s.Equal("entity123", entry["internal_entity_id"])
+			s.Equal("host123", entry["dedup_obj_id"])
+		})
+	}
+}
+
 // TestHandleCreateIncident tests the Handler.HandleCreateIncident method
 func (s *HandlerTestSuite) TestHandleCreateIncident() {
 	// Define test cases
@@ -741,9 +1171,10 @@ func (s *HandlerTestSuite) TestHandleCreateIncident() {
 			name: "Successful new ticket creation",
 			request: fdk.RequestOf[CreateIncidentRequest]{
 				Body: CreateIncidentRequest{
-					ConfigID:         "config123",
-					EntityID:         "entity123",
-					ShortDescription: "Test incident",
+					ConfigID:           "config123",
+					EntityID:           "entity123",
+					InternalEntityType: "alert",
+					ShortDescription:   "Test incident",
 				},
 				AccessToken: "test-token",
 			},
@@ -751,11 +1182,18 @@ func (s *HandlerTestSuite) TestHandleCreateIncident() {
 			setupMockStore: func(mockStorage *storage.MockStorageService) {
 				// First call - check if ticket exists
 				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 
-				// Second call - store mapping
+				// Second call - store mapping with the entity type and the ticket state from ServiceNow
 				mockStorage.PutObjectFunc = func(params *custom_storage.PutObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.PutObjectOK, error) {
+					var record storage.ExternalEntityRecord
+					s.Require().NoError(json.NewDecoder(params.Body).Decode(&record))
+					if !record.IsPending() {
+						s.Equal("alert", record.InternalEntityType)
+						s.Equal("1", record.ExternalLastKnownStatus)
+						s.Equal(int64(1745851522), record.ExternalLastUpdateTime)
+					}
 					return &custom_storage.PutObjectOK{}, nil
 				}
 			},
@@ -773,6 +1211,7 @@ func (s *HandlerTestSuite) TestHandleCreateIncident() {
 						"priority":          "2",
 						"state":             "1",
 						"opened_at":         "2025-04-28 14:45:22",
+						"sys_updated_on":    "2025-04-28 14:45:22",
 						"caller_id": map[string]interface{}{
 							"link":  "https://instance.service-now.com/api/now/table/sys_user/5137153cc611227c000bbd1bd8cd2005",
 							"value": "5137153cc611227c000bbd1bd8cd2005",
@@ -823,7 +1262,7 @@ func (s *HandlerTestSuite) TestHandleCreateIncident() {
 			setupMockStore: func(mockStorage *storage.MockStorageService) {
 				// First call - check if ticket exists
 				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 
 				// Second call - store mapping
@@ -950,7 +1389,7 @@ func (s *HandlerTestSuite) TestHandleCreateIncident() {
 			workflowCtx: fdk.WorkflowCtx{},
 			setupMockStore: func(mockStorage *storage.MockStorageService) {
 				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 			},
 			setupMockAPIIntegrations: func(mockAPIIntegrations *MockAPIIntegrationsService) {
@@ -993,7 +1432,7 @@ func (s *HandlerTestSuite) TestHandleCreateIncident() {
 			workflowCtx: fdk.WorkflowCtx{},
 			setupMockStore: func(mockStorage *storage.MockStorageService) {
 				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 			},
 			setupMockAPIIntegrations: func(mockAPIIntegrations *MockAPIIntegrationsService) {
@@ -1028,7 +1467,7 @@ func (s *HandlerTestSuite) TestHandleCreateIncident() {
 			setupMockStore: func(mockStorage *storage.MockStorageService) {
 				// First call - check if ticket exists
 				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 
 				// Second call - store mapping (fails)
@@ -1099,7 +1538,7 @@ func (s *HandlerTestSuite) TestHandleCreateIncident() {
 			setupMockStore: func(mockStorage *storage.MockStorageService) {
 				// First call - check if ticket exists
 				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 
 				// Second call - store mapping
@@ -1156,7 +1595,7 @@ func (s *HandlerTestSuite) TestHandleCreateIncident() {
 			setupMockStore: func(mockStorage *storage.MockStorageService) {
 				// First call - check if ticket exists
 				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 
 				// Second call - store mapping
@@ -1341,7 +1780,7 @@ func (s *HandlerTestSuite) TestHandleCreateSIRIncident() {
 			setupMockStore: func(mockStorage *storage.MockStorageService) {
 				// First call - check if ticket exists
 				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 
 				// Second call - store mapping
@@ -1421,7 +1860,7 @@ func (s *HandlerTestSuite) TestHandleCreateSIRIncident() {
 			setupMockStore: func(mockStorage *storage.MockStorageService) {
 				// First call - check if ticket exists
 				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 
 				// Second call - store mapping
@@ -1554,7 +1993,7 @@ func (s *HandlerTestSuite) TestHandleCreateSIRIncident() {
 			workflowCtx: fdk.WorkflowCtx{},
 			setupMockStore: func(mockStorage *storage.MockStorageService) {
 				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 			},
 			setupMockAPIIntegrations: func(mockAPIIntegrations *MockAPIIntegrationsService) {
@@ -1597,7 +2036,7 @@ func (s *HandlerTestSuite) TestHandleCreateSIRIncident() {
 			workflowCtx: fdk.WorkflowCtx{},
 			setupMockStore: func(mockStorage *storage.MockStorageService) {
 				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 			},
 			setupMockAPIIntegrations: func(mockAPIIntegrations *MockAPIIntegrationsService) {
@@ -1632,7 +2071,7 @@ func (s *HandlerTestSuite) TestHandleCreateSIRIncident() {
 			setupMockStore: func(mockStorage *storage.MockStorageService) {
 				// First call - check if ticket exists
 				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 
 				// Second call - store mapping (fails)
@@ -1802,7 +2241,7 @@ func (s *HandlerTestSuite) TestExecuteCommandPayloadJSON() {
 	for _, tc := range tests {
 		s.Run(tc.name, func() {
 			s.mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
-				return nil, fmt.Errorf("status 404")
+				return nil, runtime.NewAPIError("GetObject", nil, 404)
 			}
 			s.mockStorage.PutObjectFunc = func(params *custom_storage.PutObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.PutObjectOK, error) {
 				return &custom_storage.PutObjectOK{}, nil
@@ -1854,6 +2293,311 @@ func (s *HandlerTestSuite) TestExecuteCommandPayloadJSON() {
 	}
 }
 
+// readBarrierStorage holds the first n versioned reads until all of them were made, so that concurrent
+// executions all read the same record before any of them writes a creation lease
+type readBarrierStorage struct {
+	*storage.MemoryStorageService
+
+	mu      sync.Mutex
+	waiting int
+	release chan struct{}
+}
+
+func newReadBarrierStorage(n int) *readBarrierStorage {
+	return &readBarrierStorage{
+		MemoryStorageService: storage.NewMemoryStorageService(),
+		waiting:              n,
+		release:              make(chan struct{}),
+	}
+}
+
+func (b *readBarrierStorage) GetVersionedObject(params *custom_storage.GetVersionedObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetVersionedObjectOK, error) {
+	resp, err := b.MemoryStorageService.GetVersionedObject(params, writer, opts...)
+
+	b.mu.Lock()
+	if b.waiting == 0 {
+		b.mu.Unlock()
+		return resp, err
+	}
+	b.waiting--
+	if b.waiting == 0 {
+		close(b.release)
+	}
+	b.mu.Unlock()
+
+	<-b.release
+	return resp, err
+}
+
+// TestHandleCreateIncidentConcurrent tests that concurrent executions for the same entity create a single ticket,
+// even when all of them read the tracked entity before any of them claims it
+func (s *HandlerTestSuite) TestHandleCreateIncidentConcurrent() {
+	const executions = 8
+
+	memStorage := newReadBarrierStorage(executions)
+
+	var creations atomic.Int32
+	s.mockAPIIntegrations.ExecuteCommandFunc = func(params *api_integrations.ExecuteCommandParams, opts ...api_integrations.ClientOption) (*api_integrations.ExecuteCommandOK, error) {
+		n := creations.Add(1)
+
+		return &api_integrations.ExecuteCommandOK{
+			Payload: &models.DomainExecuteCommandResultsV1{
+				Resources: []*models.DomainExecuteCommandResultV1{{
+					ResponseBody: map[string]interface{}{"result": map[string]interface{}{
+						"sys_id":         fmt.Sprintf("sys%d", n),
+						"sys_class_name": "incident",
+					}},
+				}},
+			},
+		}, nil
+	}
+
+	handler := NewHandler(s.logger, func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+		mockClient := &client.CrowdStrikeAPISpecification{}
+		mockClient.CustomStorage = memStorage
+		mockClient.APIIntegrations = s.mockAPIIntegrations
+		return mockClient, "us-1", nil
+	}, WithCreationLease(storage.LeaseOptions{
+		PollInterval: 5 * time.Millisecond,
+		WaitTimeout:  5 * time.Second,
+	}))
+
+	start := make(chan struct{})
+	responses := make([]fdk.Response, executions)
+	var wg sync.WaitGroup
+	for i := range executions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			responses[i] = handler.HandleCreateIncident(context.Background(), fdk.RequestOf[CreateIncidentRequest]{
+				Body: CreateIncidentRequest{
+					ConfigID:         "config123",
+					EntityID:         "entity123",
+					ShortDescription: "Test incident",
+				},
+				AccessToken: "test-token",
+			}, fdk.WorkflowCtx{})
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	s.Equal(int32(1), creations.Load(), "exactly one ServiceNow ticket should be created")
+
+	created := 0
+	for _, response := range responses {
+		s.Require().Contains([]int{200, 201}, response.Code, "unexpected response: %+v", response.Errors)
+		if response.Code == 201 {
+			created++
+		}
+
+		jsonBytes, err := json.Marshal(response.Body)
+		s.Require().NoError(err)
+		var actual CreateIncidentResponse
+		s.Require().NoError(json.Unmarshal(jsonBytes, &actual))
+		s.Equal("sys1", actual.TicketID, "every execution should return the same ticket")
+	}
+	s.Equal(1, created, "only the lease winner should report a new ticket")
+
+	exists, record, err := storage.CheckExternalEntityExists(context.Background(), memStorage, s.logger, "entity123", ExternalSystemIDServiceNowIncident)
+	s.Require().NoError(err)
+	s.True(exists)
+	s.Equal("sys1", record.ExternalEntityID)
+	s.Empty(record.LeaseOwner, "the lease should be cleared once the mapping is stored")
+}
+
+// TestStorageErrorStatusCodes tests that storage failures are reported with a matching HTTP status code
+func (s *HandlerTestSuite) TestStorageErrorStatusCodes() {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+	}{
+		{name: "Rate limited", err: custom_storage.NewGetObjectTooManyRequests(), wantCode: 429},
+		{name: "Storage outage", err: custom_storage.NewGetObjectInternalServerError(), wantCode: 503},
+		{name: "Bad gateway", err: runtime.NewAPIError("GetObject", nil, 502), wantCode: 503},
+		{name: "Forbidden", err: custom_storage.NewGetObjectForbidden(), wantCode: 500},
+		{name: "Transport error", err: fmt.Errorf("connection error"), wantCode: 500},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+
+			s.mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+				return nil, tc.err
+			}
+
+			handler := &Handler{
+				logger: s.logger,
+				falconClientFunc: func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+					mockClient := &client.CrowdStrikeAPISpecification{}
+					mockClient.CustomStorage = s.mockStorage
+					mockClient.APIIntegrations = s.mockAPIIntegrations
+					return mockClient, "us-1", nil
+				},
+			}
+
+			response := handler.HandleCheckIfExtEntityExists(context.Background(), fdk.RequestOf[CheckIfExtExistsReq]{
+				Body:        CheckIfExtExistsReq{InternalEntityID: "entity123", ExternalSystemID: ExternalSystemIDServiceNowIncident},
+				AccessToken: "test-token",
+			})
+			s.Equal(tc.wantCode, response.Code, "check_if_ext_entity_exists status code")
+
+			response = handler.HandleThrottle(context.Background(), fdk.RequestOf[ThrottleFunctionRequest]{
+				Body: ThrottleFunctionRequest{
+					InternalEntityID: "entity123",
+					DedupObjType:     "detection",
+					DedupObjID:       "det123",
+					TimeBucket:       string(storage.TimeBucketForever),
+				},
+				AccessToken: "test-token",
+			})
+			s.Equal(tc.wantCode, response.Code, "throttle status code")
+		})
+	}
+}
+
+// TestParseCustomFields tests the parseCustomFields function
+func (s *HandlerTestSuite) TestParseCustomFields() {
+	tests := []struct {
+		name    string
+		raw     string
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{
+			name: "Empty",
+			raw:  "  ",
+		},
+		{
+			name: "Scalar values",
+			raw:  `{"u_text": "value", "u_count": 3, "u_flag": true, "u_empty": null}`,
+			want: map[string]interface{}{"u_text": "value", "u_count": float64(3), "u_flag": true, "u_empty": nil},
+		},
+		{
+			name:    "Syntax error reports the position",
+			raw:     "{\n  \"u_text\": \"value\",\n  \"u_count\" 3\n}",
+			wantErr: "invalid custom_fields JSON at line 3, column 13 (offset 36)",
+		},
+		{
+			name:    "Truncated JSON",
+			raw:     `{"u_text": "value"`,
+			wantErr: "invalid custom_fields JSON at line 1, column 18 (offset 18): unexpected end of JSON input",
+		},
+		{
+			name:    "Not an object",
+			raw:     `["u_text"]`,
+			wantErr: "custom_fields must be a JSON object, got array",
+		},
+		{
+			name:    "Empty field name",
+			raw:     `{"": "value"}`,
+			wantErr: "custom_fields must not contain an empty field name",
+		},
+		{
+			name:    "Nested object",
+			raw:     `{"u_owner": {"name": "soc"}}`,
+			wantErr: "custom_fields.u_owner: nested objects and arrays are not supported",
+		},
+		{
+			name:    "Array value",
+			raw:     `{"u_hosts": ["a", "b"]}`,
+			wantErr: "custom_fields.u_hosts: nested objects and arrays are not supported",
+		},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			got, err := parseCustomFields(tc.raw)
+			if tc.wantErr != "" {
+				s.ErrorContains(err, tc.wantErr)
+				return
+			}
+			s.NoError(err)
+			s.Equal(tc.want, got)
+		})
+	}
+}
+
+// TestBuildRequestPayloadCoreFields tests how buildRequestPayload merges custom fields named like core fields
+func (s *HandlerTestSuite) TestBuildRequestPayloadCoreFields() {
+	tests := []struct {
+		name    string
+		body    CreateIncidentRequest
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{
+			name:    "Core field set in the request",
+			body:    CreateIncidentRequest{ShortDescription: "Test incident", State: "1", CustomFields: `{"state": "2"}`},
+			wantErr: "custom_fields.state would overwrite a core field, set override_core_fields to allow it",
+		},
+		{
+			name: "Core field set in the request with override",
+			body: CreateIncidentRequest{ShortDescription: "Test incident", State: "1", CustomFields: `{"state": "2"}`, OverrideCoreFields: true},
+			want: map[string]interface{}{"short_description": "Test incident", "state": "2"},
+		},
+		{
+			name: "Core field left empty",
+			body: CreateIncidentRequest{ShortDescription: "Test incident", CustomFields: `{"state": "2", "category": "network"}`},
+			want: map[string]interface{}{"short_description": "Test incident", "state": "2", "category": "network"},
+		},
+		{
+			name: "Empty short description",
+			body: CreateIncidentRequest{CustomFields: `{"short_description": "From custom fields"}`},
+			want: map[string]interface{}{"short_description": "From custom fields"},
+		},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			got, err := buildRequestPayload(tc.body)
+			if tc.wantErr != "" {
+				s.EqualError(err, tc.wantErr)
+				return
+			}
+			s.NoError(err)
+			s.Equal(tc.want, got)
+		})
+	}
+}
+
+// TestHandleCreateIncidentInvalidCustomFields tests that invalid custom fields are rejected before anything is sent to ServiceNow
+func (s *HandlerTestSuite) TestHandleCreateIncidentInvalidCustomFields() {
+	executed := false
+	s.mockAPIIntegrations.ExecuteCommandFunc = func(params *api_integrations.ExecuteCommandParams, opts ...api_integrations.ClientOption) (*api_integrations.ExecuteCommandOK, error) {
+		executed = true
+		return nil, fmt.Errorf("unexpected ExecuteCommand call")
+	}
+
+	handler := &Handler{
+		logger: s.logger,
+		falconClientFunc: func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+			mockClient := &client.CrowdStrikeAPISpecification{}
+			mockClient.CustomStorage = s.mockStorage
+			mockClient.APIIntegrations = s.mockAPIIntegrations
+			return mockClient, "us-1", nil
+		},
+	}
+
+	response := handler.HandleCreateIncident(context.Background(), fdk.RequestOf[CreateIncidentRequest]{
+		Body: CreateIncidentRequest{
+			ConfigID:         "config123",
+			EntityID:         "entity123",
+			ShortDescription: "Test incident",
+			CustomFields:     `{"short_description": "overwritten"}`,
+		},
+		AccessToken: "test-token",
+	}, fdk.WorkflowCtx{})
+
+	s.Equal(400, response.Code)
+	s.Require().Len(response.Errors, 1)
+	s.Contains(response.Errors[0].Message, "custom_fields.short_description would overwrite a core field")
+	s.False(executed, "ServiceNow must not be called for invalid custom fields")
+}
+
 // TestHandlerSuite runs the handler test suite
 func TestHandlerSuite(t *testing.T) {
 	suite.Run(t, new(HandlerTestSuite))
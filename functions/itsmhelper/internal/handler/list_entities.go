@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+)
+
+// ListEntitiesForTicketRequest represents the request body for listing the entities mapped to a ticket
+type ListEntitiesForTicketRequest struct {
+	ExternalEntityID string `json:"external_entity_id"`
+	ExternalSystemID string `json:"external_system_id,omitempty"`
+	Offset           int    `json:"offset,omitempty"`
+	Limit            int    `json:"limit,omitempty"`
+}
+
+// MappedEntity is an internal entity mapped to a ticket
+type MappedEntity struct {
+	InternalEntityID        string `json:"internal_entity_id"`
+	ExternalSystemID        string `json:"external_system_id"`
+	ExternalLastKnownStatus string `json:"external_last_known_status,omitempty"`
+	ExternalLastUpdateTime  int64  `json:"external_last_update_time,omitempty"`
+}
+
+// ListEntitiesForTicketResponse represents the response body for listing the entities mapped to a ticket
+type ListEntitiesForTicketResponse struct {
+	Entities   []MappedEntity `json:"entities"`
+	Total      int            `json:"total"`
+	NextOffset int            `json:"next_offset"`
+	Completed  bool           `json:"completed"`
+}
+
+// HandleListEntitiesForTicket handles the /list_entities_for_ticket endpoint
+func (h *Handler) HandleListEntitiesForTicket(ctx context.Context, r fdk.RequestOf[ListEntitiesForTicketRequest]) fdk.Response {
+	if r.Body.ExternalEntityID == "" {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: "external_entity_id is required"})
+	}
+	if r.Body.Offset < 0 || r.Body.Limit < 0 {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: "offset and limit must not be negative"})
+	}
+
+	falconClient, _, err := h.falconClientFunc(r.AccessToken, h.logger)
+	if err != nil {
+		errMsg := fmt.Sprintf("error creating Falcon client: %v", err)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: errMsg})
+	}
+
+	result, err := storage.ListEntitiesForTicket(ctx, falconClient.CustomStorage, h.logger, r.Body.ExternalEntityID, storage.EntitySearchOptions{
+		ExternalSystemID: r.Body.ExternalSystemID,
+		Offset:           r.Body.Offset,
+		Limit:            r.Body.Limit,
+	})
+	if err != nil {
+		h.logger.Error("failed to list entities for ticket", "external_entity_id", r.Body.ExternalEntityID, "error", err)
+		return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: err.Error()})
+	}
+
+	entities := make([]MappedEntity, 0, len(result.Records))
+	for _, record := range result.Records {
+		entities = append(entities, MappedEntity{
+			InternalEntityID:        record.InternalEntityID,
+			ExternalSystemID:        record.ExternalSystemID,
+			ExternalLastKnownStatus: record.ExternalLastKnownStatus,
+			ExternalLastUpdateTime:  record.ExternalLastUpdateTime,
+		})
+	}
+
+	return fdk.Response{
+		Code: http.StatusOK,
+		Body: fdk.JSON(ListEntitiesForTicketResponse{
+			Entities:   entities,
+			Total:      result.Total,
+			NextOffset: result.NextOffset,
+			Completed:  result.NextOffset == 0,
+		}),
+	}
+}
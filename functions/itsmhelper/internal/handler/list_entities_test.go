@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+	"github.com/crowdstrike/gofalcon/falcon/client"
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+)
+
+// TestHandleListEntitiesForTicket tests the Handler.HandleListEntitiesForTicket method
+func (s *HandlerTestSuite) TestHandleListEntitiesForTicket() {
+	tests := []struct {
+		name       string
+		request    ListEntitiesForTicketRequest
+		searchErr  error
+		wantCode   int
+		wantFilter string
+		wantBody   ListEntitiesForTicketResponse
+		wantError  string
+	}{
+		{
+			name:       "Entities mapped to a ticket",
+			request:    ListEntitiesForTicketRequest{ExternalEntityID: "sys123"},
+			wantCode:   200,
+			wantFilter: "external_entity_id:'sys123'",
+			wantBody: ListEntitiesForTicketResponse{
+				Entities: []MappedEntity{
+					{InternalEntityID: "alert1", ExternalSystemID: "servicenow_incident", ExternalLastKnownStatus: "2"},
+					{InternalEntityID: "alert2", ExternalSystemID: "servicenow_incident"},
+				},
+				Total:     2,
+				Completed: true,
+			},
+		},
+		{
+			name:       "Paginated by external system",
+			request:    ListEntitiesForTicketRequest{ExternalEntityID: "sys123", ExternalSystemID: "servicenow_incident", Limit: 1},
+			wantCode:   200,
+			wantFilter: "external_entity_id:'sys123'+external_system_id:'servicenow_incident'",
+			wantBody: ListEntitiesForTicketResponse{
+				Entities:   []MappedEntity{{InternalEntityID: "alert1", ExternalSystemID: "servicenow_incident", ExternalLastKnownStatus: "2"}},
+				Total:      2,
+				NextOffset: 1,
+			},
+		},
+		{
+			name:      "Missing ticket",
+			wantCode:  400,
+			wantError: "external_entity_id is required",
+		},
+		{
+			name:      "Negative offset",
+			request:   ListEntitiesForTicketRequest{ExternalEntityID: "sys123", Offset: -1},
+			wantCode:  400,
+			wantError: "offset and limit must not be negative",
+		},
+		{
+			name:      "Storage rate limited",
+			request:   ListEntitiesForTicketRequest{ExternalEntityID: "sys123"},
+			searchErr: custom_storage.NewSearchObjectsTooManyRequests(),
+			wantCode:  429,
+			wantError: "failed to search entity mappings",
+		},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+
+			records := map[string]string{
+				"servicenow_incident.alert1": `{"internal_entity_id":"alert1","external_entity_id":"sys123","external_system_id":"servicenow_incident","external_last_known_status":"2"}`,
+				"servicenow_incident.alert2": `{"internal_entity_id":"alert2","external_entity_id":"sys123","external_system_id":"servicenow_incident"}`,
+			}
+			s.mockStorage.SearchObjectsFunc = func(params *custom_storage.SearchObjectsParams, opts ...custom_storage.ClientOption) (*custom_storage.SearchObjectsOK, error) {
+				if tc.searchErr != nil {
+					return nil, tc.searchErr
+				}
+				s.Equal(tc.wantFilter, params.Filter)
+				keys := []string{"servicenow_incident.alert1", "servicenow_incident.alert2"}
+				total := int64(len(keys))
+				keys = keys[params.Offset:min(params.Offset+params.Limit, total)]
+				resources := make([]*models.APIObjectMetadata, 0, len(keys))
+				for _, key := range keys {
+					resources = append(resources, &models.APIObjectMetadata{ObjectKey: &key})
+				}
+				return &custom_storage.SearchObjectsOK{Payload: &models.CustomStorageResponse{
+					Resources: resources,
+					Meta:      &models.APIMetaInfo{Pagination: &models.APIResponsePagination{Total: &total}},
+				}}, nil
+			}
+			s.mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+				_, err := io.Copy(writer, strings.NewReader(records[params.ObjectKey]))
+				return &custom_storage.GetObjectOK{}, err
+			}
+
+			handler := &Handler{
+				logger: s.logger,
+				falconClientFunc: func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+					mockClient := &client.CrowdStrikeAPISpecification{}
+					mockClient.CustomStorage = s.mockStorage
+					return mockClient, "us-1", nil
+				},
+			}
+
+			response := handler.HandleListEntitiesForTicket(context.Background(), fdk.RequestOf[ListEntitiesForTicketRequest]{
+				Body:        tc.request,
+				AccessToken: "test-token",
+			})
+
+			s.Equal(tc.wantCode, response.Code)
+			if tc.wantError != "" {
+				s.Require().Len(response.Errors, 1)
+				s.Contains(response.Errors[0].Message, tc.wantError)
+				return
+			}
+
+			jsonBytes, err := json.Marshal(response.Body)
+			s.Require().NoError(err)
+			var body ListEntitiesForTicketResponse
+			s.Require().NoError(json.Unmarshal(jsonBytes, &body))
+			s.Equal(tc.wantBody, body)
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+)
+
+// GetEntityMappingHistoryRequest represents the request body for reading the mapping history of an entity
+type GetEntityMappingHistoryRequest struct {
+	InternalEntityID string `json:"internal_entity_id"`
+	ExternalSystemID string `json:"external_system_id,omitempty"`
+}
+
+// TicketMapping is a ticket an entity is or was mapped to
+type TicketMapping struct {
+	ExternalEntityID string `json:"external_entity_id"`
+	// ExternalSystemID is only set on history entries recording a move to a ticket of another external system
+	ExternalSystemID        string `json:"external_system_id,omitempty"`
+	ExternalLastKnownStatus string `json:"external_last_known_status,omitempty"`
+	MappedAt                int64  `json:"mapped_at,omitempty"`
+	ReplacedAt              int64  `json:"replaced_at,omitempty"`
+	Reason                  string `json:"reason,omitempty"`
+}
+
+// GetEntityMappingHistoryResponse represents the response body for reading the mapping history of an entity
+type GetEntityMappingHistoryResponse struct {
+	InternalEntityID string        `json:"internal_entity_id"`
+	ExternalSystemID string        `json:"external_system_id"`
+	Current          TicketMapping `json:"current"`
+	// History lists the tickets the entity was mapped to before and its moves to other external systems, oldest first
+	History        []TicketMapping `json:"history"`
+	HistoryDropped int             `json:"history_dropped"`
+}
+
+// HandleGetEntityMappingHistory handles the /get_entity_mapping_history endpoint
+func (h *Handler) HandleGetEntityMappingHistory(ctx context.Context, r fdk.RequestOf[GetEntityMappingHistoryRequest]) fdk.Response {
+	if r.Body.InternalEntityID == "" {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: "internal_entity_id is required"})
+	}
+
+	externalSystemID := r.Body.ExternalSystemID
+	if externalSystemID == "" {
+		externalSystemID = ExternalSystemIDServiceNowIncident
+	}
+
+	falconClient, _, err := h.falconClientFunc(r.AccessToken, h.logger)
+	if err != nil {
+		errMsg := fmt.Sprintf("error creating Falcon client: %v", err)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: errMsg})
+	}
+
+	exists, record, err := storage.CheckExternalEntityExists(ctx, falconClient.CustomStorage, h.logger, r.Body.InternalEntityID, externalSystemID)
+	if err != nil {
+		errMsg := fmt.Sprintf("failed to read entity mapping: %v", err)
+		return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: errMsg})
+	}
+	if !exists {
+		errMsg := fmt.Sprintf("no %s ticket is mapped to entity %s", externalSystemID, r.Body.InternalEntityID)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusNotFound, Message: errMsg})
+	}
+
+	history := make([]TicketMapping, 0, len(record.History))
+	for _, entry := range record.History {
+		history = append(history, TicketMapping{
+			ExternalEntityID:        entry.ExternalEntityID,
+			ExternalSystemID:        entry.ExternalSystemID,
+			ExternalLastKnownStatus: entry.ExternalLastKnownStatus,
+			MappedAt:                entry.MappedAt,
+			ReplacedAt:              entry.ReplacedAt,
+			Reason:                  entry.Reason,
+		})
+	}
+
+	return fdk.Response{
+		Code: http.StatusOK,
+		Body: fdk.JSON(GetEntityMappingHistoryResponse{
+			InternalEntityID: r.Body.InternalEntityID,
+			ExternalSystemID: externalSystemID,
+			Current: TicketMapping{
+				ExternalEntityID:        record.ExternalEntityID,
+				ExternalLastKnownStatus: record.ExternalLastKnownStatus,
+				MappedAt:                record.MappedAt,
+			},
+			History:        history,
+			HistoryDropped: record.HistoryDropped,
+		}),
+	}
+}
@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+	"github.com/crowdstrike/gofalcon/falcon/client"
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+	"github.com/go-openapi/runtime"
+)
+
+// TestHandleGetEntityMappingHistory tests the Handler.HandleGetEntityMappingHistory method
+func (s *HandlerTestSuite) TestHandleGetEntityMappingHistory() {
+	const record = `{"internal_entity_id":"alert1","external_entity_id":"INC002","external_system_id":"servicenow_incident",` +
+		`"external_last_known_status":"1","mapped_at":2000,` +
+		`"history":[{"external_entity_id":"INC001","external_last_known_status":"7","mapped_at":1000,"replaced_at":2000,"reason":"re-escalated"}],` +
+		`"history_dropped":3}`
+
+	tests := []struct {
+		name      string
+		request   GetEntityMappingHistoryRequest
+		stored    map[string]string
+		getErr    error
+		wantCode  int
+		wantBody  GetEntityMappingHistoryResponse
+		wantError string
+	}{
+		{
+			name:     "Mapping with history",
+			request:  GetEntityMappingHistoryRequest{InternalEntityID: "alert1"},
+			stored:   map[string]string{"servicenow_incident.alert1": record},
+			wantCode: 200,
+			wantBody: GetEntityMappingHistoryResponse{
+				InternalEntityID: "alert1",
+				ExternalSystemID: "servicenow_incident",
+				Current:          TicketMapping{ExternalEntityID: "INC002", ExternalLastKnownStatus: "1", MappedAt: 2000},
+				History: []TicketMapping{
+					{ExternalEntityID: "INC001", ExternalLastKnownStatus: "7", MappedAt: 1000, ReplacedAt: 2000, Reason: "re-escalated"},
+				},
+				HistoryDropped: 3,
+			},
+		},
+		{
+			name:    "Mapping without history",
+			request: GetEntityMappingHistoryRequest{InternalEntityID: "alert1", ExternalSystemID: "servicenow_sir_incident"},
+			stored: map[string]string{
+				"servicenow_sir_incident.alert1": `{"internal_entity_id":"alert1","external_entity_id":"SIR001","external_system_id":"servicenow_sir_incident"}`,
+			},
+			wantCode: 200,
+			wantBody: GetEntityMappingHistoryResponse{
+				InternalEntityID: "alert1",
+				ExternalSystemID: "servicenow_sir_incident",
+				Current:          TicketMapping{ExternalEntityID: "SIR001"},
+				History:          []TicketMapping{},
+			},
+		},
+		{
+			name:      "Not mapped",
+			request:   GetEntityMappingHistoryRequest{InternalEntityID: "alert2"},
+			wantCode:  404,
+			wantError: "no servicenow_incident ticket is mapped to entity alert2",
+		},
+		{
+			name:      "Missing entity",
+			wantCode:  400,
+			wantError: "internal_entity_id is required",
+		},
+		{
+			name:      "Storage unavailable",
+			request:   GetEntityMappingHistoryRequest{InternalEntityID: "alert1"},
+			getErr:    custom_storage.NewGetObjectInternalServerError(),
+			wantCode:  503,
+			wantError: "failed to read entity mapping",
+		},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+
+			s.mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+				if tc.getErr != nil {
+					return nil, tc.getErr
+				}
+				data, ok := tc.stored[params.ObjectKey]
+				if !ok {
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
+				}
+				_, err := io.Copy(writer, strings.NewReader(data))
+				return &custom_storage.GetObjectOK{}, err
+			}
+
+			handler := &Handler{
+				logger: s.logger,
+				falconClientFunc: func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+					mockClient := &client.CrowdStrikeAPISpecification{}
+					mockClient.CustomStorage = s.mockStorage
+					return mockClient, "us-1", nil
+				},
+			}
+
+			response := handler.HandleGetEntityMappingHistory(context.Background(), fdk.RequestOf[GetEntityMappingHistoryRequest]{
+				Body:        tc.request,
+				AccessToken: "test-token",
+			})
+
+			s.Equal(tc.wantCode, response.Code)
+			if tc.wantError != "" {
+				s.Require().Len(response.Errors, 1)
+				s.Contains(response.Errors[0].Message, tc.wantError)
+				return
+			}
+
+			jsonBytes, err := json.Marshal(response.Body)
+			s.Require().NoError(err)
+			var body GetEntityMappingHistoryResponse
+			s.Require().NoError(json.Unmarshal(jsonBytes, &body))
+			s.Equal(tc.wantBody, body)
+		})
+	}
+}
+
+// TestEntityMappingHistoryRecordsMoves tests that moving an entity from an incident to a SIR incident is recorded
+// in the history of its incident mapping
+func (s *HandlerTestSuite) TestEntityMappingHistoryRecordsMoves() {
+	memStorage := storage.NewMemoryStorageService()
+	handler := &Handler{
+		logger: s.logger,
+		falconClientFunc: func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+			return &client.CrowdStrikeAPISpecification{CustomStorage: memStorage}, "us-1", nil
+		},
+	}
+
+	createMapping := func(externalSystemID, externalEntityID, reason string) {
+		response := handler.HandleCreateEntityMapping(context.Background(), fdk.RequestOf[CreateEntityMappingReq]{
+			Body: CreateEntityMappingReq{
+				InternalEntityID: "alert1",
+				ExternalEntityID: externalEntityID,
+				ExternalSystemID: externalSystemID,
+				Reason:           reason,
+			},
+		})
+		s.Require().Equal(201, response.Code, response.Errors)
+	}
+	getHistory := func(externalSystemID string) GetEntityMappingHistoryResponse {
+		response := handler.HandleGetEntityMappingHistory(context.Background(), fdk.RequestOf[GetEntityMappingHistoryRequest]{
+			Body: GetEntityMappingHistoryRequest{InternalEntityID: "alert1", ExternalSystemID: externalSystemID},
+		})
+		s.Require().Equal(200, response.Code, response.Errors)
+
+		jsonBytes, err := json.Marshal(response.Body)
+		s.Require().NoError(err)
+		var body GetEntityMappingHistoryResponse
+		s.Require().NoError(json.Unmarshal(jsonBytes, &body))
+		return body
+	}
+
+	createMapping(ExternalSystemIDServiceNowIncident, "INC001", "")
+	createMapping(ExternalSystemIDServiceNowSIRIncident, "SIR001", "escalated")
+	// Repeating the move does not record it twice
+	createMapping(ExternalSystemIDServiceNowSIRIncident, "SIR001", "escalated")
+
+	incident := getHistory(ExternalSystemIDServiceNowIncident)
+	s.Equal("INC001", incident.Current.ExternalEntityID, "the incident mapping itself is left unchanged")
+	s.Require().Len(incident.History, 1)
+	move := incident.History[0]
+	s.Equal("SIR001", move.ExternalEntityID)
+	s.Equal(ExternalSystemIDServiceNowSIRIncident, move.ExternalSystemID)
+	s.Equal("escalated", move.Reason)
+	s.NotZero(move.MappedAt)
+
+	sir := getHistory(ExternalSystemIDServiceNowSIRIncident)
+	s.Equal("SIR001", sir.Current.ExternalEntityID)
+	s.Empty(sir.History)
+
+	// A move to another SIR incident is recorded as well
+	createMapping(ExternalSystemIDServiceNowSIRIncident, "SIR002", "re-escalated")
+	s.Len(getHistory(ExternalSystemIDServiceNowIncident).History, 2)
+}
@@ -0,0 +1,246 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crowdstrike/gofalcon/falcon/client/api_integrations"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+	"github.com/go-openapi/runtime"
+)
+
+// RetryPolicy controls how ServiceNow operations are retried after transient failures
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one. Values below 2 disable retries.
+	MaxAttempts int
+	// BaseDelay is the backoff before the first retry. It doubles with every further retry.
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff. When ServiceNow asks to wait longer with Retry-After, the operation is not retried.
+	MaxDelay time.Duration
+	// RetryableStatusCodes lists the status codes that are considered transient
+	RetryableStatusCodes []int
+}
+
+// DefaultRetryPolicy returns the retry policy used when none is configured
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    5 * time.Second,
+		RetryableStatusCodes: []int{
+			http.StatusTooManyRequests,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+	}
+}
+
+// rejectedStatusCodes are responses that guarantee the request was not processed, so that even
+// operations which are not idempotent can be sent again. A 503 may come from a proxy after
+// ServiceNow accepted the request, so only rate limiting qualifies.
+var rejectedStatusCodes = []int{http.StatusTooManyRequests}
+
+// idempotentServiceNowOperations lists the plugin operations that can be repeated without side effects.
+// Creating records is only retried when ServiceNow rejected the request (see rejectedStatusCodes),
+// because a timed out create may still have produced a ticket.
+var idempotentServiceNowOperations = map[string]bool{
+	pluginOpIDServiceNowGetIncident:            true,
+	pluginOpIDServiceNowGetSIRIncident:         true,
+	pluginOpIDServiceNowGetSIRObservableTypes:  true,
+	pluginOpIDServiceNowGetSIRObservables:      true,
+	pluginOpIDServiceNowGetIncidentObservables: true,
+}
+
+// updateServiceNowOperations lists the plugin operations that PATCH a record. Setting fields twice
+// has no further effect, but every write to a journal field appends another entry to the ticket.
+var updateServiceNowOperations = map[string]bool{
+	pluginOpIDServiceNowUpdateIncident:    true,
+	pluginOpIDServiceNowUpdateSIRIncident: true,
+}
+
+// serviceNowJournalFields are the journal fields a PATCH appends to instead of overwriting
+var serviceNowJournalFields = []string{"work_notes", "comments"}
+
+// isIdempotentServiceNowRequest reports whether a request can be repeated without side effects
+func isIdempotentServiceNowRequest(operationID string, request *models.DomainRequest) bool {
+	if idempotentServiceNowOperations[operationID] {
+		return true
+	}
+	if !updateServiceNowOperations[operationID] || request == nil {
+		return false
+	}
+
+	// Payloads that cannot be inspected are treated like journal entries
+	payload, ok := request.JSON.(map[string]interface{})
+	if !ok {
+		return request.JSON == nil
+	}
+	for _, field := range serviceNowJournalFields {
+		if _, ok := payload[field]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// WithRetryPolicy sets the retry policy for all ServiceNow operations
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(h *Handler) {
+		h.retryPolicy = policy
+	}
+}
+
+// WithHandlerRetryPolicy sets the retry policy for the ServiceNow operations of a single handler, overriding
+// WithRetryPolicy. Handlers are identified by their API path, e.g. "/create_incident". Operations that
+// are not safe to repeat are still only retried when ServiceNow rejected the request.
+func WithHandlerRetryPolicy(path string, policy RetryPolicy) Option {
+	return func(h *Handler) {
+		if h.handlerRetryPolicies == nil {
+			h.handlerRetryPolicies = make(map[string]RetryPolicy)
+		}
+		h.handlerRetryPolicies[path] = policy
+	}
+}
+
+// handlerPathKey is the context key of the API path of the handler serving a request
+type handlerPathKey struct{}
+
+// withHandlerPath records the API path of the handler serving a request, which selects its retry policy
+func withHandlerPath(ctx context.Context, path string) context.Context {
+	return context.WithValue(ctx, handlerPathKey{}, path)
+}
+
+// retryPolicyFor returns the retry policy of the handler serving a request
+func (h *Handler) retryPolicyFor(ctx context.Context) RetryPolicy {
+	if path, ok := ctx.Value(handlerPathKey{}).(string); ok {
+		if policy, ok := h.handlerRetryPolicies[path]; ok {
+			return policy
+		}
+	}
+	return h.retryPolicy
+}
+
+// transientFailure describes a failed ExecuteCommand attempt that may succeed when repeated
+type transientFailure struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+// shouldRetry reports whether a failure of a request to an operation is retried under this policy
+func (p RetryPolicy) shouldRetry(failure *transientFailure, operationID string, request *models.DomainRequest) bool {
+	if failure == nil || !slices.Contains(p.RetryableStatusCodes, failure.StatusCode) {
+		return false
+	}
+	return isIdempotentServiceNowRequest(operationID, request) || slices.Contains(rejectedStatusCodes, failure.StatusCode)
+}
+
+// backoff returns the delay before the given retry (starting at 1), using exponential backoff with jitter.
+// It returns false when a Retry-After sent by ServiceNow exceeds MaxDelay.
+func (p RetryPolicy) backoff(retry int, retryAfter time.Duration) (time.Duration, bool) {
+	if p.MaxDelay > 0 && retryAfter > p.MaxDelay {
+		return 0, false
+	}
+
+	delay := p.BaseDelay << (retry - 1)
+	if delay <= 0 || (p.MaxDelay > 0 && delay > p.MaxDelay) {
+		delay = p.MaxDelay
+	}
+
+	// Equal jitter keeps at least half of the backoff while spreading out concurrent callers
+	if delay > 0 {
+		delay = delay/2 + rand.N(delay/2+1)
+	}
+
+	return max(delay, retryAfter), true
+}
+
+// classifyExecuteCommandFailure inspects the result of an ExecuteCommand call and returns the
+// transient failure it represents, or nil for successes and errors that are not worth retrying
+func classifyExecuteCommandFailure(execResp *api_integrations.ExecuteCommandOK, err error) *transientFailure {
+	if err != nil {
+		var tooMany *api_integrations.ExecuteCommandTooManyRequests
+		if errors.As(err, &tooMany) {
+			failure := &transientFailure{StatusCode: http.StatusTooManyRequests}
+			if tooMany.XRateLimitRetryAfter > 0 {
+				failure.RetryAfter = time.Until(time.Unix(tooMany.XRateLimitRetryAfter, 0))
+			}
+			return failure
+		}
+
+		var apiErr *runtime.APIError
+		if errors.As(err, &apiErr) {
+			return &transientFailure{StatusCode: apiErr.Code}
+		}
+
+		var coder interface{ Code() int }
+		if errors.As(err, &coder) {
+			return &transientFailure{StatusCode: coder.Code()}
+		}
+
+		// The API integration proxy timing out is treated like a gateway timeout
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return &transientFailure{StatusCode: http.StatusGatewayTimeout}
+		}
+
+		return nil
+	}
+
+	if execResp == nil || execResp.Payload == nil || len(execResp.Payload.Resources) == 0 {
+		return nil
+	}
+
+	resource := execResp.Payload.Resources[0]
+	if resource.StatusCode == nil || *resource.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+
+	return &transientFailure{
+		StatusCode: int(*resource.StatusCode),
+		RetryAfter: parseRetryAfter(resource.Headers),
+	}
+}
+
+// parseRetryAfter reads the Retry-After header, given either in seconds or as an HTTP date
+func parseRetryAfter(headers map[string][]string) time.Duration {
+	for name, values := range headers {
+		if !strings.EqualFold(name, "Retry-After") || len(values) == 0 {
+			continue
+		}
+
+		value := strings.TrimSpace(values[0])
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if at, err := http.ParseTime(value); err == nil {
+			return max(time.Until(at), 0)
+		}
+	}
+
+	return 0
+}
+
+// waitForRetry sleeps for delay unless the context is cancelled or its deadline would pass first
+func waitForRetry(ctx context.Context, delay time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		return false
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,272 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/crowdstrike/gofalcon/falcon/client"
+	"github.com/crowdstrike/gofalcon/falcon/client/api_integrations"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+)
+
+// timeoutError mimics the error returned when the API integration proxy times out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "proxy timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// TestExecuteServiceNowCommandRetry tests the retry policy around ExecuteCommand
+func (s *HandlerTestSuite) TestExecuteServiceNowCommandRetry() {
+	statusResult := func(code int32, headers map[string][]string) func() (*api_integrations.ExecuteCommandOK, error) {
+		return func() (*api_integrations.ExecuteCommandOK, error) {
+			return &api_integrations.ExecuteCommandOK{
+				Payload: &models.DomainExecuteCommandResultsV1{
+					Resources: []*models.DomainExecuteCommandResultV1{{
+						StatusCode:   &code,
+						Headers:      headers,
+						ResponseBody: map[string]interface{}{"result": map[string]interface{}{"sys_id": "sys123"}},
+					}},
+				},
+			}, nil
+		}
+	}
+	success := statusResult(200, nil)
+
+	policy := RetryPolicy{
+		MaxAttempts:          3,
+		BaseDelay:            time.Millisecond,
+		MaxDelay:             5 * time.Millisecond,
+		RetryableStatusCodes: DefaultRetryPolicy().RetryableStatusCodes,
+	}
+
+	tests := []struct {
+		name        string
+		operationID string
+		handlerPath string
+		request     *models.DomainRequest
+		attempts    []func() (*api_integrations.ExecuteCommandOK, error)
+		ctxTimeout  time.Duration
+		wantCalls   int
+		wantErr     string
+	}{
+		{
+			name:        "Create is retried when ServiceNow rate limits the request",
+			operationID: pluginOpIDServiceNowCreateIncident,
+			attempts:    []func() (*api_integrations.ExecuteCommandOK, error){statusResult(429, nil), statusResult(429, nil), success},
+			wantCalls:   3,
+		},
+		{
+			name:        "Create is not retried after a service unavailable response",
+			operationID: pluginOpIDServiceNowCreateIncident,
+			attempts:    []func() (*api_integrations.ExecuteCommandOK, error){statusResult(503, nil), success},
+			wantCalls:   1,
+			wantErr:     "failed to execute command: ServiceNow returned status 503",
+		},
+		{
+			name:        "Create is not retried after a gateway timeout",
+			operationID: pluginOpIDServiceNowCreateIncident,
+			attempts:    []func() (*api_integrations.ExecuteCommandOK, error){statusResult(504, nil), success},
+			wantCalls:   1,
+			wantErr:     "failed to execute command: ServiceNow returned status 504",
+		},
+		{
+			name:        "Read is retried after a gateway timeout",
+			operationID: pluginOpIDServiceNowGetIncident,
+			attempts:    []func() (*api_integrations.ExecuteCommandOK, error){statusResult(504, nil), success},
+			wantCalls:   2,
+		},
+		{
+			name:        "Update is retried after a proxy timeout",
+			operationID: pluginOpIDServiceNowUpdateIncident,
+			request:     &models.DomainRequest{JSON: map[string]interface{}{"state": "6"}},
+			attempts: []func() (*api_integrations.ExecuteCommandOK, error){
+				func() (*api_integrations.ExecuteCommandOK, error) { return nil, timeoutError{} },
+				success,
+			},
+			wantCalls: 2,
+		},
+		{
+			name:        "Update with work notes is not retried after a gateway timeout",
+			operationID: pluginOpIDServiceNowUpdateSIRIncident,
+			request:     &models.DomainRequest{JSON: map[string]interface{}{"state": "6", "work_notes": "Closed from Falcon"}},
+			attempts:    []func() (*api_integrations.ExecuteCommandOK, error){statusResult(504, nil), success},
+			wantCalls:   1,
+			wantErr:     "failed to execute command: ServiceNow returned status 504",
+		},
+		{
+			name:        "Update with comments is retried when ServiceNow rate limits the request",
+			operationID: pluginOpIDServiceNowUpdateIncident,
+			request:     &models.DomainRequest{JSON: map[string]interface{}{"comments": "Closed from Falcon"}},
+			attempts:    []func() (*api_integrations.ExecuteCommandOK, error){statusResult(429, nil), success},
+			wantCalls:   2,
+		},
+		{
+			name:        "Update with comments is not retried after a service unavailable response",
+			operationID: pluginOpIDServiceNowUpdateIncident,
+			request:     &models.DomainRequest{JSON: map[string]interface{}{"comments": "Closed from Falcon"}},
+			attempts:    []func() (*api_integrations.ExecuteCommandOK, error){statusResult(503, nil), success},
+			wantCalls:   1,
+			wantErr:     "failed to execute command: ServiceNow returned status 503",
+		},
+		{
+			name:        "Falcon rate limit is retried",
+			operationID: pluginOpIDServiceNowCreateIncident,
+			attempts: []func() (*api_integrations.ExecuteCommandOK, error){
+				func() (*api_integrations.ExecuteCommandOK, error) {
+					return nil, api_integrations.NewExecuteCommandTooManyRequests()
+				},
+				success,
+			},
+			wantCalls: 2,
+		},
+		{
+			name:        "Attempts are bounded",
+			operationID: pluginOpIDServiceNowGetIncident,
+			attempts:    []func() (*api_integrations.ExecuteCommandOK, error){statusResult(429, nil), statusResult(429, nil), statusResult(429, nil), success},
+			wantCalls:   3,
+			wantErr:     "failed to execute command: ServiceNow returned status 429",
+		},
+		{
+			name:        "Client errors are not retried",
+			operationID: pluginOpIDServiceNowGetIncident,
+			attempts:    []func() (*api_integrations.ExecuteCommandOK, error){statusResult(400, nil), success},
+			wantCalls:   1,
+			wantErr:     "failed to execute command: ServiceNow returned status 400",
+		},
+		{
+			name:        "Retry-After beyond the context deadline stops retrying",
+			operationID: pluginOpIDServiceNowGetIncident,
+			handlerPath: "/sync_ticket_states",
+			attempts: []func() (*api_integrations.ExecuteCommandOK, error){
+				statusResult(503, map[string][]string{"retry-after": {"30"}}),
+				success,
+			},
+			ctxTimeout: time.Second,
+			wantCalls:  1,
+			wantErr:    "failed to execute command: ServiceNow returned status 503",
+		},
+		{
+			name:        "Retry-After beyond the maximum delay stops retrying",
+			operationID: pluginOpIDServiceNowGetIncident,
+			attempts: []func() (*api_integrations.ExecuteCommandOK, error){
+				statusResult(429, map[string][]string{"Retry-After": {"1"}}),
+				success,
+			},
+			wantCalls: 1,
+			wantErr:   "failed to execute command: ServiceNow returned status 429",
+		},
+		{
+			name:        "Handler policy overrides the default policy",
+			operationID: pluginOpIDServiceNowGetIncident,
+			handlerPath: "/update_incident",
+			attempts:    []func() (*api_integrations.ExecuteCommandOK, error){statusResult(504, nil), success},
+			wantCalls:   1,
+			wantErr:     "failed to execute command: ServiceNow returned status 504",
+		},
+		{
+			name:        "Handler policy does not apply to other handlers",
+			operationID: pluginOpIDServiceNowGetIncident,
+			handlerPath: "/create_incident",
+			attempts:    []func() (*api_integrations.ExecuteCommandOK, error){statusResult(504, nil), success},
+			wantCalls:   2,
+		},
+		{
+			name:        "Handler policy does not make creates retry after a timeout",
+			operationID: pluginOpIDServiceNowCreateIncident,
+			handlerPath: "/create_sir_incident",
+			attempts:    []func() (*api_integrations.ExecuteCommandOK, error){statusResult(504, nil), success},
+			wantCalls:   1,
+			wantErr:     "failed to execute command: ServiceNow returned status 504",
+		},
+		{
+			name:        "Other transport errors are not retried",
+			operationID: pluginOpIDServiceNowGetIncident,
+			attempts: []func() (*api_integrations.ExecuteCommandOK, error){
+				func() (*api_integrations.ExecuteCommandOK, error) { return nil, fmt.Errorf("connection refused") },
+				success,
+			},
+			wantCalls: 1,
+			wantErr:   "failed to execute command: connection refused",
+		},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+
+			calls := 0
+			s.mockAPIIntegrations.ExecuteCommandFunc = func(params *api_integrations.ExecuteCommandParams, opts ...api_integrations.ClientOption) (*api_integrations.ExecuteCommandOK, error) {
+				attempt := tc.attempts[calls]
+				calls++
+				return attempt()
+			}
+
+			handler := &Handler{
+				logger: s.logger,
+				falconClientFunc: func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+					return nil, "", nil
+				},
+				retryPolicy: policy,
+				handlerRetryPolicies: map[string]RetryPolicy{
+					"/update_incident":     {MaxAttempts: 1},
+					"/create_sir_incident": {MaxAttempts: 5, RetryableStatusCodes: policy.RetryableStatusCodes},
+					"/sync_ticket_states":  {MaxAttempts: 3, MaxDelay: time.Minute, RetryableStatusCodes: policy.RetryableStatusCodes},
+				},
+			}
+			falconClient := &client.CrowdStrikeAPISpecification{APIIntegrations: s.mockAPIIntegrations}
+
+			ctx := context.Background()
+			if tc.handlerPath != "" {
+				ctx = withHandlerPath(ctx, tc.handlerPath)
+			}
+			if tc.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.ctxTimeout)
+				defer cancel()
+			}
+
+			request := tc.request
+			if request == nil {
+				request = &models.DomainRequest{}
+			}
+
+			_, err := handler.executeServiceNowRecordCommand(ctx, falconClient, "config123", tc.operationID, request)
+			s.Equal(tc.wantCalls, calls, "number of ExecuteCommand calls")
+			if tc.wantErr != "" {
+				s.EqualError(err, tc.wantErr)
+			} else {
+				s.NoError(err)
+			}
+		})
+	}
+}
+
+// TestRetryPolicyBackoff tests the RetryPolicy backoff and Retry-After handling
+func (s *HandlerTestSuite) TestRetryPolicyBackoff() {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+
+	for retry, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 300 * time.Millisecond, 10: 300 * time.Millisecond} {
+		delay, ok := policy.backoff(retry, 0)
+		s.True(ok, "retry %d", retry)
+		s.GreaterOrEqual(delay, want/2, "retry %d", retry)
+		s.LessOrEqual(delay, want, "retry %d", retry)
+	}
+
+	delay, ok := policy.backoff(1, 250*time.Millisecond)
+	s.True(ok)
+	s.Equal(250*time.Millisecond, delay, "Retry-After should win over a shorter backoff")
+
+	_, ok = policy.backoff(1, 2*time.Second)
+	s.False(ok, "Retry-After beyond MaxDelay should not be retried")
+
+	s.Equal(7*time.Second, parseRetryAfter(map[string][]string{"Retry-After": {"7"}}))
+	s.InDelta(float64(time.Minute), float64(parseRetryAfter(map[string][]string{
+		"Retry-After": {time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)},
+	})), float64(2*time.Second))
+	s.Zero(parseRetryAfter(map[string][]string{"Retry-After": {"soon"}}))
+	s.Zero(parseRetryAfter(nil))
+}
@@ -0,0 +1,299 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+	"github.com/crowdstrike/gofalcon/falcon/client"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+)
+
+var (
+	// Defined in 'api-integrations/servicenow.json'
+	pluginOpIDServiceNowGetSIRObservableTypes  = "get_sir_observable_types"
+	pluginOpIDServiceNowGetSIRObservables      = "get_sir_observables"
+	pluginOpIDServiceNowCreateSIRObservable    = "create_sir_observable"
+	pluginOpIDServiceNowGetIncidentObservables = "get_incident_observables"
+	pluginOpIDServiceNowLinkSIRObservable      = "link_observable_to_sir_incident"
+)
+
+// Statuses reported per observable by the /add_sir_observables endpoint
+const (
+	SIRObservableStatusLinked        = "linked"
+	SIRObservableStatusAlreadyLinked = "already_linked"
+	SIRObservableStatusFailed        = "failed"
+)
+
+// sirObservableTypeAliases maps the indicator types used in Falcon workflows onto the names and values
+// of the out-of-the-box sn_ti_observable_type records. Types that are not listed here are matched
+// against the sn_ti_observable_type name and value directly.
+var sirObservableTypeAliases = map[string][]string{
+	"md5":       {"MD5", "MD5 hash", "file-hash-md5"},
+	"sha1":      {"SHA1", "SHA-1", "SHA1 hash", "file-hash-sha1"},
+	"sha256":    {"SHA256", "SHA-256", "SHA256 hash", "file-hash-sha256"},
+	"ipv4":      {"IPV4-ADDR", "IPv4 address", "IP address"},
+	"ipv6":      {"IPV6-ADDR", "IPv6 address", "IP address"},
+	"domain":    {"DOMAIN-NAME", "Domain name", "Domain"},
+	"file_name": {"FILE-NAME", "File name", "Filename"},
+	"url":       {"URL"},
+}
+
+// SIRObservable represents a typed indicator to add to a SIR incident
+type SIRObservable struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	Notes string `json:"notes,omitempty"`
+}
+
+// AddSIRObservablesRequest represents the request body for adding observables to the SIR incident mapped to an entity
+type AddSIRObservablesRequest struct {
+	ConfigID    string          `json:"config_id"`
+	EntityID    string          `json:"entity_id"`
+	Context     string          `json:"context"`
+	Observables []SIRObservable `json:"observables"`
+}
+
+// SIRObservableResult reports the outcome for a single observable
+type SIRObservableResult struct {
+	Type         string `json:"type"`
+	Value        string `json:"value"`
+	Status       string `json:"status"`
+	Created      bool   `json:"created"`
+	ObservableID string `json:"observable_id,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// AddSIRObservablesResponse represents the response body for adding observables to a SIR incident
+type AddSIRObservablesResponse struct {
+	TicketID string                `json:"ticket_id"`
+	Results  []SIRObservableResult `json:"results"`
+}
+
+// sirObservableType identifies a record of the sn_ti_observable_type table
+type sirObservableType struct {
+	SysID string
+	Value string
+}
+
+// serviceNowQueryValue escapes a value for use in a ServiceNow encoded query
+func serviceNowQueryValue(value string) string {
+	return strings.ReplaceAll(value, "^", "^^")
+}
+
+// resolveSIRObservableType finds the sn_ti_observable_type record for an indicator type
+func resolveSIRObservableType(indicatorType string, types map[string]sirObservableType) (sirObservableType, bool) {
+	candidates := append([]string{indicatorType}, sirObservableTypeAliases[strings.ToLower(indicatorType)]...)
+	for _, candidate := range candidates {
+		if observableType, ok := types[strings.ToLower(candidate)]; ok {
+			return observableType, true
+		}
+	}
+
+	return sirObservableType{}, false
+}
+
+// fetchSIRObservableTypes returns the sn_ti_observable_type records indexed by lower-cased name and value
+func (h *Handler) fetchSIRObservableTypes(ctx context.Context, falconClient *client.CrowdStrikeAPISpecification, configID string) (map[string]sirObservableType, error) {
+	records, err := h.executeServiceNowListCommand(ctx, falconClient, configID, pluginOpIDServiceNowGetSIRObservableTypes, &models.DomainRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	types := make(map[string]sirObservableType, len(records)*2)
+	for _, record := range records {
+		sysID, _ := record["sys_id"].(string)
+		name, _ := record["name"].(string)
+		value, _ := record["value"].(string)
+		if sysID == "" {
+			continue
+		}
+
+		observableType := sirObservableType{SysID: sysID, Value: value}
+		if value != "" {
+			types[strings.ToLower(value)] = observableType
+		}
+		if name != "" {
+			if _, ok := types[strings.ToLower(name)]; !ok {
+				types[strings.ToLower(name)] = observableType
+			}
+		}
+	}
+
+	return types, nil
+}
+
+// findOrCreateSIRObservable returns the sys_id of the observable with the given type and value, creating it if needed
+func (h *Handler) findOrCreateSIRObservable(
+	ctx context.Context,
+	falconClient *client.CrowdStrikeAPISpecification,
+	configID string,
+	observableType sirObservableType,
+	observable SIRObservable,
+) (string, bool, error) {
+	query := fmt.Sprintf("value=%s^type=%s", serviceNowQueryValue(observable.Value), observableType.SysID)
+	records, err := h.executeServiceNowListCommand(ctx, falconClient, configID, pluginOpIDServiceNowGetSIRObservables, &models.DomainRequest{
+		Params: &models.DomainParams{
+			Query: map[string]string{"sysparm_query": query},
+		},
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	for _, record := range records {
+		if sysID, ok := record["sys_id"].(string); ok && sysID != "" {
+			return sysID, false, nil
+		}
+	}
+
+	payload := map[string]interface{}{
+		"type":  observableType.SysID,
+		"value": observable.Value,
+	}
+	if observable.Notes != "" {
+		payload["notes"] = observable.Notes
+	}
+
+	result, err := h.executeServiceNowRecordCommand(ctx, falconClient, configID, pluginOpIDServiceNowCreateSIRObservable, &models.DomainRequest{
+		JSON: payload,
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	sysID, _ := result["sys_id"].(string)
+	if sysID == "" {
+		return "", false, fmt.Errorf("ServiceNow did not return a sys_id for the created observable")
+	}
+
+	return sysID, true, nil
+}
+
+// HandleAddSIRObservables handles the /add_sir_observables endpoint
+func (h *Handler) HandleAddSIRObservables(ctx context.Context, r fdk.RequestOf[AddSIRObservablesRequest], wrkCtx fdk.WorkflowCtx) fdk.Response {
+	ctx = withHandlerPath(ctx, "/add_sir_observables")
+	h.logger.Info("Adding SIR observables", "trace_id", r.TraceID, "wrk_ctx", wrkCtx, "count", len(r.Body.Observables))
+
+	if len(r.Body.Observables) == 0 {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: "at least one observable is required"})
+	}
+	for i, observable := range r.Body.Observables {
+		if strings.TrimSpace(observable.Type) == "" || strings.TrimSpace(observable.Value) == "" {
+			errMsg := fmt.Sprintf("observable %d: type and value are required", i)
+			return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: errMsg})
+		}
+	}
+
+	falconClient, _, err := h.falconClientFunc(r.AccessToken, h.logger)
+	if err != nil {
+		errMsg := fmt.Sprintf("error creating Falcon client: %v", err)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: errMsg})
+	}
+
+	exists, extRecord, err := storage.CheckExternalEntityExists(ctx, falconClient.CustomStorage, h.logger, r.Body.EntityID, ExternalSystemIDServiceNowSIRIncident)
+	if err != nil {
+		errMsg := fmt.Sprintf("failed to check if ticket exists: %v", err)
+		return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: errMsg})
+	}
+
+	if !exists {
+		errMsg := fmt.Sprintf("no %s ticket is mapped to entity %s", ExternalSystemIDServiceNowSIRIncident, r.Body.EntityID)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusNotFound, Message: errMsg})
+	}
+
+	configID := r.Body.ConfigID
+	incidentSysID := extRecord.ExternalEntityID
+
+	types, err := h.fetchSIRObservableTypes(ctx, falconClient, configID)
+	if err != nil {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: err.Error()})
+	}
+
+	linkedRecords, err := h.executeServiceNowListCommand(ctx, falconClient, configID, pluginOpIDServiceNowGetIncidentObservables, &models.DomainRequest{
+		Params: &models.DomainParams{
+			Query: map[string]string{"sysparm_query": "task=" + incidentSysID},
+		},
+	})
+	if err != nil {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: err.Error()})
+	}
+
+	// Linked observables are compared by sys_id, which does not depend on the dot-walked
+	// observable fields being returned or matching the submitted value exactly
+	linked := make(map[string]bool, len(linkedRecords))
+	for _, record := range linkedRecords {
+		observableID, _ := record["observable"].(string)
+		if ref, ok := record["observable"].(map[string]interface{}); ok {
+			observableID, _ = ref["value"].(string)
+		}
+		if observableID != "" {
+			linked[observableID] = true
+		}
+	}
+
+	results := make([]SIRObservableResult, 0, len(r.Body.Observables))
+	for _, observable := range r.Body.Observables {
+		observable.Value = strings.TrimSpace(observable.Value)
+		result := SIRObservableResult{Type: observable.Type, Value: observable.Value}
+
+		observableType, ok := resolveSIRObservableType(observable.Type, types)
+		if !ok {
+			result.Status = SIRObservableStatusFailed
+			result.Error = fmt.Sprintf("no sn_ti_observable_type matches type %q", observable.Type)
+			results = append(results, result)
+			continue
+		}
+
+		observableID, created, err := h.findOrCreateSIRObservable(ctx, falconClient, configID, observableType, observable)
+		if err != nil {
+			h.logger.Error("failed to create SIR observable", "type", observable.Type, "error", err)
+			result.Status = SIRObservableStatusFailed
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+		result.ObservableID = observableID
+		result.Created = created
+
+		if linked[observableID] {
+			result.Status = SIRObservableStatusAlreadyLinked
+			results = append(results, result)
+			continue
+		}
+
+		linkPayload := map[string]interface{}{
+			"task":       incidentSysID,
+			"observable": observableID,
+		}
+		if r.Body.Context != "" {
+			linkPayload["context"] = r.Body.Context
+		}
+
+		if _, err := h.executeServiceNowRecordCommand(ctx, falconClient, configID, pluginOpIDServiceNowLinkSIRObservable, &models.DomainRequest{
+			JSON: linkPayload,
+		}); err != nil {
+			h.logger.Error("failed to link SIR observable", "observable_id", observableID, "error", err)
+			result.Status = SIRObservableStatusFailed
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+
+		linked[observableID] = true
+		result.Status = SIRObservableStatusLinked
+		results = append(results, result)
+	}
+
+	return fdk.Response{
+		Code: http.StatusOK,
+		Body: fdk.JSON(AddSIRObservablesResponse{
+			TicketID: incidentSysID,
+			Results:  results,
+		}),
+	}
+}
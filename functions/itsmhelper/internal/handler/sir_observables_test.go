@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+	"github.com/crowdstrike/gofalcon/falcon/client"
+	"github.com/crowdstrike/gofalcon/falcon/client/api_integrations"
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+	"github.com/go-openapi/runtime"
+)
+
+// TestHandleAddSIRObservables tests the Handler.HandleAddSIRObservables method
+func (s *HandlerTestSuite) TestHandleAddSIRObservables() {
+	s.mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+		expectedKey, _ := storage.CreateTrackedEntityKey(ExternalSystemIDServiceNowSIRIncident, "entity123")
+		s.Equal(expectedKey, params.ObjectKey)
+		json.NewEncoder(writer).Encode(storage.ExternalEntityRecord{
+			InternalEntityID: "entity123",
+			ExternalEntityID: "sir123",
+			ExternalSystemID: ExternalSystemIDServiceNowSIRIncident,
+		})
+		return &custom_storage.GetObjectOK{}, nil
+	}
+
+	var created, links []map[string]interface{}
+	s.mockAPIIntegrations.ExecuteCommandFunc = func(params *api_integrations.ExecuteCommandParams, opts ...api_integrations.ClientOption) (*api_integrations.ExecuteCommandOK, error) {
+		resource := params.Body.Resources[0]
+
+		var body map[string]interface{}
+		switch *resource.OperationID {
+		case pluginOpIDServiceNowGetSIRObservableTypes:
+			body = map[string]interface{}{"result": []interface{}{
+				map[string]interface{}{"sys_id": "type-md5", "name": "MD5 hash", "value": "MD5"},
+				map[string]interface{}{"sys_id": "type-ipv4", "name": "IPv4 address", "value": "IPV4-ADDR"},
+				map[string]interface{}{"sys_id": "type-domain", "name": "Domain name", "value": "DOMAIN-NAME"},
+			}}
+		case pluginOpIDServiceNowGetIncidentObservables:
+			s.Equal(map[string]string{"sysparm_query": "task=sir123"}, resource.Request.Params.Query)
+			body = map[string]interface{}{"result": []interface{}{
+				map[string]interface{}{
+					"sys_id":     "link-1",
+					"observable": map[string]interface{}{"value": "obs-ip"},
+				},
+			}}
+		case pluginOpIDServiceNowGetSIRObservables:
+			query := resource.Request.Params.Query.(map[string]string)["sysparm_query"]
+			switch query {
+			case "value=44d88612fea8a8f36de82e1278abb02f^type=type-md5":
+				body = map[string]interface{}{"result": []interface{}{
+					map[string]interface{}{"sys_id": "obs-md5"},
+				}}
+			case "value=10.0.0.1^type=type-ipv4":
+				body = map[string]interface{}{"result": []interface{}{
+					map[string]interface{}{"sys_id": "obs-ip"},
+				}}
+			default:
+				s.Equal("value=evil.example.com^type=type-domain", query)
+				body = map[string]interface{}{"result": []interface{}{}}
+			}
+		case pluginOpIDServiceNowCreateSIRObservable:
+			payload := resource.Request.JSON.(map[string]interface{})
+			created = append(created, payload)
+			body = map[string]interface{}{"result": map[string]interface{}{"sys_id": "obs-domain"}}
+		case pluginOpIDServiceNowLinkSIRObservable:
+			payload := resource.Request.JSON.(map[string]interface{})
+			links = append(links, payload)
+			body = map[string]interface{}{"result": map[string]interface{}{"sys_id": fmt.Sprintf("link-%d", len(links)+1)}}
+		default:
+			s.Failf("unexpected operation", "operation %s", *resource.OperationID)
+		}
+
+		return &api_integrations.ExecuteCommandOK{
+			Payload: &models.DomainExecuteCommandResultsV1{
+				Resources: []*models.DomainExecuteCommandResultV1{{ResponseBody: body}},
+			},
+		}, nil
+	}
+
+	handler := &Handler{
+		logger: s.logger,
+		falconClientFunc: func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+			mockClient := &client.CrowdStrikeAPISpecification{}
+			mockClient.CustomStorage = s.mockStorage
+			mockClient.APIIntegrations = s.mockAPIIntegrations
+			return mockClient, "us-1", nil
+		},
+	}
+
+	response := handler.HandleAddSIRObservables(context.Background(), fdk.RequestOf[AddSIRObservablesRequest]{
+		Body: AddSIRObservablesRequest{
+			ConfigID: "config123",
+			EntityID: "entity123",
+			Context:  "Seen in Falcon detection",
+			Observables: []SIRObservable{
+				{Type: "md5", Value: "44d88612fea8a8f36de82e1278abb02f"},
+				{Type: "ipv4", Value: "10.0.0.1"},
+				{Type: "domain", Value: " evil.example.com ", Notes: "C2 domain"},
+				{Type: "registry_key", Value: "HKLM\\Run"},
+			},
+		},
+		AccessToken: "test-token",
+	}, fdk.WorkflowCtx{})
+	s.Equal(200, response.Code)
+
+	jsonBytes, err := json.Marshal(response.Body)
+	s.Require().NoError(err)
+
+	var actual AddSIRObservablesResponse
+	s.Require().NoError(json.Unmarshal(jsonBytes, &actual))
+
+	s.Equal("sir123", actual.TicketID)
+	s.Equal([]SIRObservableResult{
+		{Type: "md5", Value: "44d88612fea8a8f36de82e1278abb02f", Status: SIRObservableStatusLinked, ObservableID: "obs-md5"},
+		{Type: "ipv4", Value: "10.0.0.1", Status: SIRObservableStatusAlreadyLinked, ObservableID: "obs-ip"},
+		{Type: "domain", Value: "evil.example.com", Status: SIRObservableStatusLinked, Created: true, ObservableID: "obs-domain"},
+		{Type: "registry_key", Value: "HKLM\\Run", Status: SIRObservableStatusFailed, Error: `no sn_ti_observable_type matches type "registry_key"`},
+	}, actual.Results)
+
+	s.Equal([]map[string]interface{}{
+		{"type": "type-domain", "value": "evil.example.com", "notes": "C2 domain"},
+	}, created, "only the missing observable should be created")
+	s.Equal([]map[string]interface{}{
+		{"task": "sir123", "observable": "obs-md5", "context": "Seen in Falcon detection"},
+		{"task": "sir123", "observable": "obs-domain", "context": "Seen in Falcon detection"},
+	}, links, "already linked observables should be skipped")
+}
+
+// TestHandleAddSIRObservablesErrors tests the Handler.HandleAddSIRObservables method error paths
+func (s *HandlerTestSuite) TestHandleAddSIRObservablesErrors() {
+	tests := []struct {
+		name       string
+		request    AddSIRObservablesRequest
+		wantErrors []fdk.APIError
+	}{
+		{
+			name:    "No observables",
+			request: AddSIRObservablesRequest{ConfigID: "config123", EntityID: "entity123"},
+			wantErrors: []fdk.APIError{
+				{Code: 400, Message: "at least one observable is required"},
+			},
+		},
+		{
+			name: "Observable without value",
+			request: AddSIRObservablesRequest{
+				ConfigID:    "config123",
+				EntityID:    "entity123",
+				Observables: []SIRObservable{{Type: "md5"}},
+			},
+			wantErrors: []fdk.APIError{
+				{Code: 400, Message: "observable 0: type and value are required"},
+			},
+		},
+		{
+			name: "No SIR incident mapped to entity",
+			request: AddSIRObservablesRequest{
+				ConfigID:    "config123",
+				EntityID:    "entity123",
+				Observables: []SIRObservable{{Type: "md5", Value: "abc"}},
+			},
+			wantErrors: []fdk.APIError{
+				{Code: 404, Message: "no servicenow_sir_incident ticket is mapped to entity entity123"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+
+			s.mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+				return nil, runtime.NewAPIError("GetObject", nil, 404)
+			}
+
+			handler := &Handler{
+				logger: s.logger,
+				falconClientFunc: func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+					mockClient := &client.CrowdStrikeAPISpecification{}
+					mockClient.CustomStorage = s.mockStorage
+					mockClient.APIIntegrations = s.mockAPIIntegrations
+					return mockClient, "us-1", nil
+				},
+			}
+
+			response := handler.HandleAddSIRObservables(context.Background(), fdk.RequestOf[AddSIRObservablesRequest]{
+				Body:        tc.request,
+				AccessToken: "test-token",
+			}, fdk.WorkflowCtx{})
+
+			s.Nil(response.Body, "Response body should be nil for error responses")
+			s.Equal(tc.wantErrors[0].Code, response.Code, "Response code should match expected value")
+			s.Len(response.Errors, len(tc.wantErrors), "Response should have the expected number of errors")
+			for i, wantErr := range tc.wantErrors {
+				s.Equal(wantErr.Code, response.Errors[i].Code, "Error code should match expected value")
+				s.Equal(wantErr.Message, response.Errors[i].Message, "Error message should match expected value")
+			}
+		})
+	}
+}
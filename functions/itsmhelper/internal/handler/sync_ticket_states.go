@@ -0,0 +1,244 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+	"github.com/crowdstrike/gofalcon/falcon/client"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+)
+
+// Defaults and limits for a ticket state sync run
+const (
+	DefaultSyncMaxScan   = 500
+	DefaultSyncBatchSize = 50
+	// MaxSyncBatchSize bounds the number of sys_ids in a single ServiceNow query
+	MaxSyncBatchSize = 100
+)
+
+// errTicketRemapped is returned from a mapping update when the entity was mapped to another ticket meanwhile
+var errTicketRemapped = errors.New("entity was mapped to another ticket")
+
+// SyncTicketStatesRequest represents the request body for syncing the state of mapped tickets from ServiceNow
+type SyncTicketStatesRequest struct {
+	ConfigID string `json:"config_id"`
+	// ExternalSystemID restricts the sync to mappings of one external system; empty for all
+	ExternalSystemID string `json:"external_system_id,omitempty"`
+	Cursor           string `json:"cursor,omitempty"`
+	MaxScan          int    `json:"max_scan,omitempty"`
+	BatchSize        int    `json:"batch_size,omitempty"`
+}
+
+// TicketStateChange is a mapped ticket whose state changed in ServiceNow since it was last synced
+type TicketStateChange struct {
+	InternalEntityID   string `json:"internal_entity_id"`
+	InternalEntityType string `json:"internal_entity_type,omitempty"`
+	ExternalEntityID   string `json:"external_entity_id"`
+	ExternalSystemID   string `json:"external_system_id"`
+	PreviousStatus     string `json:"previous_status"`
+	Status             string `json:"status"`
+	UpdatedAt          int64  `json:"updated_at"`
+}
+
+// SyncTicketStatesResponse represents the response body for syncing the state of mapped tickets from ServiceNow
+type SyncTicketStatesResponse struct {
+	Scanned int `json:"scanned"`
+	// Synced is the number of mapped tickets that were found in ServiceNow
+	Synced int `json:"synced"`
+	// NotFound is the number of mapped tickets that no longer exist in ServiceNow
+	NotFound   int                 `json:"not_found"`
+	Changed    []TicketStateChange `json:"changed"`
+	NextCursor string              `json:"next_cursor"`
+	Completed  bool                `json:"completed"`
+	// Error is set when the run stopped early after changes were already stored; the run continues from NextCursor
+	Error string `json:"error,omitempty"`
+}
+
+// HandleSyncTicketStates handles the /sync_ticket_states endpoint. It pages through the tracked entities,
+// looks up their tickets in ServiceNow in batches and stores the current state of each ticket. Tickets whose
+// state changed are returned, so a scheduled workflow can act on tickets resolved in ServiceNow.
+func (h *Handler) HandleSyncTicketStates(ctx context.Context, r fdk.RequestOf[SyncTicketStatesRequest], wrkCtx fdk.WorkflowCtx) fdk.Response {
+	ctx = withHandlerPath(ctx, "/sync_ticket_states")
+	h.logger.Info("Syncing ticket states", "trace_id", r.TraceID, "wrk_ctx", wrkCtx)
+
+	if r.Body.ConfigID == "" {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: "config_id is required"})
+	}
+	if r.Body.MaxScan < 0 || r.Body.BatchSize < 0 {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: "max_scan and batch_size must not be negative"})
+	}
+	if _, ok := serviceNowTicketOpsBySystem[r.Body.ExternalSystemID]; r.Body.ExternalSystemID != "" && !ok {
+		errMsg := fmt.Sprintf("unsupported external system ID: %s", r.Body.ExternalSystemID)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: errMsg})
+	}
+
+	maxScan := r.Body.MaxScan
+	if maxScan == 0 {
+		maxScan = DefaultSyncMaxScan
+	}
+	batchSize := r.Body.BatchSize
+	if batchSize == 0 {
+		batchSize = DefaultSyncBatchSize
+	}
+	batchSize = min(batchSize, MaxSyncBatchSize)
+
+	falconClient, _, err := h.falconClientFunc(r.AccessToken, h.logger)
+	if err != nil {
+		errMsg := fmt.Sprintf("error creating Falcon client: %v", err)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: errMsg})
+	}
+
+	resp := SyncTicketStatesResponse{Changed: []TicketStateChange{}}
+	cursor := r.Body.Cursor
+	for resp.Scanned < maxScan {
+		page, err := storage.ScanTrackedEntities(ctx, falconClient.CustomStorage, h.logger, cursor, min(batchSize, maxScan-resp.Scanned))
+		if err == nil {
+			err = h.syncTicketBatch(ctx, falconClient, r.Body.ConfigID, r.Body.ExternalSystemID, page.Records, &resp)
+		}
+		if err != nil {
+			h.logger.Error("ticket state sync failed", "error", err, "scanned", resp.Scanned, "changed", len(resp.Changed))
+
+			// Changes already stored would not be reported by the next run, so they are returned with the error
+			if len(resp.Changed) == 0 {
+				return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: err.Error()})
+			}
+			resp.NextCursor = cursor
+			resp.Error = err.Error()
+			return fdk.Response{Code: http.StatusOK, Body: fdk.JSON(resp)}
+		}
+
+		resp.Scanned += page.Scanned
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+
+	resp.NextCursor = cursor
+	resp.Completed = cursor == ""
+	h.logger.Info("Ticket state sync finished", "scanned", resp.Scanned, "synced", resp.Synced, "changed", len(resp.Changed), "next_cursor", cursor)
+
+	return fdk.Response{
+		Code: http.StatusOK,
+		Body: fdk.JSON(resp),
+	}
+}
+
+// syncTicketBatch looks up the tickets of a batch of mappings in ServiceNow, one query per external system,
+// and stores the state of the tickets whose state changed
+func (h *Handler) syncTicketBatch(
+	ctx context.Context,
+	falconClient *client.CrowdStrikeAPISpecification,
+	configID string,
+	externalSystemID string,
+	records []storage.ExternalEntityRecord,
+	resp *SyncTicketStatesResponse,
+) error {
+	recordsBySystem := make(map[string][]storage.ExternalEntityRecord)
+	var systems []string
+	for _, record := range records {
+		if externalSystemID != "" && record.ExternalSystemID != externalSystemID {
+			continue
+		}
+		if _, ok := serviceNowTicketOpsBySystem[record.ExternalSystemID]; !ok {
+			continue
+		}
+		// Commas and carets would break out of the sys_idIN query
+		if strings.ContainsAny(record.ExternalEntityID, ",^") {
+			h.logger.Warn("skipping mapping with invalid ticket ID", "internal_id", record.InternalEntityID, "ticket_id", record.ExternalEntityID)
+			continue
+		}
+		if _, ok := recordsBySystem[record.ExternalSystemID]; !ok {
+			systems = append(systems, record.ExternalSystemID)
+		}
+		recordsBySystem[record.ExternalSystemID] = append(recordsBySystem[record.ExternalSystemID], record)
+	}
+
+	for _, system := range systems {
+		systemRecords := recordsBySystem[system]
+		sysIDs := make([]string, 0, len(systemRecords))
+		for _, record := range systemRecords {
+			sysIDs = append(sysIDs, record.ExternalEntityID)
+		}
+
+		tickets, err := h.executeServiceNowListCommand(ctx, falconClient, configID, serviceNowTicketOpsBySystem[system].GetOpID, &models.DomainRequest{
+			Params: &models.DomainParams{
+				Query: map[string]string{"sysparm_query": "sys_idIN" + strings.Join(sysIDs, ",")},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to query %s tickets: %w", system, err)
+		}
+
+		ticketsByID := make(map[string]map[string]interface{}, len(tickets))
+		for _, ticket := range tickets {
+			if sysID, _ := ticket["sys_id"].(string); sysID != "" {
+				ticketsByID[sysID] = ticket
+			}
+		}
+
+		for _, record := range systemRecords {
+			ticket, ok := ticketsByID[record.ExternalEntityID]
+			if !ok {
+				resp.NotFound++
+				continue
+			}
+			resp.Synced++
+
+			state, _ := ticket["state"].(string)
+			if state == "" || state == record.ExternalLastKnownStatus {
+				continue
+			}
+
+			change, err := h.storeTicketState(ctx, falconClient, record, state, parseServiceNowTime(ticket["sys_updated_on"]))
+			if err != nil {
+				// The mapping is synced again by the next run
+				h.logger.Warn("failed to store ticket state", "internal_id", record.InternalEntityID, "ticket_id", record.ExternalEntityID, "error", err)
+				continue
+			}
+			if change != nil {
+				resp.Changed = append(resp.Changed, *change)
+			}
+		}
+	}
+
+	return nil
+}
+
+// storeTicketState stores the state of the ticket of a mapping, returning nil when the state was stored meanwhile
+func (h *Handler) storeTicketState(ctx context.Context, falconClient *client.CrowdStrikeAPISpecification, record storage.ExternalEntityRecord, state string, updateTime int64) (*TicketStateChange, error) {
+	var previousStatus string
+	_, err := h.updateEntityMapping(ctx, falconClient, &record, func(current *storage.ExternalEntityRecord) error {
+		if current.ExternalEntityID != record.ExternalEntityID {
+			return errTicketRemapped
+		}
+		previousStatus = current.ExternalLastKnownStatus
+		current.ExternalLastKnownStatus = state
+		current.ExternalLastUpdateTime = updateTime
+		return nil
+	})
+	if errors.Is(err, errTicketRemapped) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if previousStatus == state {
+		return nil, nil
+	}
+
+	return &TicketStateChange{
+		InternalEntityID:   record.InternalEntityID,
+		InternalEntityType: record.InternalEntityType,
+		ExternalEntityID:   record.ExternalEntityID,
+		ExternalSystemID:   record.ExternalSystemID,
+		PreviousStatus:     previousStatus,
+		Status:             state,
+		UpdatedAt:          updateTime,
+	}, nil
+}
@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+	"github.com/crowdstrike/gofalcon/falcon/client"
+	"github.com/crowdstrike/gofalcon/falcon/client/api_integrations"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+)
+
+// TestHandleSyncTicketStates tests the Handler.HandleSyncTicketStates method
+func (s *HandlerTestSuite) TestHandleSyncTicketStates() {
+	memStorage := storage.NewMemoryStorageService()
+	for _, record := range []storage.ExternalEntityRecord{
+		{InternalEntityID: "alert1", InternalEntityType: "alert", ExternalEntityID: "sys1", ExternalSystemID: ExternalSystemIDServiceNowIncident, ExternalLastKnownStatus: "1"},
+		{InternalEntityID: "alert2", ExternalEntityID: "sys2", ExternalSystemID: ExternalSystemIDServiceNowIncident, ExternalLastKnownStatus: "2"},
+		{InternalEntityID: "alert3", ExternalEntityID: "sys3", ExternalSystemID: ExternalSystemIDServiceNowIncident},
+		{InternalEntityID: "alert4", ExternalEntityID: "sir4", ExternalSystemID: ExternalSystemIDServiceNowSIRIncident, ExternalLastKnownStatus: "10"},
+	} {
+		s.Require().NoError(storage.CreateOrUpdateExternalEntityMapping(context.Background(), memStorage, s.logger, record))
+	}
+
+	// sys3 was deleted in ServiceNow
+	tickets := map[string]map[string]interface{}{
+		"sys1": {"sys_id": "sys1", "state": "6", "sys_updated_on": "2025-04-28 14:45:22"},
+		"sys2": {"sys_id": "sys2", "state": "2", "sys_updated_on": "2025-04-28 10:00:00"},
+		"sir4": {"sys_id": "sir4", "state": "100", "sys_updated_on": "2025-04-28 15:00:00"},
+	}
+	var queries []string
+	var failOpID string
+	s.mockAPIIntegrations.ExecuteCommandFunc = func(params *api_integrations.ExecuteCommandParams, opts ...api_integrations.ClientOption) (*api_integrations.ExecuteCommandOK, error) {
+		resource := params.Body.Resources[0]
+		query := resource.Request.Params.Query.(map[string]string)["sysparm_query"]
+		queries = append(queries, *resource.OperationID+" "+query)
+		if *resource.OperationID == failOpID {
+			return nil, fmt.Errorf("connection reset")
+		}
+
+		var result []interface{}
+		for _, sysID := range strings.Split(strings.TrimPrefix(query, "sys_idIN"), ",") {
+			if ticket, ok := tickets[sysID]; ok {
+				result = append(result, ticket)
+			}
+		}
+		return &api_integrations.ExecuteCommandOK{
+			Payload: &models.DomainExecuteCommandResultsV1{
+				Resources: []*models.DomainExecuteCommandResultV1{{
+					ResponseBody: map[string]interface{}{"result": result},
+				}},
+			},
+		}, nil
+	}
+
+	handler := &Handler{
+		logger: s.logger,
+		falconClientFunc: func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+			mockClient := &client.CrowdStrikeAPISpecification{}
+			mockClient.CustomStorage = memStorage
+			mockClient.APIIntegrations = s.mockAPIIntegrations
+			return mockClient, "us-1", nil
+		},
+	}
+	sync := func(request SyncTicketStatesRequest) (fdk.Response, SyncTicketStatesResponse) {
+		response := handler.HandleSyncTicketStates(context.Background(), fdk.RequestOf[SyncTicketStatesRequest]{
+			Body:        request,
+			AccessToken: "test-token",
+		}, fdk.WorkflowCtx{})
+
+		var body SyncTicketStatesResponse
+		if response.Body != nil {
+			jsonBytes, err := json.Marshal(response.Body)
+			s.Require().NoError(err)
+			s.Require().NoError(json.Unmarshal(jsonBytes, &body))
+		}
+		return response, body
+	}
+
+	response, body := sync(SyncTicketStatesRequest{ConfigID: "config123"})
+	s.Require().Equal(200, response.Code)
+	s.Equal(SyncTicketStatesResponse{
+		Scanned:  4,
+		Synced:   3,
+		NotFound: 1,
+		Changed: []TicketStateChange{
+			{InternalEntityID: "alert1", InternalEntityType: "alert", ExternalEntityID: "sys1", ExternalSystemID: ExternalSystemIDServiceNowIncident, PreviousStatus: "1", Status: "6", UpdatedAt: 1745851522},
+			{InternalEntityID: "alert4", ExternalEntityID: "sir4", ExternalSystemID: ExternalSystemIDServiceNowSIRIncident, PreviousStatus: "10", Status: "100", UpdatedAt: 1745852400},
+		},
+		Completed: true,
+	}, body)
+	s.Equal([]string{
+		pluginOpIDServiceNowGetIncident + " sys_idINsys1,sys2,sys3",
+		pluginOpIDServiceNowGetSIRIncident + " sys_idINsir4",
+	}, queries)
+
+	exists, record, err := storage.CheckExternalEntityExists(context.Background(), memStorage, s.logger, "alert1", ExternalSystemIDServiceNowIncident)
+	s.Require().NoError(err)
+	s.Require().True(exists)
+	s.Equal("6", record.ExternalLastKnownStatus)
+	s.Equal(int64(1745851522), record.ExternalLastUpdateTime)
+
+	// A second run finds no changes, and runs are bounded and continue from the cursor
+	queries = nil
+	response, body = sync(SyncTicketStatesRequest{ConfigID: "config123", MaxScan: 2, BatchSize: 2})
+	s.Require().Equal(200, response.Code)
+	s.Empty(body.Changed)
+	s.Equal(2, body.Scanned)
+	s.False(body.Completed)
+	s.NotEmpty(body.NextCursor)
+
+	response, body = sync(SyncTicketStatesRequest{ConfigID: "config123", Cursor: body.NextCursor, ExternalSystemID: ExternalSystemIDServiceNowSIRIncident})
+	s.Require().Equal(200, response.Code)
+	s.Empty(body.Changed)
+	s.Equal(2, body.Scanned)
+	s.True(body.Completed)
+	s.Equal([]string{pluginOpIDServiceNowGetIncident + " sys_idINsys1,sys2", pluginOpIDServiceNowGetSIRIncident + " sys_idINsir4"}, queries)
+
+	// A failed query stops the run; changes stored before it are returned with the error
+	tickets["sys2"]["state"] = "6"
+	failOpID = pluginOpIDServiceNowGetIncident
+	response, _ = sync(SyncTicketStatesRequest{ConfigID: "config123"})
+	s.Equal(500, response.Code)
+	s.Require().Len(response.Errors, 1)
+	s.Contains(response.Errors[0].Message, "failed to query servicenow_incident tickets")
+
+	failOpID = pluginOpIDServiceNowGetSIRIncident
+	tickets["sir4"]["state"] = "200"
+	response, body = sync(SyncTicketStatesRequest{ConfigID: "config123"})
+	s.Require().Equal(200, response.Code)
+	s.Require().Len(body.Changed, 1)
+	s.Equal("alert2", body.Changed[0].InternalEntityID)
+	s.Contains(body.Error, "failed to query servicenow_sir_incident tickets")
+	s.Equal("", body.NextCursor)
+	s.False(body.Completed)
+}
+
+// TestHandleSyncTicketStatesValidation tests the request validation of Handler.HandleSyncTicketStates
+func (s *HandlerTestSuite) TestHandleSyncTicketStatesValidation() {
+	tests := []struct {
+		name      string
+		request   SyncTicketStatesRequest
+		wantError string
+	}{
+		{name: "Missing config", request: SyncTicketStatesRequest{}, wantError: "config_id is required"},
+		{name: "Negative batch size", request: SyncTicketStatesRequest{ConfigID: "config123", BatchSize: -1}, wantError: "max_scan and batch_size must not be negative"},
+		{name: "Unsupported system", request: SyncTicketStatesRequest{ConfigID: "config123", ExternalSystemID: "jira"}, wantError: "unsupported external system ID: jira"},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			handler := &Handler{logger: s.logger}
+			response := handler.HandleSyncTicketStates(context.Background(), fdk.RequestOf[SyncTicketStatesRequest]{Body: tc.request}, fdk.WorkflowCtx{})
+			s.Equal(400, response.Code)
+			s.Require().Len(response.Errors, 1)
+			s.Equal(tc.wantError, response.Errors[0].Message)
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package handler
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// maxRenderedFieldBytes caps the output of a single template so a runaway range over the
+// context cannot produce an oversized ServiceNow request
+const maxRenderedFieldBytes = 64 * 1024
+
+// codeTagPattern matches ServiceNow [code] and [/code] journal markers, which render their
+// content as raw HTML
+var codeTagPattern = regexp.MustCompile(`(?i)\[(/?)code\]`)
+
+// templateFuncs are the helper functions available to incident templates. They only format
+// values from the request context and have no access to the environment.
+var templateFuncs = template.FuncMap{
+	"truncate":   truncateTemplateValue,
+	"join":       joinTemplateValues,
+	"default":    defaultTemplateValue,
+	"snescape":   escapeServiceNowCode,
+	"sncode":     serviceNowCodeBlock,
+	"formatTime": formatTemplateTime,
+}
+
+// renderIncidentTemplates renders short_description, description, work_notes and the string values of
+// the custom fields as Go text/template strings against the request context.
+// Requests without a context are left untouched, so existing workflows that pre-render their text keep working.
+func renderIncidentTemplates(body *CreateIncidentRequest, customFields map[string]interface{}) error {
+	if body.Context == nil {
+		return nil
+	}
+
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"short_description", &body.ShortDescription},
+		{"description", &body.Description},
+		{"work_notes", &body.WorkNotes},
+	}
+	for _, field := range fields {
+		rendered, err := renderTemplate(field.name, *field.value, body.Context)
+		if err != nil {
+			return err
+		}
+		*field.value = rendered
+	}
+
+	keys := make([]string, 0, len(customFields))
+	for key := range customFields {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		value, ok := customFields[key].(string)
+		if !ok {
+			continue
+		}
+		rendered, err := renderTemplate("custom_fields."+key, value, body.Context)
+		if err != nil {
+			return err
+		}
+		customFields[key] = rendered
+	}
+
+	return nil
+}
+
+// renderTemplate renders a single template, naming the field in any error
+func renderTemplate(field, text string, data map[string]interface{}) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	// A key missing from the context is an error rather than "<no value>" in the ticket.
+	// Optional keys can be read with index, e.g. {{ index .alert "host" | default "unknown" }}.
+	tmpl, err := template.New(field).Option("missingkey=error").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid template in %s: %v", field, err)
+	}
+
+	var out limitedBuilder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("error rendering template in %s: %v", field, err)
+	}
+
+	return out.String(), nil
+}
+
+// limitedBuilder is a strings.Builder that fails once maxRenderedFieldBytes is exceeded
+type limitedBuilder struct {
+	strings.Builder
+}
+
+func (b *limitedBuilder) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > maxRenderedFieldBytes {
+		return 0, fmt.Errorf("rendered text exceeds %d bytes", maxRenderedFieldBytes)
+	}
+	return b.Builder.Write(p)
+}
+
+// templateString formats a context value for use in a template, treating missing values as empty
+func templateString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// truncateTemplateValue shortens a value to at most n characters, e.g. {{ .alert.name | truncate 80 }}
+func truncateTemplateValue(n int, value interface{}) string {
+	s := templateString(value)
+	if n < 0 || utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// joinTemplateValues joins the elements of a list with a separator, e.g. {{ .alert.tactics | join ", " }}
+func joinTemplateValues(sep string, value interface{}) string {
+	switch v := value.(type) {
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = templateString(item)
+		}
+		return strings.Join(parts, sep)
+	case []string:
+		return strings.Join(v, sep)
+	default:
+		return templateString(value)
+	}
+}
+
+// defaultTemplateValue returns def when value is missing or empty, e.g. {{ index .alert "host" | default "unknown" }}
+func defaultTemplateValue(def interface{}, value interface{}) interface{} {
+	if templateString(value) == "" {
+		return def
+	}
+	return value
+}
+
+// escapeServiceNowCode neutralises [code] markers so context values cannot inject HTML into journal fields
+func escapeServiceNowCode(value interface{}) string {
+	return codeTagPattern.ReplaceAllString(templateString(value), "[$1 code]")
+}
+
+// serviceNowCodeBlock wraps a value in a [code] block as preformatted, HTML-escaped text
+func serviceNowCodeBlock(value interface{}) string {
+	return "[code]<pre>" + html.EscapeString(templateString(value)) + "</pre>[/code]"
+}
+
+// formatTemplateTime formats a timestamp using a Go time layout, e.g. {{ .alert.created | formatTime "2006-01-02 15:04:05" }}.
+// Timestamps may be RFC 3339 strings or Unix times in seconds or milliseconds. The result is in UTC.
+func formatTemplateTime(layout string, value interface{}) (string, error) {
+	var t time.Time
+	switch v := value.(type) {
+	case time.Time:
+		t = v
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return "", fmt.Errorf("formatTime: %q is not an RFC 3339 timestamp", v)
+		}
+		t = parsed
+	case float64:
+		t = unixTime(v)
+	case int64:
+		t = unixTime(float64(v))
+	case int:
+		t = unixTime(float64(v))
+	default:
+		return "", fmt.Errorf("formatTime: unsupported timestamp %v", value)
+	}
+
+	return t.UTC().Format(layout), nil
+}
+
+// unixTime converts a Unix timestamp to a time, treating values beyond the year 5138 in seconds as milliseconds
+func unixTime(ts float64) time.Time {
+	if math.Abs(ts) >= 1e11 {
+		return time.UnixMilli(int64(ts))
+	}
+	sec, frac := math.Modf(ts)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
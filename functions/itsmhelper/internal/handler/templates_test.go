@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"strings"
+)
+
+// TestRenderTemplate tests the template helpers available to incident templates
+func (s *HandlerTestSuite) TestRenderTemplate() {
+	data := map[string]interface{}{
+		"alert": map[string]interface{}{
+			"name":     "Malicious PowerShell execution",
+			"severity": float64(70),
+			"tactics":  []interface{}{"Execution", "Persistence"},
+			"cmdline":  "powershell -enc [code]<script>alert(1)</script>[/code]",
+			"created":  "2024-05-01T12:30:00Z",
+			"epoch":    float64(1714566600),
+			"epoch_ms": float64(1714566600000),
+			"host":     "",
+		},
+	}
+
+	tests := []struct {
+		name    string
+		text    string
+		want    string
+		wantErr string
+	}{
+		{name: "Plain text", text: "No template here", want: "No template here"},
+		{name: "Field access", text: "{{ .alert.name }} ({{ .alert.severity }})", want: "Malicious PowerShell execution (70)"},
+		{name: "Truncate", text: "{{ .alert.name | truncate 9 }}", want: "Malicious"},
+		{name: "Join", text: `{{ .alert.tactics | join ", " }}`, want: "Execution, Persistence"},
+		{name: "Default for empty value", text: `{{ .alert.host | default "unknown" }}`, want: "unknown"},
+		{name: "Default for missing key", text: `{{ index .alert "user" | default "n/a" }}`, want: "n/a"},
+		{name: "ServiceNow code escaping", text: "{{ .alert.cmdline | snescape }}", want: "powershell -enc [ code]<script>alert(1)</script>[/ code]"},
+		{name: "ServiceNow code block", text: "{{ .alert.name | sncode }}", want: "[code]<pre>Malicious PowerShell execution</pre>[/code]"},
+		{name: "Format RFC 3339 time", text: `{{ .alert.created | formatTime "2006-01-02 15:04" }}`, want: "2024-05-01 12:30"},
+		{name: "Format Unix seconds", text: `{{ .alert.epoch | formatTime "2006-01-02 15:04" }}`, want: "2024-05-01 12:30"},
+		{name: "Format Unix milliseconds", text: `{{ .alert.epoch_ms | formatTime "2006-01-02 15:04" }}`, want: "2024-05-01 12:30"},
+		{name: "Invalid time", text: `{{ .alert.name | formatTime "2006" }}`, wantErr: "error rendering template in work_notes"},
+		{name: "Missing key", text: "{{ .alert.user }}", wantErr: `error rendering template in work_notes: template: work_notes:1:9: executing "work_notes" at <.alert.user>: map has no entry for key "user"`},
+		{name: "Syntax error", text: "{{ .alert.name ", wantErr: "invalid template in work_notes"},
+		{name: "Oversized output", text: strings.Repeat("{{ .alert.name }}", 3000), wantErr: "rendered text exceeds"},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			got, err := renderTemplate("work_notes", tc.text, data)
+			if tc.wantErr != "" {
+				s.ErrorContains(err, tc.wantErr)
+				return
+			}
+			s.NoError(err)
+			s.Equal(tc.want, got)
+		})
+	}
+}
+
+// TestBuildRequestPayloadTemplates tests that the request fields are rendered against the request context
+func (s *HandlerTestSuite) TestBuildRequestPayloadTemplates() {
+	body := CreateIncidentRequest{
+		ShortDescription: "{{ .alert.name }} on {{ .alert.hostname }}",
+		Description:      "Severity {{ .alert.severity }}",
+		WorkNotes:        "{{ .alert.cmdline | sncode }}",
+		Category:         "{{ not rendered }}",
+		CustomFields:     `{"u_hostname": "{{ .alert.hostname }}", "u_count": 3}`,
+		Context: map[string]interface{}{
+			"alert": map[string]interface{}{
+				"name":     "Credential dumping",
+				"hostname": "host1",
+				"severity": "High",
+				"cmdline":  "mimikatz.exe",
+			},
+		},
+	}
+
+	payload, err := buildRequestPayload(body)
+	s.Require().NoError(err)
+	s.Equal(map[string]interface{}{
+		"short_description": "Credential dumping on host1",
+		"description":       "Severity High",
+		"work_notes":        "[code]<pre>mimikatz.exe</pre>[/code]",
+		"category":          "{{ not rendered }}",
+		"u_hostname":        "host1",
+		"u_count":           float64(3),
+	}, payload)
+
+	// Without a context the fields are sent as they are
+	body.Context = nil
+	payload, err = buildRequestPayload(body)
+	s.Require().NoError(err)
+	s.Equal("{{ .alert.name }} on {{ .alert.hostname }}", payload["short_description"])
+
+	// Template errors name the field
+	body.Context = map[string]interface{}{"alert": map[string]interface{}{}}
+	body.ShortDescription = "static"
+	body.Description = ""
+	body.WorkNotes = ""
+	_, err = buildRequestPayload(body)
+	s.ErrorContains(err, "error rendering template in custom_fields.u_hostname")
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+)
+
+// serviceNowTimeLayout is the layout ServiceNow uses for glide_date_time values such as sys_updated_on (UTC)
+const serviceNowTimeLayout = "2006-01-02 15:04:05"
+
+// timeNow is a variable that can be replaced in tests
+var timeNow = time.Now
+
+// UpdateIncidentRequest represents the request body for updating the incident mapped to an entity.
+// It accepts the same field set as CreateIncidentRequest; empty fields are left untouched in ServiceNow.
+type UpdateIncidentRequest CreateIncidentRequest
+
+// UpdateIncidentResponse represents the response body for updating an incident
+type UpdateIncidentResponse struct {
+	TicketID                string `json:"ticket_id"`
+	TicketType              string `json:"ticket_type"`
+	ExternalLastKnownStatus string `json:"external_last_known_status"`
+	ExternalLastUpdateTime  int64  `json:"external_last_update_time"`
+}
+
+// parseServiceNowTime converts a ServiceNow glide_date_time string into a Unix timestamp,
+// falling back to the current time when the value is missing or malformed
+func parseServiceNowTime(value interface{}) int64 {
+	if str, ok := value.(string); ok && str != "" {
+		if t, err := time.ParseInLocation(serviceNowTimeLayout, str, time.UTC); err == nil {
+			return t.Unix()
+		}
+	}
+
+	return timeNow().UTC().Unix()
+}
+
+// updateIncident handles the common logic for updating both regular and SIR incidents
+func (h *Handler) updateIncident(
+	ctx context.Context,
+	r fdk.RequestOf[UpdateIncidentRequest],
+	wrkCtx fdk.WorkflowCtx,
+	operationID string,
+	ticketType string,
+	externalSystemID string,
+) fdk.Response {
+	h.logger.Info("Updating incident", "type", ticketType, "trace_id", r.TraceID, "wrk_ctx", wrkCtx)
+
+	// Only send the fields that were provided, so an update never blanks the short description
+	requestPayload, err := buildRequestPayload(CreateIncidentRequest(r.Body))
+	if err != nil {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: err.Error()})
+	}
+	if requestPayload["short_description"] == "" {
+		delete(requestPayload, "short_description")
+	}
+
+	falconClient, _, err := h.falconClientFunc(r.AccessToken, h.logger)
+	if err != nil {
+		errMsg := fmt.Sprintf("error creating Falcon client: %v", err)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: errMsg})
+	}
+
+	// Resolve the ticket mapped to the entity for the specific external system ID
+	exists, extRecord, err := storage.CheckExternalEntityExists(ctx, falconClient.CustomStorage, h.logger, r.Body.EntityID, externalSystemID)
+	if err != nil {
+		errMsg := fmt.Sprintf("failed to check if ticket exists: %v", err)
+		return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: errMsg})
+	}
+
+	if !exists {
+		errMsg := fmt.Sprintf("no %s ticket is mapped to entity %s", externalSystemID, r.Body.EntityID)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusNotFound, Message: errMsg})
+	}
+
+	result, err := h.executeServiceNowRecordCommand(ctx, falconClient, r.Body.ConfigID, operationID, &models.DomainRequest{
+		JSON: requestPayload,
+		Params: &models.DomainParams{
+			Path: map[string]string{"sys_id": extRecord.ExternalEntityID},
+		},
+	})
+	if err != nil {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: err.Error()})
+	}
+
+	status, _ := result["state"].(string)
+	if status == "" {
+		status = r.Body.State
+	}
+
+	updateTime := parseServiceNowTime(result["sys_updated_on"])
+
+	h.logger.Info("updated ticket in ITSM", "ticket_id", extRecord.ExternalEntityID, "ticket_type", ticketType, "status", status)
+
+	extRecord, err = h.updateEntityMapping(ctx, falconClient, extRecord, func(record *storage.ExternalEntityRecord) error {
+		record.ExternalLastKnownStatus = status
+		record.ExternalLastUpdateTime = updateTime
+		return nil
+	})
+	if err != nil {
+		return h.mappingErrResp(err)
+	}
+
+	return fdk.Response{
+		Code: http.StatusOK,
+		Body: fdk.JSON(UpdateIncidentResponse{
+			TicketID:                extRecord.ExternalEntityID,
+			TicketType:              ticketType,
+			ExternalLastKnownStatus: extRecord.ExternalLastKnownStatus,
+			ExternalLastUpdateTime:  extRecord.ExternalLastUpdateTime,
+		}),
+	}
+}
+
+// HandleUpdateIncident handles the /update_incident endpoint
+func (h *Handler) HandleUpdateIncident(ctx context.Context, r fdk.RequestOf[UpdateIncidentRequest], wrkCtx fdk.WorkflowCtx) fdk.Response {
+	return h.updateIncident(withHandlerPath(ctx, "/update_incident"), r, wrkCtx, pluginOpIDServiceNowUpdateIncident, "incident", ExternalSystemIDServiceNowIncident)
+}
+
+// HandleUpdateSIRIncident handles the /update_sir_incident endpoint
+func (h *Handler) HandleUpdateSIRIncident(ctx context.Context, r fdk.RequestOf[UpdateIncidentRequest], wrkCtx fdk.WorkflowCtx) fdk.Response {
+	return h.updateIncident(withHandlerPath(ctx, "/update_sir_incident"), r, wrkCtx, pluginOpIDServiceNowUpdateSIRIncident, "sn_si_incident", ExternalSystemIDServiceNowSIRIncident)
+}
@@ -0,0 +1,283 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"time"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+	"github.com/crowdstrike/gofalcon/falcon/client"
+	"github.com/crowdstrike/gofalcon/falcon/client/api_integrations"
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+	"github.com/go-openapi/runtime"
+)
+
+// TestHandleUpdateIncident tests the Handler.HandleUpdateIncident and Handler.HandleUpdateSIRIncident methods
+func (s *HandlerTestSuite) TestHandleUpdateIncident() {
+	tests := []struct {
+		name                     string
+		request                  UpdateIncidentRequest
+		handler                  func(h *Handler, req fdk.RequestOf[UpdateIncidentRequest]) fdk.Response
+		setupMockStore           func(mockStorage *storage.MockStorageService, stored *bytes.Buffer)
+		setupMockAPIIntegrations func(mockAPIIntegrations *MockAPIIntegrationsService)
+		wantCode                 int
+		wantBody                 map[string]interface{}
+		wantRecord               *storage.ExternalEntityRecord
+		wantErrors               []fdk.APIError
+	}{
+		{
+			name: "Successful incident update",
+			request: UpdateIncidentRequest{
+				ConfigID:  "config123",
+				EntityID:  "entity123",
+				State:     "2",
+				WorkNotes: "Containment started",
+			},
+			handler: func(h *Handler, req fdk.RequestOf[UpdateIncidentRequest]) fdk.Response {
+				return h.HandleUpdateIncident(context.Background(), req, fdk.WorkflowCtx{})
+			},
+			setupMockStore: func(mockStorage *storage.MockStorageService, stored *bytes.Buffer) {
+				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+					expectedKey, _ := storage.CreateTrackedEntityKey(ExternalSystemIDServiceNowIncident, "entity123")
+					s.Equal(expectedKey, params.ObjectKey)
+					json.NewEncoder(writer).Encode(storage.ExternalEntityRecord{
+						InternalEntityID: "entity123",
+						ExternalEntityID: "sys123",
+						ExternalSystemID: ExternalSystemIDServiceNowIncident,
+					})
+					return &custom_storage.GetObjectOK{}, nil
+				}
+				mockStorage.PutObjectFunc = func(params *custom_storage.PutObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.PutObjectOK, error) {
+					io.Copy(stored, params.Body)
+					return &custom_storage.PutObjectOK{}, nil
+				}
+			},
+			setupMockAPIIntegrations: func(mockAPIIntegrations *MockAPIIntegrationsService) {
+				mockAPIIntegrations.ExecuteCommandFunc = func(params *api_integrations.ExecuteCommandParams, opts ...api_integrations.ClientOption) (*api_integrations.ExecuteCommandOK, error) {
+					resource := params.Body.Resources[0]
+					s.Equal(pluginOpIDServiceNowUpdateIncident, *resource.OperationID)
+					s.Equal(map[string]string{"sys_id": "sys123"}, resource.Request.Params.Path)
+
+					requestJSON := resource.Request.JSON.(map[string]interface{})
+					s.NotContains(requestJSON, "short_description", "empty short description must not be sent on update")
+					s.Equal("2", requestJSON["state"])
+					s.Equal("Containment started", requestJSON["work_notes"])
+
+					return &api_integrations.ExecuteCommandOK{
+						Payload: &models.DomainExecuteCommandResultsV1{
+							Resources: []*models.DomainExecuteCommandResultV1{
+								{ResponseBody: map[string]interface{}{"result": map[string]interface{}{
+									"sys_id":         "sys123",
+									"number":         "INC0010005",
+									"state":          "2",
+									"sys_updated_on": "2025-04-28 14:45:22",
+								}}},
+							},
+						},
+					}, nil
+				}
+			},
+			wantCode: 200,
+			wantBody: map[string]interface{}{
+				"ticket_id":                  "sys123",
+				"ticket_type":                "incident",
+				"external_last_known_status": "2",
+				"external_last_update_time":  float64(time.Date(2025, 4, 28, 14, 45, 22, 0, time.UTC).Unix()),
+			},
+			wantRecord: &storage.ExternalEntityRecord{
+				InternalEntityID:        "entity123",
+				ExternalEntityID:        "sys123",
+				ExternalSystemID:        ExternalSystemIDServiceNowIncident,
+				ExternalLastKnownStatus: "2",
+				ExternalLastUpdateTime:  time.Date(2025, 4, 28, 14, 45, 22, 0, time.UTC).Unix(),
+				Revision:                1,
+			},
+		},
+		{
+			name: "Successful SIR incident update",
+			request: UpdateIncidentRequest{
+				ConfigID:         "config456",
+				EntityID:         "entity456",
+				ShortDescription: "Updated summary",
+			},
+			handler: func(h *Handler, req fdk.RequestOf[UpdateIncidentRequest]) fdk.Response {
+				return h.HandleUpdateSIRIncident(context.Background(), req, fdk.WorkflowCtx{})
+			},
+			setupMockStore: func(mockStorage *storage.MockStorageService, stored *bytes.Buffer) {
+				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+					json.NewEncoder(writer).Encode(storage.ExternalEntityRecord{
+						InternalEntityID: "entity456",
+						ExternalEntityID: "sir456",
+						ExternalSystemID: ExternalSystemIDServiceNowSIRIncident,
+					})
+					return &custom_storage.GetObjectOK{}, nil
+				}
+				mockStorage.PutObjectFunc = func(params *custom_storage.PutObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.PutObjectOK, error) {
+					io.Copy(stored, params.Body)
+					return &custom_storage.PutObjectOK{}, nil
+				}
+			},
+			setupMockAPIIntegrations: func(mockAPIIntegrations *MockAPIIntegrationsService) {
+				mockAPIIntegrations.ExecuteCommandFunc = func(params *api_integrations.ExecuteCommandParams, opts ...api_integrations.ClientOption) (*api_integrations.ExecuteCommandOK, error) {
+					resource := params.Body.Resources[0]
+					s.Equal(pluginOpIDServiceNowUpdateSIRIncident, *resource.OperationID)
+					s.Equal(map[string]string{"sys_id": "sir456"}, resource.Request.Params.Path)
+
+					return &api_integrations.ExecuteCommandOK{
+						Payload: &models.DomainExecuteCommandResultsV1{
+							Resources: []*models.DomainExecuteCommandResultV1{
+								{ResponseBody: map[string]interface{}{"result": map[string]interface{}{
+									"sys_id":         "sir456",
+									"state":          "10",
+									"sys_updated_on": "2025-05-01 08:00:00",
+								}}},
+							},
+						},
+					}, nil
+				}
+			},
+			wantCode: 200,
+			wantBody: map[string]interface{}{
+				"ticket_id":                  "sir456",
+				"ticket_type":                "sn_si_incident",
+				"external_last_known_status": "10",
+			},
+			wantRecord: &storage.ExternalEntityRecord{
+				InternalEntityID:        "entity456",
+				ExternalEntityID:        "sir456",
+				ExternalSystemID:        ExternalSystemIDServiceNowSIRIncident,
+				ExternalLastKnownStatus: "10",
+				ExternalLastUpdateTime:  time.Date(2025, 5, 1, 8, 0, 0, 0, time.UTC).Unix(),
+				Revision:                1,
+			},
+		},
+		{
+			name: "No ticket mapped to entity",
+			request: UpdateIncidentRequest{
+				ConfigID: "config123",
+				EntityID: "entity123",
+				State:    "2",
+			},
+			handler: func(h *Handler, req fdk.RequestOf[UpdateIncidentRequest]) fdk.Response {
+				return h.HandleUpdateIncident(context.Background(), req, fdk.WorkflowCtx{})
+			},
+			setupMockStore: func(mockStorage *storage.MockStorageService, stored *bytes.Buffer) {
+				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
+				}
+			},
+			setupMockAPIIntegrations: func(mockAPIIntegrations *MockAPIIntegrationsService) {
+				mockAPIIntegrations.ExecuteCommandFunc = func(params *api_integrations.ExecuteCommandParams, opts ...api_integrations.ClientOption) (*api_integrations.ExecuteCommandOK, error) {
+					s.Fail("ExecuteCommand must not be called when no ticket is mapped")
+					return nil, nil
+				}
+			},
+			wantCode: 404,
+			wantErrors: []fdk.APIError{
+				{Code: 404, Message: "no servicenow_incident ticket is mapped to entity entity123"},
+			},
+		},
+		{
+			name: "ServiceNow error",
+			request: UpdateIncidentRequest{
+				ConfigID: "config123",
+				EntityID: "entity123",
+				State:    "2",
+			},
+			handler: func(h *Handler, req fdk.RequestOf[UpdateIncidentRequest]) fdk.Response {
+				return h.HandleUpdateIncident(context.Background(), req, fdk.WorkflowCtx{})
+			},
+			setupMockStore: func(mockStorage *storage.MockStorageService, stored *bytes.Buffer) {
+				mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+					json.NewEncoder(writer).Encode(storage.ExternalEntityRecord{
+						InternalEntityID: "entity123",
+						ExternalEntityID: "sys123",
+						ExternalSystemID: ExternalSystemIDServiceNowIncident,
+					})
+					return &custom_storage.GetObjectOK{}, nil
+				}
+				mockStorage.PutObjectFunc = func(params *custom_storage.PutObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.PutObjectOK, error) {
+					s.Fail("mapping must not be written when the update fails")
+					return nil, nil
+				}
+			},
+			setupMockAPIIntegrations: func(mockAPIIntegrations *MockAPIIntegrationsService) {
+				mockAPIIntegrations.ExecuteCommandFunc = func(params *api_integrations.ExecuteCommandParams, opts ...api_integrations.ClientOption) (*api_integrations.ExecuteCommandOK, error) {
+					return &api_integrations.ExecuteCommandOK{
+						Payload: &models.DomainExecuteCommandResultsV1{
+							Resources: []*models.DomainExecuteCommandResultV1{
+								{ResponseBody: map[string]interface{}{"error": "Record not found"}},
+							},
+						},
+					}, nil
+				}
+			},
+			wantCode: 500,
+			wantErrors: []fdk.APIError{
+				{Code: 500, Message: "failed to execute command: ServiceNow Error: Record not found"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+
+			stored := new(bytes.Buffer)
+			tc.setupMockStore(s.mockStorage, stored)
+			tc.setupMockAPIIntegrations(s.mockAPIIntegrations)
+
+			mockClientBuilder := func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+				mockClient := &client.CrowdStrikeAPISpecification{}
+				mockClient.CustomStorage = s.mockStorage
+				mockClient.APIIntegrations = s.mockAPIIntegrations
+				return mockClient, "us-1", nil
+			}
+
+			handler := &Handler{
+				logger:           s.logger,
+				falconClientFunc: mockClientBuilder,
+			}
+
+			response := tc.handler(handler, fdk.RequestOf[UpdateIncidentRequest]{
+				Body:        tc.request,
+				AccessToken: "test-token",
+			})
+			s.Equal(tc.wantCode, response.Code, "Response code should match expected value")
+
+			if len(tc.wantErrors) > 0 {
+				s.Nil(response.Body, "Response body should be nil for error responses")
+				s.Len(response.Errors, len(tc.wantErrors), "Response should have the expected number of errors")
+				for i, wantErr := range tc.wantErrors {
+					s.Equal(wantErr.Code, response.Errors[i].Code, "Error code should match expected value")
+					s.Equal(wantErr.Message, response.Errors[i].Message, "Error message should match expected value")
+				}
+				return
+			}
+
+			jsonBytes, err := json.Marshal(response.Body)
+			s.NoError(err, "Failed to marshal JSON body")
+
+			var actual map[string]interface{}
+			s.NoError(json.Unmarshal(jsonBytes, &actual), "Failed to unmarshal JSON body")
+
+			for k, v := range tc.wantBody {
+				actualVal, exists := actual[k]
+				s.True(exists, "Expected key %q not found in response", k)
+				s.Equal(v, actualVal, "For key %q, expected value should match actual value", k)
+			}
+
+			if tc.wantRecord != nil {
+				var record storage.ExternalEntityRecord
+				s.NoError(json.Unmarshal(stored.Bytes(), &record), "Failed to unmarshal stored record")
+				s.Equal(*tc.wantRecord, record, "Stored mapping should carry the refreshed status")
+			}
+		})
+	}
+}
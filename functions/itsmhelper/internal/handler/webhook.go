@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+	"github.com/crowdstrike/gofalcon/falcon/client"
+)
+
+// WebhookSignatureHeader carries the HMAC-SHA256 of the webhook timestamp and raw body, hex or base64 encoded
+const WebhookSignatureHeader = "X-ServiceNow-Signature"
+
+// WebhookTimestampHeader carries the time the webhook was sent, in Unix seconds. It is signed together with
+// the body, so that a captured request can't be replayed once MaxWebhookClockSkew has passed.
+const WebhookTimestampHeader = "X-ServiceNow-Timestamp"
+
+// MaxWebhookClockSkew bounds how far the webhook timestamp may be from the current time, in either direction
+const MaxWebhookClockSkew = 5 * time.Minute
+
+// MaxWebhookBodyBytes bounds the size of a webhook payload
+const MaxWebhookBodyBytes = 1 << 20
+
+// WithWebhookSecret sets the shared secret that /servicenow_webhook payloads are signed with.
+// Without a secret every webhook call is rejected.
+func WithWebhookSecret(secret string) Option {
+	return func(h *Handler) {
+		h.webhookSecret = secret
+	}
+}
+
+// ServiceNowWebhookPayload is the ticket sent by a ServiceNow business rule through an outbound REST message
+type ServiceNowWebhookPayload struct {
+	SysID        string `json:"sys_id"`
+	Number       string `json:"number,omitempty"`
+	SysClassName string `json:"sys_class_name,omitempty"`
+	State        string `json:"state"`
+	SysUpdatedOn string `json:"sys_updated_on,omitempty"`
+}
+
+// ServiceNowWebhookResponse represents the response body for a ServiceNow webhook call
+type ServiceNowWebhookResponse struct {
+	TicketID     string `json:"ticket_id"`
+	TicketNumber string `json:"ticket_number,omitempty"`
+	State        string `json:"state"`
+	// EntityIDs are the internal entities mapped to the ticket
+	EntityIDs []string `json:"entity_ids"`
+	// Changed are the mappings whose state was updated by this call
+	Changed []TicketStateChange `json:"changed"`
+}
+
+// HandleServiceNowWebhook handles the /servicenow_webhook endpoint. It verifies the signature of the timestamp
+// and raw body, finds the entities mapped to the ticket and stores the ticket's state on their mappings. The body
+// is read as it was sent, since the signature covers its exact bytes.
+func (h *Handler) HandleServiceNowWebhook(ctx context.Context, r fdk.Request) fdk.Response {
+	if h.webhookSecret == "" {
+		h.logger.Error("rejecting ServiceNow webhook, servicenow_webhook_secret is not configured")
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: "servicenow webhook is not configured"})
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, MaxWebhookBodyBytes+1))
+		if err != nil {
+			return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: fmt.Sprintf("failed to read payload: %v", err)})
+		}
+	}
+	if len(body) > MaxWebhookBodyBytes {
+		errMsg := fmt.Sprintf("payload exceeds the limit of %d bytes", MaxWebhookBodyBytes)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusRequestEntityTooLarge, Message: errMsg})
+	}
+
+	timestamp, signature := r.Headers.Get(WebhookTimestampHeader), r.Headers.Get(WebhookSignatureHeader)
+	if err := verifyWebhookSignature(h.webhookSecret, timestamp, body, signature, timeNow()); err != nil {
+		h.logger.Warn("rejecting ServiceNow webhook", "trace_id", r.TraceID, "error", err)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusUnauthorized, Message: err.Error()})
+	}
+
+	var payload ServiceNowWebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: fmt.Sprintf("failed to unmarshal payload: %v", err)})
+	}
+	if payload.SysID == "" || payload.State == "" {
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: "sys_id and state are required"})
+	}
+
+	externalSystemID, ok := externalSystemForTable(payload.SysClassName)
+	if !ok {
+		errMsg := fmt.Sprintf("unsupported sys_class_name: %s", payload.SysClassName)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusBadRequest, Message: errMsg})
+	}
+
+	h.logger.Info("Received ServiceNow webhook", "trace_id", r.TraceID, "ticket_id", payload.SysID, "number", payload.Number, "state", payload.State)
+
+	falconClient, _, err := h.falconClientFunc(r.AccessToken, h.logger)
+	if err != nil {
+		errMsg := fmt.Sprintf("error creating Falcon client: %v", err)
+		return fdk.ErrResp(fdk.APIError{Code: http.StatusInternalServerError, Message: errMsg})
+	}
+
+	records, err := h.entitiesForTicket(ctx, falconClient, payload.SysID, externalSystemID)
+	if err != nil {
+		h.logger.Error("failed to look up entities for ticket", "ticket_id", payload.SysID, "error", err)
+		return fdk.ErrResp(fdk.APIError{Code: storageErrCode(err), Message: err.Error()})
+	}
+
+	updateTime := parseServiceNowTime(payload.SysUpdatedOn)
+	resp := ServiceNowWebhookResponse{
+		TicketID:     payload.SysID,
+		TicketNumber: payload.Number,
+		State:        payload.State,
+		EntityIDs:    make([]string, 0, len(records)),
+		Changed:      []TicketStateChange{},
+	}
+	for _, record := range records {
+		resp.EntityIDs = append(resp.EntityIDs, record.InternalEntityID)
+
+		// Deliveries may be retried or arrive out of order, so older notifications don't overwrite newer states
+		if record.ExternalLastKnownStatus == payload.State || updateTime < record.ExternalLastUpdateTime {
+			continue
+		}
+
+		change, err := h.storeTicketState(ctx, falconClient, record, payload.State, updateTime)
+		if err != nil {
+			return h.mappingErrResp(err)
+		}
+		if change != nil {
+			resp.Changed = append(resp.Changed, *change)
+		}
+	}
+
+	return fdk.Response{
+		Code: http.StatusOK,
+		Body: fdk.JSON(resp),
+	}
+}
+
+// verifyWebhookSignature checks the HMAC-SHA256 signature of a webhook, computed over the timestamp, a '.'
+// and the body, and that the timestamp is within MaxWebhookClockSkew of now. The signature may be hex or
+// base64 encoded and prefixed with "sha256=".
+func verifyWebhookSignature(secret, timestamp string, body []byte, signature string, now time.Time) error {
+	timestamp = strings.TrimSpace(timestamp)
+	if timestamp == "" {
+		return fmt.Errorf("missing %s header", WebhookTimestampHeader)
+	}
+	sentAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header, must be Unix seconds: %s", WebhookTimestampHeader, timestamp)
+	}
+	if skew := now.Sub(time.Unix(sentAt, 0)).Abs(); skew > MaxWebhookClockSkew {
+		return fmt.Errorf("webhook timestamp is %s away from the current time, more than the allowed %s", skew.Truncate(time.Second), MaxWebhookClockSkew)
+	}
+
+	signature = strings.TrimSpace(signature)
+	if signature == "" {
+		return fmt.Errorf("missing %s header", WebhookSignatureHeader)
+	}
+	if prefix, rest, ok := strings.Cut(signature, "="); ok && strings.EqualFold(prefix, "sha256") {
+		signature = rest
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	got, err := hex.DecodeString(signature)
+	if err != nil || len(got) != len(expected) {
+		got, err = base64.StdEncoding.DecodeString(signature)
+	}
+	if err != nil || !hmac.Equal(got, expected) {
+		return errors.New("invalid webhook signature")
+	}
+
+	return nil
+}
+
+// externalSystemForTable returns the external system ID of a ServiceNow table, or "" for all systems when
+// the table is not given
+func externalSystemForTable(table string) (string, bool) {
+	if table == "" {
+		return "", true
+	}
+	for externalSystemID, ticketOps := range serviceNowTicketOpsBySystem {
+		if ticketOps.TicketType == table {
+			return externalSystemID, true
+		}
+	}
+	return "", false
+}
+
+// entitiesForTicket returns the mappings of all entities mapped to a ticket, reading every page of the lookup
+func (h *Handler) entitiesForTicket(ctx context.Context, falconClient *client.CrowdStrikeAPISpecification, sysID, externalSystemID string) ([]storage.ExternalEntityRecord, error) {
+	var records []storage.ExternalEntityRecord
+	offset := 0
+	for {
+		result, err := storage.ListEntitiesForTicket(ctx, falconClient.CustomStorage, h.logger, sysID, storage.EntitySearchOptions{
+			ExternalSystemID: externalSystemID,
+			Offset:           offset,
+			Limit:            storage.MaxEntitySearchLimit,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, result.Records...)
+		if offset = result.NextOffset; offset == 0 {
+			return records, nil
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"itsmhelper/internal/storage"
+
+	fdk "github.com/CrowdStrike/foundry-fn-go"
+	"github.com/crowdstrike/gofalcon/falcon/client"
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+)
+
+// TestHandleServiceNowWebhook tests the Handler.HandleServiceNowWebhook method
+func (s *HandlerTestSuite) TestHandleServiceNowWebhook() {
+	originalTimeNow := timeNow
+	defer func() { timeNow = originalTimeNow }()
+
+	now := time.Unix(1745852000, 0)
+	timeNow = func() time.Time { return now }
+
+	const secret = "s3cret"
+	sentAt := strconv.FormatInt(now.Add(-30*time.Second).Unix(), 10)
+	signAt := func(timestamp, body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "." + body))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	sign := func(body string) string {
+		return signAt(sentAt, body)
+	}
+	signBase64 := func(body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(sentAt + "." + body))
+		return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	expired := strconv.FormatInt(now.Add(-MaxWebhookClockSkew-time.Second).Unix(), 10)
+	future := strconv.FormatInt(now.Add(MaxWebhookClockSkew+time.Minute).Unix(), 10)
+
+	resolved := `{"sys_id":"sys1","number":"INC0010005","sys_class_name":"incident","state":"6","sys_updated_on":"2025-04-28 14:45:22"}`
+	stale := `{"sys_id":"sys1","sys_class_name":"incident","state":"2","sys_updated_on":"2025-04-28 08:00:00"}`
+
+	tests := []struct {
+		name         string
+		secret       string
+		body         string
+		timestamp    string
+		signature    string
+		wantCode     int
+		wantBody     ServiceNowWebhookResponse
+		wantError    string
+		wantStatuses map[string]string
+	}{
+		{
+			name:      "Ticket resolved",
+			secret:    secret,
+			body:      resolved,
+			signature: sign(resolved),
+			wantCode:  200,
+			wantBody: ServiceNowWebhookResponse{
+				TicketID:     "sys1",
+				TicketNumber: "INC0010005",
+				State:        "6",
+				EntityIDs:    []string{"alert1", "alert2"},
+				Changed: []TicketStateChange{
+					{InternalEntityID: "alert2", InternalEntityType: "alert", ExternalEntityID: "sys1", ExternalSystemID: ExternalSystemIDServiceNowIncident, PreviousStatus: "2", Status: "6", UpdatedAt: 1745851522},
+				},
+			},
+			wantStatuses: map[string]string{"alert1": "6", "alert2": "6", "alert3": "2"},
+		},
+		{
+			name:      "Base64 signature with prefix",
+			secret:    secret,
+			body:      resolved,
+			signature: "sha256=" + signBase64(resolved),
+			wantCode:  200,
+			wantBody: ServiceNowWebhookResponse{
+				TicketID:     "sys1",
+				TicketNumber: "INC0010005",
+				State:        "6",
+				EntityIDs:    []string{"alert1", "alert2"},
+				Changed: []TicketStateChange{
+					{InternalEntityID: "alert2", InternalEntityType: "alert", ExternalEntityID: "sys1", ExternalSystemID: ExternalSystemIDServiceNowIncident, PreviousStatus: "2", Status: "6", UpdatedAt: 1745851522},
+				},
+			},
+		},
+		{
+			name:      "Older notification",
+			secret:    secret,
+			body:      stale,
+			signature: sign(stale),
+			wantCode:  200,
+			wantBody: ServiceNowWebhookResponse{
+				TicketID:  "sys1",
+				State:     "2",
+				EntityIDs: []string{"alert1", "alert2"},
+				Changed:   []TicketStateChange{},
+			},
+			wantStatuses: map[string]string{"alert1": "6", "alert2": "2"},
+		},
+		{
+			name:      "Invalid signature",
+			secret:    secret,
+			body:      resolved,
+			signature: sign(stale),
+			wantCode:  401,
+			wantError: "invalid webhook signature",
+		},
+		{
+			name:      "Missing signature",
+			secret:    secret,
+			body:      resolved,
+			wantCode:  401,
+			wantError: "missing X-ServiceNow-Signature header",
+		},
+		{
+			name:      "Missing timestamp",
+			secret:    secret,
+			body:      resolved,
+			timestamp: "-",
+			signature: sign(resolved),
+			wantCode:  401,
+			wantError: "missing X-ServiceNow-Timestamp header",
+		},
+		{
+			name:      "Invalid timestamp",
+			secret:    secret,
+			body:      resolved,
+			timestamp: "2025-04-28T14:45:22Z",
+			signature: signAt("2025-04-28T14:45:22Z", resolved),
+			wantCode:  401,
+			wantError: "invalid X-ServiceNow-Timestamp header",
+		},
+		{
+			name:      "Replayed request",
+			secret:    secret,
+			body:      resolved,
+			timestamp: expired,
+			signature: signAt(expired, resolved),
+			wantCode:  401,
+			wantError: "webhook timestamp is 5m1s away from the current time",
+		},
+		{
+			name:      "Timestamp in the future",
+			secret:    secret,
+			body:      resolved,
+			timestamp: future,
+			signature: signAt(future, resolved),
+			wantCode:  401,
+			wantError: "webhook timestamp is 6m0s away from the current time",
+		},
+		{
+			name:      "Timestamp replaced without signing it",
+			secret:    secret,
+			body:      resolved,
+			timestamp: strconv.FormatInt(now.Unix(), 10),
+			signature: sign(resolved),
+			wantCode:  401,
+			wantError: "invalid webhook signature",
+		},
+		{
+			name:      "Secret not configured",
+			body:      resolved,
+			signature: sign(resolved),
+			wantCode:  500,
+			wantError: "servicenow webhook is not configured",
+		},
+		{
+			name:      "Missing state",
+			secret:    secret,
+			body:      `{"sys_id":"sys1"}`,
+			signature: sign(`{"sys_id":"sys1"}`),
+			wantCode:  400,
+			wantError: "sys_id and state are required",
+		},
+		{
+			name:      "Unsupported table",
+			secret:    secret,
+			body:      `{"sys_id":"sys1","state":"6","sys_class_name":"problem"}`,
+			signature: sign(`{"sys_id":"sys1","state":"6","sys_class_name":"problem"}`),
+			wantCode:  400,
+			wantError: "unsupported sys_class_name: problem",
+		},
+		{
+			name:      "Oversized payload",
+			secret:    secret,
+			body:      strings.Repeat(" ", MaxWebhookBodyBytes+1),
+			wantCode:  413,
+			wantError: "payload exceeds the limit",
+		},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+
+			memStorage := storage.NewMemoryStorageService()
+			for _, record := range []storage.ExternalEntityRecord{
+				{InternalEntityID: "alert1", ExternalEntityID: "sys1", ExternalSystemID: ExternalSystemIDServiceNowIncident, ExternalLastKnownStatus: "6", ExternalLastUpdateTime: 1745830800},
+				{InternalEntityID: "alert2", InternalEntityType: "alert", ExternalEntityID: "sys1", ExternalSystemID: ExternalSystemIDServiceNowIncident, ExternalLastKnownStatus: "2", ExternalLastUpdateTime: 1745830800},
+				{InternalEntityID: "alert3", ExternalEntityID: "sys3", ExternalSystemID: ExternalSystemIDServiceNowIncident, ExternalLastKnownStatus: "2"},
+			} {
+				s.Require().NoError(storage.CreateOrUpdateExternalEntityMapping(context.Background(), memStorage, s.logger, record))
+			}
+			memStorage.SearchObjectsFunc = func(params *custom_storage.SearchObjectsParams, opts ...custom_storage.ClientOption) (*custom_storage.SearchObjectsOK, error) {
+				s.Equal("external_entity_id:'sys1'+external_system_id:'servicenow_incident'", params.Filter)
+				keys := []string{"servicenow_incident.alert1", "servicenow_incident.alert2"}
+				total := int64(len(keys))
+				resources := make([]*models.APIObjectMetadata, 0, len(keys))
+				for _, key := range keys {
+					resources = append(resources, &models.APIObjectMetadata{ObjectKey: &key})
+				}
+				return &custom_storage.SearchObjectsOK{Payload: &models.CustomStorageResponse{
+					Resources: resources,
+					Meta:      &models.APIMetaInfo{Pagination: &models.APIResponsePagination{Total: &total}},
+				}}, nil
+			}
+
+			handler := &Handler{
+				logger:        s.logger,
+				webhookSecret: tc.secret,
+				falconClientFunc: func(token string, logger *slog.Logger) (*client.CrowdStrikeAPISpecification, string, error) {
+					mockClient := &client.CrowdStrikeAPISpecification{}
+					mockClient.CustomStorage = memStorage
+					return mockClient, "us-1", nil
+				},
+			}
+
+			headers := http.Header{}
+			switch tc.timestamp {
+			case "":
+				headers.Set(WebhookTimestampHeader, sentAt)
+			case "-":
+			default:
+				headers.Set(WebhookTimestampHeader, tc.timestamp)
+			}
+			if tc.signature != "" {
+				headers.Set(WebhookSignatureHeader, tc.signature)
+			}
+			response := handler.HandleServiceNowWebhook(context.Background(), fdk.Request{
+				Body:        bytes.NewBufferString(tc.body),
+				Headers:     headers,
+				AccessToken: "test-token",
+			})
+
+			s.Equal(tc.wantCode, response.Code)
+			if tc.wantError != "" {
+				s.Require().Len(response.Errors, 1)
+				s.Contains(response.Errors[0].Message, tc.wantError)
+				return
+			}
+
+			jsonBytes, err := json.Marshal(response.Body)
+			s.Require().NoError(err)
+			var body ServiceNowWebhookResponse
+			s.Require().NoError(json.Unmarshal(jsonBytes, &body))
+			s.Equal(tc.wantBody, body)
+
+			for entityID, wantStatus := range tc.wantStatuses {
+				_, record, err := storage.CheckExternalEntityExists(context.Background(), memStorage, s.logger, entityID, ExternalSystemIDServiceNowIncident)
+				s.Require().NoError(err)
+				s.Equal(wantStatus, record.ExternalLastKnownStatus, entityID)
+			}
+		})
+	}
+}
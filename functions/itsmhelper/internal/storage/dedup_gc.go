@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+)
+
+// Defaults and limits for a dedup store garbage collection run
+const (
+	DefaultGCMaxScan   = 1000
+	DefaultGCBatchSize = 100
+	MaxGCBatchSize     = 500
+)
+
+// GCOptions bounds a dedup store garbage collection run
+type GCOptions struct {
+	// Cursor is the last key scanned by a previous run; empty to start from the beginning of the collection
+	Cursor string
+	// MaxScan is the maximum number of records scanned in this run
+	MaxScan int
+	// BatchSize is the number of keys listed per ListObjects call
+	BatchSize int
+}
+
+// GCResult reports the outcome of a dedup store garbage collection run
+type GCResult struct {
+	Scanned int
+	Deleted int
+	// NextCursor is the cursor to continue from in the next run, empty once the whole collection was scanned
+	NextCursor string
+}
+
+// CollectExpiredDedupRecords pages through the dedup store and deletes records whose window has ended
+// and that were not seen within the last window. Records written before expiry was tracked are judged
+// by their last modification time and time bucket. Records of forever windows are kept. A run scans at most opts.MaxScan records, so large collections
+// are cleaned up over several runs by passing NextCursor back in.
+func CollectExpiredDedupRecords(ctx context.Context, storageService StorageService, logger *slog.Logger, opts GCOptions) (*GCResult, error) {
+	if opts.MaxScan <= 0 {
+		opts.MaxScan = DefaultGCMaxScan
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultGCBatchSize
+	}
+	opts.BatchSize = min(opts.BatchSize, MaxGCBatchSize)
+
+	now := timeNow()
+	result := &GCResult{}
+	cursor := opts.Cursor
+
+	for result.Scanned < opts.MaxScan {
+		// The start key may be included in the listing, so one more key is requested to make progress either way
+		limit := min(opts.BatchSize, opts.MaxScan-result.Scanned)
+		if cursor != "" {
+			limit++
+		}
+
+		listResp, err := storageService.ListObjects(&custom_storage.ListObjectsParams{
+			CollectionName: CollectionNameDedupStore,
+			Start:          cursor,
+			Limit:          int64(limit),
+			Context:        ctx,
+		})
+		err = newStorageError("ListObjects", err)
+		if err != nil {
+			return result, fmt.Errorf("failed to list dedup records: %w", err)
+		}
+
+		var keys []string
+		if listResp != nil && listResp.Payload != nil {
+			keys = listResp.Payload.Resources
+		}
+
+		for _, key := range keys {
+			if key == cursor {
+				continue
+			}
+			if result.Scanned >= opts.MaxScan {
+				break
+			}
+
+			expired, err := dedupRecordExpired(ctx, storageService, logger, key, now)
+			if err != nil {
+				return result, err
+			}
+			result.Scanned++
+			cursor = key
+
+			if !expired {
+				continue
+			}
+
+			_, err = storageService.DeleteObject(&custom_storage.DeleteObjectParams{
+				CollectionName: CollectionNameDedupStore,
+				ObjectKey:      key,
+				Context:        ctx,
+			})
+			err = newStorageError("DeleteObject", err)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return result, fmt.Errorf("failed to delete dedup record: %w", err)
+			}
+			result.Deleted++
+		}
+
+		// A short page means the end of the collection was reached
+		if len(keys) < limit {
+			logger.Info("Dedup store garbage collection completed", "scanned", result.Scanned, "deleted", result.Deleted)
+			return result, nil
+		}
+	}
+
+	result.NextCursor = cursor
+	logger.Info("Dedup store garbage collection paused", "scanned", result.Scanned, "deleted", result.Deleted, "next_cursor", cursor)
+	return result, nil
+}
+
+// dedupRecordExpired reports whether the window of a dedup record has ended
+func dedupRecordExpired(ctx context.Context, storageService StorageService, logger *slog.Logger, key string, now time.Time) (bool, error) {
+	buf := new(bytes.Buffer)
+	_, err := storageService.GetObject(&custom_storage.GetObjectParams{
+		CollectionName: CollectionNameDedupStore,
+		ObjectKey:      key,
+		Context:        ctx,
+	}, buf)
+	err = newStorageError("GetObject", err)
+	if err != nil {
+		// Deleted since it was listed
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read dedup record: %w", err)
+	}
+
+	var record DedupStoreRecord
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		logger.Warn("skipping unreadable dedup record", "key", key, "error", err)
+		return false, nil
+	}
+
+	window, windowErr := record.TimeBucket.Window()
+
+	if record.ExpiresAt > 0 {
+		// The record is only read here, so a sliding window restarted by a call between this read
+		// and the delete would be lost. Keys seen within the last window are therefore kept until
+		// they have been idle for a whole window, which narrows that race to keys that were idle.
+		// Fixed windows are deleted up to one window later than their expiry as a result.
+		if windowErr == nil && record.LastSeenAt > 0 && now.Sub(time.UnixMilli(record.LastSeenAt)) < window {
+			return false, nil
+		}
+		return now.UnixMilli() >= record.ExpiresAt, nil
+	}
+
+	// Without an expiry the record is either a forever window or predates expiry tracking.
+	// Older records were written within their window, so the window has ended once its length
+	// has passed since the last write.
+	if windowErr != nil || window == 0 {
+		return false, nil
+	}
+
+	metaResp, err := storageService.GetObjectMetadata(&custom_storage.GetObjectMetadataParams{
+		CollectionName: CollectionNameDedupStore,
+		ObjectKey:      key,
+		Context:        ctx,
+	})
+	err = newStorageError("GetObjectMetadata", err)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read dedup record metadata: %w", err)
+	}
+	if metaResp == nil || metaResp.Payload == nil || len(metaResp.Payload.Resources) == 0 {
+		return false, nil
+	}
+
+	lastModified := time.Time(metaResp.Payload.Resources[0].LastModifiedTime)
+	return !lastModified.IsZero() && now.Sub(lastModified) >= window, nil
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+)
+
+// TestCollectExpiredDedupRecords tests the CollectExpiredDedupRecords function
+func (s *StorageTestSuite) TestCollectExpiredDedupRecords() {
+	originalTimeNow := timeNow
+	defer func() { timeNow = originalTimeNow }()
+
+	start := time.Date(2023, 5, 15, 10, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return start }
+
+	memStorage := NewMemoryStorageService()
+	throttle := func(dedupObjID, timeBucket string, mode ThrottleMode) {
+		_, err := Throttle(context.Background(), memStorage, s.logger, ThrottleParams{
+			InternalEntityID: "entity123",
+			DedupObjType:     "Host",
+			DedupObjID:       dedupObjID,
+			TimeBucket:       timeBucket,
+			Mode:             mode,
+		})
+		s.Require().NoError(err)
+	}
+	put := func(key, data string) {
+		_, err := memStorage.PutObject(&custom_storage.PutObjectParams{
+			CollectionName: CollectionNameDedupStore,
+			ObjectKey:      key,
+			Body:           io.NopCloser(strings.NewReader(data)),
+		})
+		s.Require().NoError(err)
+	}
+
+	throttle("host1", "5 minutes", ThrottleModeFixed)
+	throttle("host2", "1h", ThrottleModeSliding)
+	throttle("host3", "forever", ThrottleModeFixed)
+	put("legacy", `{"time_bucket":"5 minutes"}`)
+	put("corrupt", `not json`)
+
+	// Nothing has expired yet
+	result, err := CollectExpiredDedupRecords(context.Background(), memStorage, s.logger, GCOptions{})
+	s.Require().NoError(err)
+	s.Equal(&GCResult{Scanned: 5}, result)
+
+	// The 5 minute windows have ended, the sliding hour and the forever window have not
+	timeNow = func() time.Time { return start.Add(10 * time.Minute) }
+	result, err = CollectExpiredDedupRecords(context.Background(), memStorage, s.logger, GCOptions{})
+	s.Require().NoError(err)
+	s.Equal(&GCResult{Scanned: 5, Deleted: 2}, result)
+	_, ok := memStorage.Object(CollectionNameDedupStore, "legacy")
+	s.False(ok, "records without an expiry are judged by their last modification")
+
+	// Runs are bounded and continue from the cursor
+	timeNow = func() time.Time { return start.Add(2 * time.Hour) }
+	var scanned, deleted, runs int
+	cursor := ""
+	for {
+		result, err = CollectExpiredDedupRecords(context.Background(), memStorage, s.logger, GCOptions{Cursor: cursor, MaxScan: 2, BatchSize: 1})
+		s.Require().NoError(err)
+		s.LessOrEqual(result.Scanned, 2)
+		scanned += result.Scanned
+		deleted += result.Deleted
+		runs++
+		if cursor = result.NextCursor; cursor == "" {
+			break
+		}
+	}
+	s.Equal(3, scanned)
+	s.Equal(1, deleted)
+	s.Equal(2, runs)
+}
+
+// TestCollectExpiredDedupRecordsRecentlySeen tests that a sliding window restarted while a collection
+// run reads its record is not deleted
+func (s *StorageTestSuite) TestCollectExpiredDedupRecordsRecentlySeen() {
+	originalTimeNow := timeNow
+	defer func() { timeNow = originalTimeNow }()
+
+	start := time.Date(2023, 5, 15, 10, 0, 0, 0, time.UTC)
+	params := ThrottleParams{
+		InternalEntityID: "entity123",
+		DedupObjType:     "Host",
+		DedupObjID:       "host1",
+		TimeBucket:       "1h",
+		Mode:             ThrottleModeSliding,
+	}
+
+	mem := NewMemoryStorageService()
+	throttleAt := func(storageService StorageService, at time.Time) *ThrottleResult {
+		timeNow = func() time.Time { return at }
+		result, err := Throttle(context.Background(), storageService, s.logger, params)
+		s.Require().NoError(err)
+		return result
+	}
+
+	throttleAt(mem, start)
+	throttleAt(mem, start.Add(50*time.Minute))
+
+	// The window that started at 10:00 has ended at 11:10, and a call restarts it while the record is read
+	racing := &racingStorageService{MemoryStorageService: mem}
+	racing.race = func(m *MemoryStorageService) {
+		s.True(throttleAt(m, start.Add(70*time.Minute)).Allowed)
+	}
+
+	timeNow = func() time.Time { return start.Add(70 * time.Minute) }
+	result, err := CollectExpiredDedupRecords(context.Background(), racing, s.logger, GCOptions{})
+	s.Require().NoError(err)
+	s.Equal(&GCResult{Scanned: 1}, result, "the key was seen within the last window")
+	s.False(throttleAt(mem, start.Add(71*time.Minute)).Allowed, "the restarted window should be kept")
+
+	// Once the key has been idle for a whole window the record is deleted
+	timeNow = func() time.Time { return start.Add(3 * time.Hour) }
+	result, err = CollectExpiredDedupRecords(context.Background(), mem, s.logger, GCOptions{})
+	s.Require().NoError(err)
+	s.Equal(&GCResult{Scanned: 1, Deleted: 1}, result)
+}
+
+// TestCollectExpiredDedupRecordsErrors tests storage errors during garbage collection
+func (s *StorageTestSuite) TestCollectExpiredDedupRecordsErrors() {
+	s.mockStorage.ListObjectsFunc = func(params *custom_storage.ListObjectsParams, opts ...custom_storage.ClientOption) (*custom_storage.ListObjectsOK, error) {
+		return nil, custom_storage.NewListObjectsTooManyRequests()
+	}
+	_, err := CollectExpiredDedupRecords(context.Background(), s.mockStorage, s.logger, GCOptions{})
+	s.ErrorContains(err, "failed to list dedup records")
+	s.ErrorIs(err, ErrRateLimited)
+
+	memStorage := NewMemoryStorageService()
+	_, err = memStorage.PutObject(&custom_storage.PutObjectParams{
+		CollectionName: CollectionNameDedupStore,
+		ObjectKey:      "expired",
+		Body:           io.NopCloser(bytes.NewReader([]byte(`{"time_bucket":"5 minutes","expires_at":1}`))),
+	})
+	s.Require().NoError(err)
+	_, err = CollectExpiredDedupRecords(context.Background(), failingDeleteStorage{memStorage}, s.logger, GCOptions{})
+	s.ErrorContains(err, "failed to delete dedup record")
+	s.ErrorIs(err, ErrUnavailable)
+}
+
+// failingDeleteStorage is a MemoryStorageService whose deletes fail
+type failingDeleteStorage struct {
+	*MemoryStorageService
+}
+
+func (f failingDeleteStorage) DeleteObject(params *custom_storage.DeleteObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.DeleteObjectOK, error) {
+	return nil, custom_storage.NewDeleteObjectInternalServerError()
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+)
+
+// Defaults and limits for a page of tracked entities
+const (
+	DefaultEntityScanLimit = 100
+	MaxEntityScanLimit     = 500
+)
+
+// EntityScanResult is a page of the tracked entities collection
+type EntityScanResult struct {
+	// Records holds the mappings on the page; pending creation leases and unreadable records are left out
+	Records []ExternalEntityRecord
+	// Scanned is the number of keys on the page
+	Scanned int
+	// NextCursor is the cursor of the next page, empty once the whole collection was scanned
+	NextCursor string
+}
+
+// ScanTrackedEntities reads a page of up to limit tracked entities, starting after cursor. Pass NextCursor
+// back in to continue with the next page.
+func ScanTrackedEntities(ctx context.Context, storageService StorageService, logger *slog.Logger, cursor string, limit int) (*EntityScanResult, error) {
+	if limit <= 0 {
+		limit = DefaultEntityScanLimit
+	}
+	limit = min(limit, MaxEntityScanLimit)
+
+	// The start key may be included in the listing, so one more key is requested to fill the page either way
+	listLimit := limit
+	if cursor != "" {
+		listLimit++
+	}
+
+	listResp, err := storageService.ListObjects(&custom_storage.ListObjectsParams{
+		CollectionName: CollectionNameTrackedEntities,
+		Start:          cursor,
+		Limit:          int64(listLimit),
+		Context:        ctx,
+	})
+	err = newStorageError("ListObjects", err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tracked entities: %w", err)
+	}
+
+	var keys []string
+	if listResp != nil && listResp.Payload != nil {
+		keys = listResp.Payload.Resources
+	}
+
+	result := &EntityScanResult{}
+	for _, key := range keys {
+		if key == cursor {
+			continue
+		}
+		if result.Scanned >= limit {
+			break
+		}
+		result.Scanned++
+		result.NextCursor = key
+
+		record, err := readExternalEntityRecord(ctx, storageService, key)
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			logger.Warn("skipping unreadable tracked entity", "key", key, "error", err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Deleted since it was listed, or not turned into a mapping yet
+		if record == nil || record.IsPending() {
+			continue
+		}
+
+		// Records of early versions may lack the IDs they were stored under
+		if record.InternalEntityID == "" || record.ExternalSystemID == "" {
+			externalSystemID, internalEntityID, err := parseTrackedEntityKey(key)
+			if err != nil {
+				logger.Warn("skipping tracked entity without IDs", "key", key, "error", err)
+				continue
+			}
+			record.InternalEntityID = internalEntityID
+			record.ExternalSystemID = externalSystemID
+		}
+
+		result.Records = append(result.Records, *record)
+	}
+
+	// A short page means the end of the collection was reached
+	if len(keys) < listLimit {
+		result.NextCursor = ""
+	}
+
+	return result, nil
+}
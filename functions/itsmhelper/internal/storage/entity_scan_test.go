@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+)
+
+// TestScanTrackedEntities tests paging through the tracked entities collection
+func (s *StorageTestSuite) TestScanTrackedEntities() {
+	memStorage := NewMemoryStorageService()
+	put := func(key, data string) {
+		_, err := memStorage.PutObject(&custom_storage.PutObjectParams{
+			CollectionName: CollectionNameTrackedEntities,
+			ObjectKey:      key,
+			Body:           io.NopCloser(strings.NewReader(data)),
+		})
+		s.Require().NoError(err)
+	}
+
+	put("servicenow_incident.alert1", `{"internal_entity_id":"alert1","external_entity_id":"sys1","external_system_id":"servicenow_incident"}`)
+	put("servicenow_incident.alert2", `{"internal_entity_id":"alert2","external_system_id":"servicenow_incident","lease_owner":"owner"}`)
+	put("servicenow_incident.alert3", `not json`)
+	put("servicenow_incident.alert.3A4", `{"external_entity_id":"sys4"}`)
+	put("servicenow_sir_incident.alert5", `{"internal_entity_id":"alert5","external_entity_id":"sys5","external_system_id":"servicenow_sir_incident"}`)
+
+	var records []ExternalEntityRecord
+	var scanned, pages int
+	cursor := ""
+	for {
+		result, err := ScanTrackedEntities(context.Background(), memStorage, s.logger, cursor, 2)
+		s.Require().NoError(err)
+		s.LessOrEqual(result.Scanned, 2)
+		records = append(records, result.Records...)
+		scanned += result.Scanned
+		pages++
+		if cursor = result.NextCursor; cursor == "" {
+			break
+		}
+	}
+
+	s.Equal(5, scanned)
+	s.Equal(3, pages)
+
+	// Pending leases and unreadable records are skipped, missing IDs are taken from the key
+	s.Require().Len(records, 3)
+	s.Equal("alert:4", records[0].InternalEntityID)
+	s.Equal("servicenow_incident", records[0].ExternalSystemID)
+	s.Equal("alert1", records[1].InternalEntityID)
+	s.Equal("alert5", records[2].InternalEntityID)
+}
+
+// TestScanTrackedEntitiesErrors tests storage errors while paging through the tracked entities collection
+func (s *StorageTestSuite) TestScanTrackedEntitiesErrors() {
+	s.mockStorage.ListObjectsFunc = func(params *custom_storage.ListObjectsParams, opts ...custom_storage.ClientOption) (*custom_storage.ListObjectsOK, error) {
+		return nil, custom_storage.NewListObjectsTooManyRequests()
+	}
+	_, err := ScanTrackedEntities(context.Background(), s.mockStorage, s.logger, "", 10)
+	s.ErrorContains(err, "failed to list tracked entities")
+	s.ErrorIs(err, ErrRateLimited)
+
+	s.mockStorage.ListObjectsFunc = func(params *custom_storage.ListObjectsParams, opts ...custom_storage.ClientOption) (*custom_storage.ListObjectsOK, error) {
+		return &custom_storage.ListObjectsOK{Payload: &models.CustomStorageObjectKeys{Resources: []string{"servicenow_incident.alert1"}}}, nil
+	}
+	s.mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+		return nil, custom_storage.NewGetObjectInternalServerError()
+	}
+	_, err = ScanTrackedEntities(context.Background(), s.mockStorage, s.logger, "", 10)
+	s.ErrorIs(err, ErrUnavailable)
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-openapi/runtime"
+)
+
+// Errors returned by the storage functions can be matched against these with errors.Is
+var (
+	ErrNotFound    = errors.New("object not found")
+	ErrRateLimited = errors.New("custom storage rate limit exceeded")
+	ErrUnavailable = errors.New("custom storage unavailable")
+	ErrConflict    = errors.New("conflicting custom storage write")
+)
+
+// StorageError is a failed custom storage call, carrying the HTTP status code of the response.
+// It matches ErrNotFound, ErrRateLimited, ErrUnavailable or ErrConflict depending on that status code.
+type StorageError struct {
+	Op         string
+	StatusCode int
+	Err        error
+}
+
+func (e *StorageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the status code of the error belongs to target's category
+func (e *StorageError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrUnavailable:
+		return e.StatusCode >= http.StatusInternalServerError
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict || e.StatusCode == http.StatusPreconditionFailed
+	}
+	return false
+}
+
+// newStorageError classifies an error returned by the custom storage client.
+// The typed custom_storage responses (e.g. GetObjectTooManyRequests) expose Code(), while status codes
+// that are not part of the API spec, such as 404, come back as a *runtime.APIError.
+func newStorageError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var storageErr *StorageError
+	if errors.As(err, &storageErr) {
+		return err
+	}
+
+	statusCode := 0
+	var apiErr *runtime.APIError
+	var coder interface{ Code() int }
+	switch {
+	case errors.As(err, &apiErr):
+		statusCode = apiErr.Code
+	case errors.As(err, &coder):
+		statusCode = coder.Code()
+	}
+
+	return &StorageError{Op: op, StatusCode: statusCode, Err: err}
+}
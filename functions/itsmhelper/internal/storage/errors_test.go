@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+	"github.com/go-openapi/runtime"
+)
+
+// TestNewStorageError tests the classification of custom storage errors
+func (s *StorageTestSuite) TestNewStorageError() {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantIs     error
+	}{
+		{
+			name:       "Not found API error",
+			err:        runtime.NewAPIError("GetObject", nil, 404),
+			wantStatus: 404,
+			wantIs:     ErrNotFound,
+		},
+		{
+			name:       "Typed rate limit response",
+			err:        custom_storage.NewGetObjectTooManyRequests(),
+			wantStatus: 429,
+			wantIs:     ErrRateLimited,
+		},
+		{
+			name:       "Typed internal server error response",
+			err:        custom_storage.NewPutObjectInternalServerError(),
+			wantStatus: 500,
+			wantIs:     ErrUnavailable,
+		},
+		{
+			name:       "Service unavailable API error",
+			err:        runtime.NewAPIError("PutObject", nil, 503),
+			wantStatus: 503,
+			wantIs:     ErrUnavailable,
+		},
+		{
+			name:       "Conflict API error",
+			err:        runtime.NewAPIError("PutObject", nil, 409),
+			wantStatus: 409,
+			wantIs:     ErrConflict,
+		},
+		{
+			name: "Transport error",
+			err:  fmt.Errorf("connection error"),
+		},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			err := fmt.Errorf("wrapped: %w", newStorageError("GetObject", tc.err))
+
+			var storageErr *StorageError
+			s.Require().ErrorAs(err, &storageErr)
+			s.Equal(tc.wantStatus, storageErr.StatusCode)
+			s.Equal(tc.err.Error(), storageErr.Error(), "the original error text should be kept")
+			s.ErrorIs(err, tc.err)
+
+			for _, sentinel := range []error{ErrNotFound, ErrRateLimited, ErrUnavailable, ErrConflict} {
+				s.Equal(sentinel == tc.wantIs, errors.Is(err, sentinel), "errors.Is(%v)", sentinel)
+			}
+		})
+	}
+
+	s.Nil(newStorageError("GetObject", nil))
+}
+
+// TestStorageErrorsFromStorageFunctions tests that the storage functions return classified errors
+func (s *StorageTestSuite) TestStorageErrorsFromStorageFunctions() {
+	s.mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+		return nil, custom_storage.NewGetObjectTooManyRequests()
+	}
+
+	_, _, err := CheckExternalEntityExists(context.Background(), s.mockStorage, s.logger, "entity123", "servicenow_incident")
+	s.ErrorIs(err, ErrRateLimited)
+
+	_, err = CheckThrottlingStore(context.Background(), s.mockStorage, s.logger, "entity123", "type", "id", string(TimeBucketForever))
+	s.ErrorIs(err, ErrRateLimited)
+
+	_, err = UpdateExternalEntityMapping(context.Background(), s.mockStorage, s.logger, "entity123", "servicenow_incident", func(*ExternalEntityRecord) error { return nil })
+	s.ErrorIs(err, ErrRateLimited)
+
+	s.ErrorIs(&MappingConflictError{}, ErrConflict, "mapping conflicts should match ErrConflict")
+}
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+)
+
+// ErrLeaseWaitTimeout is returned when another caller holds the creation lease for longer than the wait timeout
+var ErrLeaseWaitTimeout = errors.New("timed out waiting for a concurrent ticket creation to finish")
+
+// LeaseOptions controls how ClaimExternalEntityCreation claims and waits for the creation lease
+type LeaseOptions struct {
+	// TTL is how long a pending lease is honoured before another caller may take it over
+	TTL time.Duration
+	// PollInterval is how often a waiting caller re-reads the record
+	PollInterval time.Duration
+	// WaitTimeout is how long a caller waits for a competing creation before giving up
+	WaitTimeout time.Duration
+}
+
+// DefaultLeaseOptions returns the lease timings used when none are configured
+func DefaultLeaseOptions() LeaseOptions {
+	return LeaseOptions{
+		TTL:          60 * time.Second,
+		PollInterval: 500 * time.Millisecond,
+		WaitTimeout:  20 * time.Second,
+	}
+}
+
+// WithDefaults returns a copy of the options where unset values are taken from DefaultLeaseOptions
+func (o LeaseOptions) WithDefaults() LeaseOptions {
+	defaults := DefaultLeaseOptions()
+	if o.TTL <= 0 {
+		o.TTL = defaults.TTL
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = defaults.PollInterval
+	}
+	if o.WaitTimeout <= 0 {
+		o.WaitTimeout = defaults.WaitTimeout
+	}
+	return o
+}
+
+// ClaimResult is the outcome of ClaimExternalEntityCreation.
+// When Acquired is true the caller owns the lease and must create the ticket, then either store the
+// final mapping or call ReleaseExternalEntityCreation. Otherwise Record holds the mapping created by
+// the winning caller.
+type ClaimResult struct {
+	Acquired bool
+	Record   *ExternalEntityRecord
+}
+
+// ClaimExternalEntityCreation claims the right to create the external ticket for an internal entity.
+//
+// The caller writes a pending record carrying its owner ID, on the condition that the record it read is still
+// the one stored (see UpdateExternalEntityMapping). Of several callers that read the same record, only the first
+// write succeeds; the others get a conflict, re-read the record and find the winner's lease. Callers that lose
+// poll until the winner stores the ticket ID and return that mapping. A lease that is not turned into a mapping
+// before its TTL expires, e.g. because the function crashed, is taken over by the next caller.
+func ClaimExternalEntityCreation(ctx context.Context, storageService StorageService, logger *slog.Logger, internalEntityID, externalSystemID, owner string, opts LeaseOptions) (*ClaimResult, error) {
+	opts = opts.WithDefaults()
+	deadline := timeNow().Add(opts.WaitTimeout)
+
+	key, err := CreateTrackedEntityKey(externalSystemID, internalEntityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracked entity key: %w", err)
+	}
+
+	for {
+		stored, record, _, err := readVersionedTrackedEntityRecord(ctx, storageService, key, internalEntityID, externalSystemID)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil && record.ExternalSystemID != externalSystemID {
+			record = nil
+		}
+
+		switch {
+		case record != nil && !record.IsPending():
+			return &ClaimResult{Record: record}, nil
+
+		case record != nil && record.LeaseOwner != owner && !record.LeaseExpired(timeNow()):
+			logger.Info("ticket creation in progress by another caller, waiting",
+				"internal_id", internalEntityID, "lease_owner", record.LeaseOwner)
+
+		default:
+			if record != nil && record.LeaseOwner != owner {
+				logger.Warn("taking over expired creation lease",
+					"internal_id", internalEntityID, "lease_owner", record.LeaseOwner)
+			}
+
+			acquired, err := writeCreationLease(ctx, storageService, logger, key, internalEntityID, externalSystemID, owner, stored, opts)
+			if err != nil {
+				return nil, err
+			}
+			if acquired {
+				return &ClaimResult{Acquired: true}, nil
+			}
+
+			// Another caller's write landed first, its lease is read straight away on the next pass
+			logger.Info("lost the creation lease to a concurrent caller", "internal_id", internalEntityID)
+			if !timeNow().Before(deadline) {
+				return nil, ErrLeaseWaitTimeout
+			}
+			continue
+		}
+
+		if !timeNow().Before(deadline) {
+			return nil, ErrLeaseWaitTimeout
+		}
+
+		if err := sleepContext(ctx, opts.PollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ReleaseExternalEntityCreation removes a pending lease so that another caller can retry the creation
+// straight away instead of waiting for the lease to expire. Leases held by other owners are left alone.
+func ReleaseExternalEntityCreation(ctx context.Context, storageService StorageService, logger *slog.Logger, internalEntityID, externalSystemID, owner string) error {
+	record, err := getExternalEntityRecord(ctx, storageService, internalEntityID, externalSystemID)
+	if err != nil {
+		return err
+	}
+
+	if record == nil || !record.IsPending() || record.LeaseOwner != owner {
+		return nil
+	}
+
+	key, err := CreateTrackedEntityKey(externalSystemID, internalEntityID)
+	if err != nil {
+		return fmt.Errorf("failed to create tracked entity key: %w", err)
+	}
+
+	_, err = storageService.DeleteObject(&custom_storage.DeleteObjectParams{
+		CollectionName: CollectionNameTrackedEntities,
+		ObjectKey:      key,
+		Context:        ctx,
+	})
+	err = newStorageError("DeleteObject", err)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		logger.Error("failed to release creation lease", "error", err)
+		return fmt.Errorf("failed to release creation lease: %w", err)
+	}
+
+	return nil
+}
+
+// writeCreationLease writes a pending record owned by owner on the condition that stored is still the record
+// under key, and reports whether it won. A write that lost to a concurrent one reports false.
+func writeCreationLease(ctx context.Context, storageService StorageService, logger *slog.Logger, key, internalEntityID, externalSystemID, owner string, stored *ExternalEntityRecord, opts LeaseOptions) (bool, error) {
+	err := putExternalEntityRecord(ctx, storageService, key, ExternalEntityRecord{
+		InternalEntityID: internalEntityID,
+		ExternalSystemID: externalSystemID,
+		LeaseOwner:       owner,
+		LeaseExpiresAt:   timeNow().Add(opts.TTL).UnixMilli(),
+		Revision:         stored.nextRevision(),
+	}, stored)
+	if errors.Is(err, ErrConflict) {
+		return false, nil
+	}
+	if err != nil {
+		logger.Error("failed to write creation lease", "error", err)
+		return false, fmt.Errorf("failed to write creation lease: %w", err)
+	}
+
+	return true, nil
+}
+
+// getExternalEntityRecord reads the tracked entity record, returning nil when it does not exist
+func getExternalEntityRecord(ctx context.Context, storageService StorageService, internalEntityID, externalSystemID string) (*ExternalEntityRecord, error) {
+	record, _, err := readTrackedEntityRecord(ctx, storageService, internalEntityID, externalSystemID)
+	if err != nil || record == nil || record.ExternalSystemID != externalSystemID {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// sleepContext waits for d or until the context is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// testLeaseOptions keeps the lease timings short enough for unit tests
+var testLeaseOptions = LeaseOptions{
+	TTL:          time.Minute,
+	PollInterval: time.Millisecond,
+	WaitTimeout:  50 * time.Millisecond,
+}
+
+// TestClaimExternalEntityCreation tests the ClaimExternalEntityCreation function
+func (s *StorageTestSuite) TestClaimExternalEntityCreation() {
+	now := time.Now()
+
+	tests := []struct {
+		name         string
+		stored       *ExternalEntityRecord
+		wantAcquired bool
+		wantTicketID string
+		wantErr      error
+	}{
+		{
+			name:         "No record",
+			wantAcquired: true,
+		},
+		{
+			name: "Mapping already exists",
+			stored: &ExternalEntityRecord{
+				InternalEntityID: "entity123",
+				ExternalEntityID: "sys123",
+				ExternalSystemID: "servicenow_incident",
+			},
+			wantTicketID: "sys123",
+		},
+		{
+			name: "Expired lease is taken over",
+			stored: &ExternalEntityRecord{
+				InternalEntityID: "entity123",
+				ExternalSystemID: "servicenow_incident",
+				LeaseOwner:       "crashed",
+				LeaseExpiresAt:   now.Add(-time.Second).UnixMilli(),
+			},
+			wantAcquired: true,
+		},
+		{
+			name: "Active lease held by another owner",
+			stored: &ExternalEntityRecord{
+				InternalEntityID: "entity123",
+				ExternalSystemID: "servicenow_incident",
+				LeaseOwner:       "other",
+				LeaseExpiresAt:   now.Add(time.Minute).UnixMilli(),
+			},
+			wantErr: ErrLeaseWaitTimeout,
+		},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+
+			memStorage := NewMemoryStorageService()
+			if tc.stored != nil {
+				s.Require().NoError(CreateOrUpdateExternalEntityMapping(context.Background(), memStorage, s.logger, *tc.stored))
+			}
+
+			claim, err := ClaimExternalEntityCreation(context.Background(), memStorage, s.logger, "entity123", "servicenow_incident", "owner1", testLeaseOptions)
+			if tc.wantErr != nil {
+				s.ErrorIs(err, tc.wantErr)
+				return
+			}
+			s.Require().NoError(err)
+			s.Equal(tc.wantAcquired, claim.Acquired)
+
+			if !tc.wantAcquired {
+				s.Equal(tc.wantTicketID, claim.Record.ExternalEntityID)
+				return
+			}
+
+			exists, _, err := CheckExternalEntityExists(context.Background(), memStorage, s.logger, "entity123", "servicenow_incident")
+			s.NoError(err)
+			s.False(exists, "a pending lease must not be reported as an existing mapping")
+		})
+	}
+}
+
+// TestClaimExternalEntityCreationWaitsForWinner tests that a losing caller returns the winner's mapping
+func (s *StorageTestSuite) TestClaimExternalEntityCreationWaitsForWinner() {
+	memStorage := NewMemoryStorageService()
+	s.Require().NoError(CreateOrUpdateExternalEntityMapping(context.Background(), memStorage, s.logger, ExternalEntityRecord{
+		InternalEntityID: "entity123",
+		ExternalSystemID: "servicenow_incident",
+		LeaseOwner:       "winner",
+		LeaseExpiresAt:   time.Now().Add(time.Minute).UnixMilli(),
+	}))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		CreateOrUpdateExternalEntityMapping(context.Background(), memStorage, s.logger, ExternalEntityRecord{
+			InternalEntityID: "entity123",
+			ExternalEntityID: "sys123",
+			ExternalSystemID: "servicenow_incident",
+		})
+	}()
+
+	opts := testLeaseOptions
+	opts.WaitTimeout = time.Second
+	claim, err := ClaimExternalEntityCreation(context.Background(), memStorage, s.logger, "entity123", "servicenow_incident", "loser", opts)
+	s.Require().NoError(err)
+	s.False(claim.Acquired)
+	s.Equal("sys123", claim.Record.ExternalEntityID)
+}
+
+// TestReleaseExternalEntityCreation tests the ReleaseExternalEntityCreation function
+func (s *StorageTestSuite) TestReleaseExternalEntityCreation() {
+	memStorage := NewMemoryStorageService()
+	key, _ := CreateTrackedEntityKey("servicenow_incident", "entity123")
+
+	claim, err := ClaimExternalEntityCreation(context.Background(), memStorage, s.logger, "entity123", "servicenow_incident", "owner1", testLeaseOptions)
+	s.Require().NoError(err)
+	s.Require().True(claim.Acquired)
+
+	s.NoError(ReleaseExternalEntityCreation(context.Background(), memStorage, s.logger, "entity123", "servicenow_incident", "owner2"))
+	_, ok := memStorage.Object(CollectionNameTrackedEntities, key)
+	s.True(ok, "a lease held by another owner must not be released")
+
+	s.NoError(ReleaseExternalEntityCreation(context.Background(), memStorage, s.logger, "entity123", "servicenow_incident", "owner1"))
+	_, ok = memStorage.Object(CollectionNameTrackedEntities, key)
+	s.False(ok, "the lease should be removed")
+
+	s.NoError(ReleaseExternalEntityCreation(context.Background(), memStorage, s.logger, "entity123", "servicenow_incident", "owner1"))
+}
+
+// TestClaimExternalEntityCreationInterleavedWriters tests that of two callers that both read "no record", only the
+// first lease write succeeds, and the other caller returns the winner's ticket instead of creating its own
+func (s *StorageTestSuite) TestClaimExternalEntityCreationInterleavedWriters() {
+	memStorage := NewMemoryStorageService()
+
+	var claimA *ClaimResult
+	racing := &racingStorageService{MemoryStorageService: memStorage}
+	racing.race = func(m *MemoryStorageService) {
+		var err error
+		claimA, err = ClaimExternalEntityCreation(context.Background(), m, s.logger, "entity123", "servicenow_incident", "ownerA", testLeaseOptions)
+		s.Require().NoError(err)
+
+		// A creates its ticket while B waits
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			CreateOrUpdateExternalEntityMapping(context.Background(), m, s.logger, ExternalEntityRecord{
+				InternalEntityID: "entity123",
+				ExternalEntityID: "sysA",
+				ExternalSystemID: "servicenow_incident",
+			})
+		}()
+	}
+
+	opts := testLeaseOptions
+	opts.WaitTimeout = time.Second
+	claimB, err := ClaimExternalEntityCreation(context.Background(), racing, s.logger, "entity123", "servicenow_incident", "ownerB", opts)
+	s.Require().NoError(err)
+	s.Require().NotNil(claimA)
+	s.True(claimA.Acquired, "A's lease landed first")
+	s.False(claimB.Acquired, "B's lease write must be rejected, as the record changed after B read it")
+	s.Equal("sysA", claimB.Record.ExternalEntityID, "B should return the winner's ticket")
+}
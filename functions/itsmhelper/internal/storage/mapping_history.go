@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// MaxMappingHistory is the maximum number of earlier tickets kept in the history of a mapping
+const MaxMappingHistory = 50
+
+// ReplaceExternalEntityMapping stores a mapping between internal and external entities, replacing any previous
+// mapping for the same internal entity and external system. When the entity was mapped to another ticket, that
+// ticket is appended to the history of the mapping with the given reason.
+//
+// Only the ticket, and the entity type and ticket state when set, are taken from record; the revision and the
+// history are carried over from the previous mapping. The state and attachments of the previous ticket are
+// kept while the ticket stays the same and dropped when it changes. The creation lease is taken from record, so
+// storing a ticket clears it.
+//
+// The history is kept per external system, so an entity that moves to a ticket of another system, e.g. from
+// an incident to a SIR incident, gets a separate mapping. RecordExternalSystemMove records the move in the
+// history of the mapping it left.
+func ReplaceExternalEntityMapping(ctx context.Context, storageService StorageService, logger *slog.Logger, record ExternalEntityRecord, reason string) error {
+	_, err := UpdateExternalEntityMapping(ctx, storageService, logger, record.InternalEntityID, record.ExternalSystemID, func(current *ExternalEntityRecord) error {
+		now := timeNow().UnixMilli()
+
+		// The history is copied so that appending never writes into the record that was read
+		history := slices.Clone(current.History)
+		mappedAt := current.MappedAt
+		if current.ExternalEntityID != record.ExternalEntityID {
+			if current.ExternalEntityID != "" {
+				history = append(history, MappingHistoryEntry{
+					ExternalEntityID:        current.ExternalEntityID,
+					ExternalLastKnownStatus: current.ExternalLastKnownStatus,
+					MappedAt:                current.MappedAt,
+					ReplacedAt:              now,
+					Reason:                  reason,
+				})
+				logger.Info("replacing entity mapping",
+					"internal_id", record.InternalEntityID,
+					"system_id", record.ExternalSystemID,
+					"previous_external_id", current.ExternalEntityID,
+					"external_id", record.ExternalEntityID,
+					"reason", reason)
+			}
+			mappedAt = now
+		}
+		if mappedAt == 0 {
+			mappedAt = now
+		}
+
+		history, dropped := compactMappingHistory(history, current.HistoryDropped)
+
+		// State and attachments belong to the ticket, so they don't carry over to another one
+		if current.ExternalEntityID != record.ExternalEntityID {
+			current.ExternalLastKnownStatus = ""
+			current.ExternalLastUpdateTime = 0
+			current.Attachments = nil
+		}
+
+		current.ExternalEntityID = record.ExternalEntityID
+		if record.InternalEntityType != "" {
+			current.InternalEntityType = record.InternalEntityType
+		}
+		if record.ExternalLastKnownStatus != "" {
+			current.ExternalLastKnownStatus = record.ExternalLastKnownStatus
+		}
+		if record.ExternalLastUpdateTime != 0 {
+			current.ExternalLastUpdateTime = record.ExternalLastUpdateTime
+		}
+		current.LeaseOwner = record.LeaseOwner
+		current.LeaseExpiresAt = record.LeaseExpiresAt
+		current.MappedAt = mappedAt
+		current.History = history
+		current.HistoryDropped = dropped
+		return nil
+	})
+	return err
+}
+
+// errNoMappingToMove stops RecordExternalSystemMove from writing when there is no mapping to record the move in
+var errNoMappingToMove = errors.New("no mapping to record the move in")
+
+// RecordExternalSystemMove records that an internal entity was mapped to a ticket of another external system, e.g.
+// that an entity tracked as an incident was moved to a SIR incident. An entry pointing at the system and ticket of
+// to is appended to the history of the entity's mapping for fromSystemID, which is otherwise left unchanged.
+// Nothing is recorded when the entity has no mapping for fromSystemID, or when the move is already its latest entry,
+// so that repeating a move does not add it twice. Reports whether the move was recorded.
+func RecordExternalSystemMove(ctx context.Context, storageService StorageService, logger *slog.Logger, fromSystemID string, to ExternalEntityRecord, reason string) (bool, error) {
+	if fromSystemID == to.ExternalSystemID {
+		return false, fmt.Errorf("a move must change the external system, both are %s", fromSystemID)
+	}
+
+	exists, _, err := CheckExternalEntityExists(ctx, storageService, logger, to.InternalEntityID, fromSystemID)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	_, err = UpdateExternalEntityMapping(ctx, storageService, logger, to.InternalEntityID, fromSystemID, func(current *ExternalEntityRecord) error {
+		// The mapping may have been removed or turned into a creation lease since it was checked
+		if current.IsPending() {
+			return errNoMappingToMove
+		}
+		if n := len(current.History); n > 0 {
+			last := current.History[n-1]
+			if last.ExternalSystemID == to.ExternalSystemID && last.ExternalEntityID == to.ExternalEntityID {
+				return errNoMappingToMove
+			}
+		}
+
+		history := append(slices.Clone(current.History), MappingHistoryEntry{
+			ExternalEntityID: to.ExternalEntityID,
+			ExternalSystemID: to.ExternalSystemID,
+			MappedAt:         timeNow().UnixMilli(),
+			Reason:           reason,
+		})
+		current.History, current.HistoryDropped = compactMappingHistory(history, current.HistoryDropped)
+		return nil
+	})
+	if errors.Is(err, errNoMappingToMove) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	logger.Info("recorded move to another external system",
+		"internal_id", to.InternalEntityID,
+		"system_id", fromSystemID,
+		"to_system_id", to.ExternalSystemID,
+		"to_external_id", to.ExternalEntityID,
+		"reason", reason)
+	return true, nil
+}
+
+// compactMappingHistory keeps a history within MaxMappingHistory entries. The first entry, the ticket the entity
+// was originally mapped to, is kept along with the most recent ones; the entries in between are dropped and
+// counted in dropped.
+func compactMappingHistory(history []MappingHistoryEntry, dropped int) ([]MappingHistoryEntry, int) {
+	if len(history) <= MaxMappingHistory {
+		return history, dropped
+	}
+
+	excess := len(history) - MaxMappingHistory
+	compacted := append([]MappingHistoryEntry{history[0]}, history[1+excess:]...)
+	return compacted, dropped + excess
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// TestReplaceExternalEntityMapping tests that replaced tickets are kept in the mapping history
+func (s *StorageTestSuite) TestReplaceExternalEntityMapping() {
+	originalTimeNow := timeNow
+	defer func() { timeNow = originalTimeNow }()
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return start }
+
+	memStorage := NewMemoryStorageService()
+	replace := func(externalEntityID, status, reason string) *ExternalEntityRecord {
+		err := ReplaceExternalEntityMapping(context.Background(), memStorage, s.logger, ExternalEntityRecord{
+			InternalEntityID:        "alert1",
+			ExternalEntityID:        externalEntityID,
+			ExternalSystemID:        "servicenow_incident",
+			ExternalLastKnownStatus: status,
+		}, reason)
+		s.Require().NoError(err)
+
+		exists, record, err := CheckExternalEntityExists(context.Background(), memStorage, s.logger, "alert1", "servicenow_incident")
+		s.Require().NoError(err)
+		s.Require().True(exists)
+		return record
+	}
+
+	record := replace("INC001", "1", "")
+	s.Equal(start.UnixMilli(), record.MappedAt)
+	s.Empty(record.History)
+
+	// Writing the same ticket again updates it without adding to the history
+	timeNow = func() time.Time { return start.Add(time.Hour) }
+	record = replace("INC001", "7", "")
+	s.Equal(start.UnixMilli(), record.MappedAt)
+	s.Empty(record.History)
+
+	// A new ticket moves the previous one into the history
+	timeNow = func() time.Time { return start.Add(2 * time.Hour) }
+	record = replace("INC002", "1", "re-escalated")
+	s.Equal("INC002", record.ExternalEntityID)
+	s.Equal(start.Add(2*time.Hour).UnixMilli(), record.MappedAt)
+	s.Equal([]MappingHistoryEntry{{
+		ExternalEntityID:        "INC001",
+		ExternalLastKnownStatus: "7",
+		MappedAt:                start.UnixMilli(),
+		ReplacedAt:              start.Add(2 * time.Hour).UnixMilli(),
+		Reason:                  "re-escalated",
+	}}, record.History)
+
+	// CreateOrUpdateExternalEntityMapping keeps the history as well
+	err := CreateOrUpdateExternalEntityMapping(context.Background(), memStorage, s.logger, ExternalEntityRecord{
+		InternalEntityID: "alert1",
+		ExternalEntityID: "INC003",
+		ExternalSystemID: "servicenow_incident",
+	})
+	s.Require().NoError(err)
+	_, record, err = CheckExternalEntityExists(context.Background(), memStorage, s.logger, "alert1", "servicenow_incident")
+	s.Require().NoError(err)
+	s.Require().Len(record.History, 2)
+	s.Equal("INC002", record.History[1].ExternalEntityID)
+	s.Empty(record.History[1].Reason)
+}
+
+// TestReplaceExternalEntityMappingKeepsFields tests that replacing a mapping only takes the ticket from the record
+func (s *StorageTestSuite) TestReplaceExternalEntityMappingKeepsFields() {
+	ctx := context.Background()
+	memStorage := NewMemoryStorageService()
+	s.Require().NoError(ReplaceExternalEntityMapping(ctx, memStorage, s.logger, ExternalEntityRecord{
+		InternalEntityID:        "alert1",
+		InternalEntityType:      "alert",
+		ExternalEntityID:        "INC001",
+		ExternalSystemID:        "servicenow_incident",
+		ExternalLastKnownStatus: "2",
+		ExternalLastUpdateTime:  1714564800,
+	}, ""))
+	_, err := UpdateExternalEntityMapping(ctx, memStorage, s.logger, "alert1", "servicenow_incident", func(record *ExternalEntityRecord) error {
+		record.Attachments = append(record.Attachments, AttachmentRecord{ContentHash: "hash1", AttachmentID: "att1"})
+		return nil
+	})
+	s.Require().NoError(err)
+
+	// The same ticket sent again without a type or state keeps everything stored for it
+	s.Require().NoError(ReplaceExternalEntityMapping(ctx, memStorage, s.logger, ExternalEntityRecord{
+		InternalEntityID: "alert1",
+		ExternalEntityID: "INC001",
+		ExternalSystemID: "servicenow_incident",
+	}, ""))
+	_, record, err := CheckExternalEntityExists(ctx, memStorage, s.logger, "alert1", "servicenow_incident")
+	s.Require().NoError(err)
+	s.Equal("alert", record.InternalEntityType)
+	s.Equal("2", record.ExternalLastKnownStatus)
+	s.Equal(int64(1714564800), record.ExternalLastUpdateTime)
+	s.Equal([]AttachmentRecord{{ContentHash: "hash1", AttachmentID: "att1"}}, record.Attachments)
+	s.Equal(int64(3), record.Revision)
+
+	// A new ticket keeps the entity type but not the state and attachments of the previous ticket
+	s.Require().NoError(ReplaceExternalEntityMapping(ctx, memStorage, s.logger, ExternalEntityRecord{
+		InternalEntityID: "alert1",
+		ExternalEntityID: "INC002",
+		ExternalSystemID: "servicenow_incident",
+	}, "reopened"))
+	_, record, err = CheckExternalEntityExists(ctx, memStorage, s.logger, "alert1", "servicenow_incident")
+	s.Require().NoError(err)
+	s.Equal("INC002", record.ExternalEntityID)
+	s.Equal("alert", record.InternalEntityType)
+	s.Empty(record.ExternalLastKnownStatus)
+	s.Zero(record.ExternalLastUpdateTime)
+	s.Empty(record.Attachments)
+	s.Equal(int64(4), record.Revision)
+	s.Require().Len(record.History, 1)
+	s.Equal("2", record.History[0].ExternalLastKnownStatus)
+}
+
+// TestMappingHistoryCompaction tests that the mapping history is capped at MaxMappingHistory entries
+func (s *StorageTestSuite) TestMappingHistoryCompaction() {
+	memStorage := NewMemoryStorageService()
+	for i := 0; i <= MaxMappingHistory+5; i++ {
+		err := ReplaceExternalEntityMapping(context.Background(), memStorage, s.logger, ExternalEntityRecord{
+			InternalEntityID: "alert1",
+			ExternalEntityID: fmt.Sprintf("INC%03d", i),
+			ExternalSystemID: "servicenow_incident",
+		}, "reopened")
+		s.Require().NoError(err)
+	}
+
+	_, record, err := CheckExternalEntityExists(context.Background(), memStorage, s.logger, "alert1", "servicenow_incident")
+	s.Require().NoError(err)
+	s.Equal(fmt.Sprintf("INC%03d", MaxMappingHistory+5), record.ExternalEntityID)
+	s.Len(record.History, MaxMappingHistory)
+	s.Equal(5, record.HistoryDropped)
+
+	// The original ticket and the most recent ones are kept
+	s.Equal("INC000", record.History[0].ExternalEntityID)
+	s.Equal("INC006", record.History[1].ExternalEntityID)
+	s.Equal(fmt.Sprintf("INC%03d", MaxMappingHistory+4), record.History[MaxMappingHistory-1].ExternalEntityID)
+}
+
+// TestRecordExternalSystemMove tests that moves to another external system are recorded in the mapping that was left
+func (s *StorageTestSuite) TestRecordExternalSystemMove() {
+	originalTimeNow := timeNow
+	defer func() { timeNow = originalTimeNow }()
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return start }
+
+	ctx := context.Background()
+	memStorage := NewMemoryStorageService()
+	sir := ExternalEntityRecord{InternalEntityID: "alert1", ExternalEntityID: "SIR001", ExternalSystemID: "servicenow_sir_incident"}
+
+	// Without an incident mapping there is nothing to record the move in, and none is created
+	recorded, err := RecordExternalSystemMove(ctx, memStorage, s.logger, "servicenow_incident", sir, "escalated")
+	s.Require().NoError(err)
+	s.False(recorded)
+	exists, _, err := CheckExternalEntityExists(ctx, memStorage, s.logger, "alert1", "servicenow_incident")
+	s.Require().NoError(err)
+	s.False(exists)
+
+	s.Require().NoError(CreateOrUpdateExternalEntityMapping(ctx, memStorage, s.logger, ExternalEntityRecord{
+		InternalEntityID: "alert1",
+		ExternalEntityID: "INC001",
+		ExternalSystemID: "servicenow_incident",
+	}))
+
+	timeNow = func() time.Time { return start.Add(time.Hour) }
+	recorded, err = RecordExternalSystemMove(ctx, memStorage, s.logger, "servicenow_incident", sir, "escalated")
+	s.Require().NoError(err)
+	s.True(recorded)
+
+	recorded, err = RecordExternalSystemMove(ctx, memStorage, s.logger, "servicenow_incident", sir, "escalated")
+	s.Require().NoError(err)
+	s.False(recorded, "the same move should not be recorded twice")
+
+	_, record, err := CheckExternalEntityExists(ctx, memStorage, s.logger, "alert1", "servicenow_incident")
+	s.Require().NoError(err)
+	s.Equal("INC001", record.ExternalEntityID)
+	s.Equal(start.UnixMilli(), record.MappedAt)
+	s.Equal([]MappingHistoryEntry{{
+		ExternalEntityID: "SIR001",
+		ExternalSystemID: "servicenow_sir_incident",
+		MappedAt:         start.Add(time.Hour).UnixMilli(),
+		Reason:           "escalated",
+	}}, record.History)
+
+	_, err = RecordExternalSystemMove(ctx, memStorage, s.logger, "servicenow_sir_incident", sir, "")
+	s.Error(err, "a move must change the external system")
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+	"github.com/go-openapi/runtime"
+	"github.com/go-openapi/strfmt"
+)
+
+// MemoryStorageService is a concurrency-safe in-memory implementation of the object methods of the
+// custom storage API for testing. PutObject is last-writer-wins, like custom storage itself, while
+// PutObjectByVersion honours revision preconditions.
+// Methods that are not overridden fall through to MockStorageService.
+type MemoryStorageService struct {
+	*MockStorageService
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	modified map[string]time.Time
+}
+
+// NewMemoryStorageService creates an empty MemoryStorageService
+func NewMemoryStorageService() *MemoryStorageService {
+	return &MemoryStorageService{
+		MockStorageService: &MockStorageService{},
+		objects:            make(map[string][]byte),
+		modified:           make(map[string]time.Time),
+	}
+}
+
+// GetObject implements the GetObject method, returning a 404 API error for unknown keys
+func (m *MemoryStorageService) GetObject(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+	m.mu.Lock()
+	data, ok := m.objects[memoryObjectKey(params.CollectionName, params.ObjectKey)]
+	m.mu.Unlock()
+
+	if !ok {
+		return nil, runtime.NewAPIError("GetObject", nil, http.StatusNotFound)
+	}
+
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+
+	return &custom_storage.GetObjectOK{}, nil
+}
+
+// PutObject implements the PutObject method
+func (m *MemoryStorageService) PutObject(params *custom_storage.PutObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.PutObjectOK, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.objects[memoryObjectKey(params.CollectionName, params.ObjectKey)] = data
+	m.modified[memoryObjectKey(params.CollectionName, params.ObjectKey)] = timeNow()
+	m.mu.Unlock()
+
+	return &custom_storage.PutObjectOK{}, nil
+}
+
+// GetVersionedObject implements the GetVersionedObject method. Objects are not kept per collection version.
+func (m *MemoryStorageService) GetVersionedObject(params *custom_storage.GetVersionedObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetVersionedObjectOK, error) {
+	if _, err := m.GetObject(&custom_storage.GetObjectParams{
+		CollectionName: params.CollectionName,
+		ObjectKey:      params.ObjectKey,
+		Context:        params.Context,
+	}, writer, opts...); err != nil {
+		return nil, err
+	}
+	return &custom_storage.GetVersionedObjectOK{Payload: writer}, nil
+}
+
+// PutObjectByVersion implements the PutObjectByVersion method. The If-Match and If-None-Match preconditions set
+// through opts are checked against the revision of the stored object atomically with the write, and a failed
+// precondition is answered with a 412 API error.
+func (m *MemoryStorageService) PutObjectByVersion(params *custom_storage.PutObjectByVersionParams, opts ...custom_storage.ClientOption) (*custom_storage.PutObjectByVersionOK, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	headers := requestHeaders(opts)
+	key := memoryObjectKey(params.CollectionName, params.ObjectKey)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, exists := m.objects[key]
+	if !preconditionHolds(headers, stored, exists) {
+		return nil, runtime.NewAPIError("PutObjectByVersion", nil, http.StatusPreconditionFailed)
+	}
+
+	m.objects[key] = data
+	m.modified[key] = timeNow()
+
+	return &custom_storage.PutObjectByVersionOK{}, nil
+}
+
+// requestHeaders returns the headers that client options add to a request
+func requestHeaders(opts []custom_storage.ClientOption) http.Header {
+	op := &runtime.ClientOperation{}
+	for _, opt := range opts {
+		opt(op)
+	}
+
+	req := &runtime.TestClientRequest{Headers: make(http.Header)}
+	if op.Params != nil {
+		_ = op.Params.WriteToRequest(req, strfmt.Default)
+	}
+	return req.Headers
+}
+
+// preconditionHolds checks the If-Match and If-None-Match headers against the revision of a stored object
+func preconditionHolds(headers http.Header, stored []byte, exists bool) bool {
+	if headers.Get("If-None-Match") == "*" && exists {
+		return false
+	}
+
+	ifMatch := headers.Get("If-Match")
+	if ifMatch == "" {
+		return true
+	}
+	if !exists {
+		return false
+	}
+
+	var record struct {
+		Revision int64 `json:"revision"`
+	}
+	if err := json.Unmarshal(stored, &record); err != nil {
+		return false
+	}
+	return ifMatch == revisionETag(record.Revision)
+}
+
+// DeleteObject implements the DeleteObject method, returning a 404 API error for unknown keys
+func (m *MemoryStorageService) DeleteObject(params *custom_storage.DeleteObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.DeleteObjectOK, error) {
+	key := memoryObjectKey(params.CollectionName, params.ObjectKey)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.objects[key]; !ok {
+		return nil, runtime.NewAPIError("DeleteObject", nil, http.StatusNotFound)
+	}
+	delete(m.objects, key)
+	delete(m.modified, key)
+
+	return &custom_storage.DeleteObjectOK{}, nil
+}
+
+// GetObjectMetadata implements the GetObjectMetadata method, reporting the time of the last write
+func (m *MemoryStorageService) GetObjectMetadata(params *custom_storage.GetObjectMetadataParams, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectMetadataOK, error) {
+	m.mu.Lock()
+	modified, ok := m.modified[memoryObjectKey(params.CollectionName, params.ObjectKey)]
+	m.mu.Unlock()
+
+	if !ok {
+		return nil, runtime.NewAPIError("GetObjectMetadata", nil, http.StatusNotFound)
+	}
+
+	return &custom_storage.GetObjectMetadataOK{
+		Payload: &models.CustomStorageResponse{
+			Resources: []*models.APIObjectMetadata{{
+				CollectionName:   &params.CollectionName,
+				ObjectKey:        &params.ObjectKey,
+				LastModifiedTime: strfmt.DateTime(modified),
+			}},
+		},
+	}, nil
+}
+
+// ListObjects implements the ListObjects method, listing keys in order after the start key
+func (m *MemoryStorageService) ListObjects(params *custom_storage.ListObjectsParams, opts ...custom_storage.ClientOption) (*custom_storage.ListObjectsOK, error) {
+	prefix := memoryObjectKey(params.CollectionName, "")
+
+	m.mu.Lock()
+	var keys []string
+	for key := range m.objects {
+		if objectKey, ok := strings.CutPrefix(key, prefix); ok && objectKey > params.Start {
+			keys = append(keys, objectKey)
+		}
+	}
+	m.mu.Unlock()
+
+	slices.Sort(keys)
+	if params.Limit > 0 && int64(len(keys)) > params.Limit {
+		keys = keys[:params.Limit]
+	}
+
+	return &custom_storage.ListObjectsOK{
+		Payload: &models.CustomStorageObjectKeys{Resources: keys},
+	}, nil
+}
+
+// Object returns the stored bytes for a key, for assertions in tests
+func (m *MemoryStorageService) Object(collectionName, objectKey string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.objects[memoryObjectKey(collectionName, objectKey)]
+	return data, ok
+}
+
+func memoryObjectKey(collectionName, objectKey string) string {
+	return collectionName + "/" + objectKey
+}
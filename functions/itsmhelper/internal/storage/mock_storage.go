@@ -2,8 +2,10 @@ package storage
 
 import (
 	"io"
+	"net/http"
 
 	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+	"github.com/crowdstrike/gofalcon/falcon/models"
 	"github.com/go-openapi/runtime"
 )
 
@@ -23,12 +25,12 @@ type MockStorageService struct {
 	SearchObjectsByVersionFunc     func(*custom_storage.SearchObjectsByVersionParams, ...custom_storage.ClientOption) (*custom_storage.SearchObjectsByVersionOK, error)
 }
 
-// GetObject implements the GetObject method for the mock
+// GetObject implements the GetObject method for the mock, behaving like an empty collection by default
 func (m *MockStorageService) GetObject(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
 	if m.GetObjectFunc != nil {
 		return m.GetObjectFunc(params, writer, opts...)
 	}
-	return nil, nil
+	return nil, runtime.NewAPIError("GetObject", nil, http.StatusNotFound)
 }
 
 // PutObject implements the PutObject method for the mock
@@ -39,8 +41,12 @@ func (m *MockStorageService) PutObject(params *custom_storage.PutObjectParams, o
 	return nil, nil
 }
 
+// DeleteObject implements the DeleteObject method for the mock
 func (m *MockStorageService) DeleteObject(params *custom_storage.DeleteObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.DeleteObjectOK, error) {
-	panic("not implemented")
+	if m.DeleteFunc != nil {
+		return m.DeleteFunc(params, opts...)
+	}
+	return nil, nil
 }
 
 func (m *MockStorageService) DeleteVersionedObject(params *custom_storage.DeleteVersionedObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.DeleteVersionedObjectOK, error) {
@@ -55,8 +61,12 @@ func (m *MockStorageService) DescribeCollections(params *custom_storage.Describe
 	panic("not implemented")
 }
 
+// GetObjectMetadata implements the GetObjectMetadata method for the mock, behaving like an empty collection by default
 func (m *MockStorageService) GetObjectMetadata(params *custom_storage.GetObjectMetadataParams, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectMetadataOK, error) {
-	panic("not implemented")
+	if m.MetadataFunc != nil {
+		return m.MetadataFunc(params, opts...)
+	}
+	return nil, runtime.NewAPIError("GetObjectMetadata", nil, http.StatusNotFound)
 }
 
 func (m *MockStorageService) GetSchema(params *custom_storage.GetSchemaParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetSchemaOK, error) {
@@ -67,8 +77,19 @@ func (m *MockStorageService) GetSchemaMetadata(params *custom_storage.GetSchemaM
 	panic("not implemented")
 }
 
+// GetVersionedObject implements the GetVersionedObject method for the mock, reading through GetObject by default
 func (m *MockStorageService) GetVersionedObject(params *custom_storage.GetVersionedObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetVersionedObjectOK, error) {
-	panic("not implemented")
+	if m.GetVersionedObjectFunc != nil {
+		return m.GetVersionedObjectFunc(params, writer, opts...)
+	}
+	if _, err := m.GetObject(&custom_storage.GetObjectParams{
+		CollectionName: params.CollectionName,
+		ObjectKey:      params.ObjectKey,
+		Context:        params.Context,
+	}, writer, opts...); err != nil {
+		return nil, err
+	}
+	return &custom_storage.GetVersionedObjectOK{Payload: writer}, nil
 }
 
 func (m *MockStorageService) GetVersionedObjectMetadata(params *custom_storage.GetVersionedObjectMetadataParams, opts ...custom_storage.ClientOption) (*custom_storage.GetVersionedObjectMetadataOK, error) {
@@ -79,8 +100,12 @@ func (m *MockStorageService) ListCollections(params *custom_storage.ListCollecti
 	panic("not implemented")
 }
 
+// ListObjects implements the ListObjects method for the mock, behaving like an empty collection by default
 func (m *MockStorageService) ListObjects(params *custom_storage.ListObjectsParams, opts ...custom_storage.ClientOption) (*custom_storage.ListObjectsOK, error) {
-	panic("not implemented")
+	if m.ListObjectsFunc != nil {
+		return m.ListObjectsFunc(params, opts...)
+	}
+	return &custom_storage.ListObjectsOK{Payload: &models.CustomStorageObjectKeys{}}, nil
 }
 
 func (m *MockStorageService) ListObjectsByVersion(params *custom_storage.ListObjectsByVersionParams, opts ...custom_storage.ClientOption) (*custom_storage.ListObjectsByVersionOK, error) {
@@ -91,12 +116,29 @@ func (m *MockStorageService) ListSchemas(params *custom_storage.ListSchemasParam
 	panic("not implemented")
 }
 
+// PutObjectByVersion implements the PutObjectByVersion method for the mock, writing through PutObject by default
+// without checking preconditions
 func (m *MockStorageService) PutObjectByVersion(params *custom_storage.PutObjectByVersionParams, opts ...custom_storage.ClientOption) (*custom_storage.PutObjectByVersionOK, error) {
-	panic("not implemented")
+	if m.PutObjectByVersionFunc != nil {
+		return m.PutObjectByVersionFunc(params, opts...)
+	}
+	if _, err := m.PutObject(&custom_storage.PutObjectParams{
+		CollectionName: params.CollectionName,
+		ObjectKey:      params.ObjectKey,
+		Body:           params.Body,
+		Context:        params.Context,
+	}, opts...); err != nil {
+		return nil, err
+	}
+	return &custom_storage.PutObjectByVersionOK{}, nil
 }
 
+// SearchObjects implements the SearchObjects method for the mock, finding nothing by default
 func (m *MockStorageService) SearchObjects(params *custom_storage.SearchObjectsParams, opts ...custom_storage.ClientOption) (*custom_storage.SearchObjectsOK, error) {
-	panic("not implemented")
+	if m.SearchObjectsFunc != nil {
+		return m.SearchObjectsFunc(params, opts...)
+	}
+	return &custom_storage.SearchObjectsOK{Payload: &models.CustomStorageResponse{}}, nil
 }
 
 func (m *MockStorageService) SearchObjectsByVersion(params *custom_storage.SearchObjectsByVersionParams, opts ...custom_storage.ClientOption) (*custom_storage.SearchObjectsByVersionOK, error) {
@@ -1,14 +1,87 @@
 package storage
 
+import "time"
+
 // ExternalEntityRecord represents a mapping between internal entities and external ITSM system entities
 type ExternalEntityRecord struct {
 	InternalEntityID string `json:"internal_entity_id"`
+	// InternalEntityType is the kind of internal entity, e.g. "alert" or "incident"
+	InternalEntityType string `json:"internal_entity_type,omitempty"`
 
 	ExternalEntityID string `json:"external_entity_id"`
 	ExternalSystemID string `json:"external_system_id"`
+
+	ExternalLastKnownStatus string `json:"external_last_known_status,omitempty"`
+	ExternalLastUpdateTime  int64  `json:"external_last_update_time,omitempty"`
+
+	Attachments []AttachmentRecord `json:"attachments,omitempty"`
+
+	// LeaseOwner and LeaseExpiresAt (Unix milliseconds) are set while a ticket is being created
+	LeaseOwner     string `json:"lease_owner,omitempty"`
+	LeaseExpiresAt int64  `json:"lease_expires_at,omitempty"`
+
+	// Revision is incremented on every write and is the precondition of the next conditional write
+	Revision int64 `json:"revision,omitempty"`
+
+	// MappedAt is when the entity was mapped to ExternalEntityID (Unix milliseconds)
+	MappedAt int64 `json:"mapped_at,omitempty"`
+	// History holds the tickets the entity was mapped to before, oldest first
+	History []MappingHistoryEntry `json:"history,omitempty"`
+	// HistoryDropped is the number of entries removed from History to keep it within MaxMappingHistory
+	HistoryDropped int `json:"history_dropped,omitempty"`
+}
+
+// MappingHistoryEntry is a ticket an entity was mapped to before the mapping was pointed at another ticket,
+// or a ticket of another external system the entity was moved to
+type MappingHistoryEntry struct {
+	ExternalEntityID string `json:"external_entity_id"`
+	// ExternalSystemID is only set on moves, to the external system of the ticket the entity was moved to
+	ExternalSystemID        string `json:"external_system_id,omitempty"`
+	ExternalLastKnownStatus string `json:"external_last_known_status,omitempty"`
+	// MappedAt and ReplacedAt are when the entity was mapped to the ticket and to the next one (Unix milliseconds)
+	MappedAt   int64 `json:"mapped_at,omitempty"`
+	ReplacedAt int64 `json:"replaced_at"`
+	// Reason is why the mapping was replaced, e.g. "reopened" or "re-escalated"
+	Reason string `json:"reason,omitempty"`
+}
+
+// IsPending reports whether the record is a creation lease that has not been turned into a mapping yet
+func (r *ExternalEntityRecord) IsPending() bool {
+	return r.ExternalEntityID == ""
+}
+
+// belongsTo reports whether the record is the mapping of internalEntityID. Records without an internal entity ID
+// are assumed to belong to whoever reads them.
+func (r *ExternalEntityRecord) belongsTo(internalEntityID string) bool {
+	return r.InternalEntityID == "" || r.InternalEntityID == internalEntityID
+}
+
+// LeaseExpired reports whether the creation lease is no longer honoured at the given time
+func (r *ExternalEntityRecord) LeaseExpired(now time.Time) bool {
+	return now.UnixMilli() >= r.LeaseExpiresAt
+}
+
+// AttachmentRecord represents a file uploaded to the external ticket, keyed by a hash of its content
+type AttachmentRecord struct {
+	ContentHash  string `json:"content_hash"`
+	FileName     string `json:"file_name"`
+	AttachmentID string `json:"attachment_id"`
+	UploadedAt   int64  `json:"uploaded_at"`
+}
+
+// FindAttachment returns the attachment previously uploaded with the given content hash, if any
+func (r *ExternalEntityRecord) FindAttachment(contentHash string) (*AttachmentRecord, bool) {
+	for i := range r.Attachments {
+		if r.Attachments[i].ContentHash == contentHash {
+			return &r.Attachments[i], true
+		}
+	}
+
+	return nil, false
 }
 
-// TimeBucket represents time interval for time-based deduping
+// TimeBucket represents time interval for time-based deduping.
+// Besides the named values below, any window accepted by TimeBucket.Window can be used.
 type TimeBucket string
 
 const (
@@ -17,6 +90,27 @@ const (
 	TimeBucketThirtyMin TimeBucket = "30 minutes"
 )
 
+// ThrottleMode selects how the throttle window is applied
+type ThrottleMode string
+
+const (
+	// ThrottleModeFixed allows one call per epoch-aligned time bucket
+	ThrottleModeFixed ThrottleMode = "fixed"
+	// ThrottleModeSliding allows a call once the window has passed since the last allowed call
+	ThrottleModeSliding ThrottleMode = "sliding"
+)
+
 type DedupStoreRecord struct {
 	TimeBucket TimeBucket `json:"time_bucket"`
+	// Count is the number of calls seen in the window
+	Count int64 `json:"count,omitempty"`
+	// FirstSeenAt, LastSeenAt and LastAllowedAt are times of calls in the window (Unix milliseconds)
+	FirstSeenAt   int64 `json:"first_seen_at,omitempty"`
+	LastSeenAt    int64 `json:"last_seen_at,omitempty"`
+	LastAllowedAt int64 `json:"last_allowed_at,omitempty"`
+	// ExpiresAt is the end of the window, after which the record can be deleted (Unix milliseconds).
+	// It is not set for forever windows.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// KeyFields are the normalized fields the key of the record was computed from, if any
+	KeyFields map[string]string `json:"key_fields,omitempty"`
 }
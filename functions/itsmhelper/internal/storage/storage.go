@@ -4,15 +4,22 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+	"github.com/go-openapi/runtime"
+	"github.com/go-openapi/strfmt"
 )
 
 const (
@@ -20,85 +27,489 @@ const (
 	CollectionNameDedupStore      = "dedup_store"
 )
 
+// TrackedEntitiesCollectionVersion is the version of the tracked_entities collection schema
+// (collections/tracked_entities.json) that mappings are read and conditionally written at
+const TrackedEntitiesCollectionVersion = "v1"
+
 type StorageService interface {
 	GetObject(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error)
+	GetObjectMetadata(params *custom_storage.GetObjectMetadataParams, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectMetadataOK, error)
+	GetVersionedObject(params *custom_storage.GetVersionedObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetVersionedObjectOK, error)
+	ListObjects(params *custom_storage.ListObjectsParams, opts ...custom_storage.ClientOption) (*custom_storage.ListObjectsOK, error)
 	PutObject(params *custom_storage.PutObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.PutObjectOK, error)
+	PutObjectByVersion(params *custom_storage.PutObjectByVersionParams, opts ...custom_storage.ClientOption) (*custom_storage.PutObjectByVersionOK, error)
+	DeleteObject(params *custom_storage.DeleteObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.DeleteObjectOK, error)
+	SearchObjects(params *custom_storage.SearchObjectsParams, opts ...custom_storage.ClientOption) (*custom_storage.SearchObjectsOK, error)
 }
 
 // CheckThrottlingStore check if a combination of ids is already known.
 // Returns true if already exists, false if it doesn't
 func CheckThrottlingStore(ctx context.Context, storageService StorageService, logger *slog.Logger, internalEntityID, dedupObjType, dedupObjId, timeBucket string) (bool, error) {
+	result, err := Throttle(ctx, storageService, logger, ThrottleParams{
+		InternalEntityID: internalEntityID,
+		DedupObjType:     dedupObjType,
+		DedupObjID:       dedupObjId,
+		TimeBucket:       timeBucket,
+		Mode:             ThrottleModeFixed,
+		ReadLegacyKeys:   true,
+	})
+	if err != nil {
+		return false, err
+	}
+	return !result.Allowed, nil
+}
+
+// CheckSlidingThrottle checks whether an action for a combination of ids was already allowed within the
+// sliding window given by timeBucket. It is allowed only when at least the window has passed since the
+// last allowed call, in which case the time of this call is recorded.
+// Returns true if the action should be suppressed, false if it is allowed.
+func CheckSlidingThrottle(ctx context.Context, storageService StorageService, logger *slog.Logger, internalEntityID, dedupObjType, dedupObjId, timeBucket string) (bool, error) {
+	result, err := Throttle(ctx, storageService, logger, ThrottleParams{
+		InternalEntityID: internalEntityID,
+		DedupObjType:     dedupObjType,
+		DedupObjID:       dedupObjId,
+		TimeBucket:       timeBucket,
+		Mode:             ThrottleModeSliding,
+		ReadLegacyKeys:   true,
+	})
+	if err != nil {
+		return false, err
+	}
+	return !result.Allowed, nil
+}
+
+// ThrottleParams identifies a throttled action and how it is throttled
+type ThrottleParams struct {
+	InternalEntityID string
+	DedupObjType     string
+	DedupObjID       string
+	// KeyFields identify the action instead of InternalEntityID, DedupObjType and DedupObjID when set
+	KeyFields  map[string]string
+	TimeBucket string
+	Mode       ThrottleMode
+	// MaxAllowed is the number of calls allowed per window. Values below 1 allow a single call.
+	MaxAllowed int
+	// Peek reports whether a call would be allowed without recording it
+	Peek bool
+	// ReadLegacyKeys looks up records under their md5 key when there is none under the current key,
+	// so that windows started before keys were changed to SHA-256 carry on
+	ReadLegacyKeys bool
+}
+
+// ThrottleResult is the outcome of a Throttle call
+type ThrottleResult struct {
+	Allowed bool
+	// Count is the number of calls seen in the current window, including this one unless peeking
+	Count int64
+	// Suppressed is the number of calls suppressed in the current window, including this one unless peeking
+	Suppressed int64
+	// Key is the dedup store key of the record the call was counted in
+	Key string
+}
+
+// Throttle counts a call for a combination of ids and reports whether it is allowed.
+// In fixed mode the window is the current epoch-aligned time bucket. In sliding mode the window starts
+// with the first call after the previous window ended, and its length is given by the time bucket.
+// The first MaxAllowed calls of a window are allowed, later ones are suppressed.
+// Like the rest of custom storage, counting is last-writer-wins, so concurrent calls may be undercounted.
+func Throttle(ctx context.Context, storageService StorageService, logger *slog.Logger, params ThrottleParams) (*ThrottleResult, error) {
 	// Convert timeBucket string to TimeBucket type
-	tb := TimeBucket(timeBucket)
+	tb := TimeBucket(params.TimeBucket)
 
-	// Validate timeBucket against supported enum values
-	if tb != TimeBucketForever && tb != TimeBucketFiveMin && tb != TimeBucketThirtyMin {
-		return false, fmt.Errorf("unsupported time bucket value: %s (must be one of: %s, %s, %s)",
-			timeBucket, TimeBucketForever, TimeBucketFiveMin, TimeBucketThirtyMin)
+	// Validate timeBucket against the supported windows
+	window, err := tb.Window()
+	if err != nil {
+		return nil, fmt.Errorf("unsupported time bucket value: %w", err)
 	}
 
-	// Calculate the current bucket
-	currentBucket, err := calculateTimeBucket(tb)
+	keyFields, err := NormalizeKeyFields(params.KeyFields)
 	if err != nil {
-		return false, fmt.Errorf("failed to calculate time bucket: %w", err)
+		return nil, err
 	}
+	params.KeyFields = keyFields
 
-	combined := strings.Join([]string{internalEntityID, dedupObjType, dedupObjId, currentBucket}, ":")
-	hasher := md5.New()
-	hasher.Write([]byte(combined))
-	dedupKey := hex.EncodeToString(hasher.Sum(nil))
+	parts, err := throttleKeyParts(params)
+	if err != nil {
+		return nil, err
+	}
+	dedupKey := createDedupKey(parts...)
+
+	buf := new(bytes.Buffer)
+	err = getDedupRecord(ctx, storageService, dedupKey, buf)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("failed to check dedup record: %w", err)
+	}
+
+	// Fall back to the md5 key the record may have been written under before the upgrade
+	legacyKey := ""
+	if errors.Is(err, ErrNotFound) && params.ReadLegacyKeys {
+		err = getDedupRecord(ctx, storageService, legacyDedupKey(parts...), buf)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("failed to check legacy dedup record: %w", err)
+		}
+		if err == nil {
+			legacyKey = legacyDedupKey(parts...)
+		}
+	}
+
+	now := timeNow()
+	record := DedupStoreRecord{TimeBucket: tb, KeyFields: keyFields}
+	if err == nil {
+		if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal dedup record: %w", err)
+		}
+		record.TimeBucket = tb
+		record.KeyFields = keyFields
+
+		// Records written before calls were counted stand for the single call that created them
+		if record.Count == 0 {
+			record.Count = 1
+		}
 
-	getCommand := &custom_storage.GetObjectParams{
+		// A sliding window ends once its length has passed since the first call; a forever window never ends
+		if params.Mode == ThrottleModeSliding && window > 0 {
+			windowStart := record.FirstSeenAt
+			if windowStart == 0 {
+				windowStart = record.LastAllowedAt
+			}
+			if now.Sub(time.UnixMilli(windowStart)) >= window {
+				record = DedupStoreRecord{TimeBucket: tb, KeyFields: keyFields}
+			}
+		}
+	}
+
+	if record.Count == 0 {
+		record.FirstSeenAt = now.UnixMilli()
+	}
+	record.Count++
+	record.LastSeenAt = now.UnixMilli()
+
+	maxAllowed := int64(max(params.MaxAllowed, 1))
+	result := &ThrottleResult{
+		Allowed:    record.Count <= maxAllowed,
+		Count:      record.Count,
+		Suppressed: max(record.Count-maxAllowed, 0),
+		Key:        dedupKey,
+	}
+
+	// Peeking reports the decision for a call now, but leaves the window as it is
+	if params.Peek {
+		result.Count--
+		result.Suppressed = max(result.Count-maxAllowed, 0)
+		return result, nil
+	}
+
+	if result.Allowed {
+		record.LastAllowedAt = now.UnixMilli()
+	}
+
+	// Records of forever windows never expire
+	if window > 0 {
+		if params.Mode == ThrottleModeSliding {
+			record.ExpiresAt = time.UnixMilli(record.FirstSeenAt).Add(window).UnixMilli()
+		} else {
+			record.ExpiresAt = bucketStart(now, window).Add(window).UnixMilli()
+		}
+	}
+
+	if err := putDedupRecord(ctx, storageService, logger, dedupKey, record); err != nil {
+		return nil, err
+	}
+
+	// The record now lives under the current key. A failure to delete the legacy one only leaves it
+	// for garbage collection, as the current key is looked up first.
+	if legacyKey != "" {
+		_, err := storageService.DeleteObject(&custom_storage.DeleteObjectParams{
+			CollectionName: CollectionNameDedupStore,
+			ObjectKey:      legacyKey,
+			Context:        ctx,
+		})
+		if err = newStorageError("DeleteObject", err); err != nil && !errors.Is(err, ErrNotFound) {
+			logger.Warn("failed to delete migrated legacy dedup record", "key", legacyKey, "error", err)
+		} else {
+			logger.Info("Migrated legacy dedup record", "legacy_key", legacyKey, "key", dedupKey)
+		}
+	}
+
+	return result, nil
+}
+
+// getDedupRecord reads the dedup record stored under key into buf
+func getDedupRecord(ctx context.Context, storageService StorageService, key string, buf *bytes.Buffer) error {
+	buf.Reset()
+	_, err := storageService.GetObject(&custom_storage.GetObjectParams{
 		CollectionName: CollectionNameDedupStore,
-		ObjectKey:      dedupKey,
+		ObjectKey:      key,
 		Context:        ctx,
+	}, buf)
+	return newStorageError("GetObject", err)
+}
+
+// ResetThrottle deletes the dedup records of the current window for a throttled action, in both
+// fixed and sliding mode, so the next call is allowed again. The mode of params is ignored.
+// Returns true if a record was deleted, false if there was nothing to reset.
+func ResetThrottle(ctx context.Context, storageService StorageService, logger *slog.Logger, params ThrottleParams) (bool, error) {
+	if _, err := TimeBucket(params.TimeBucket).Window(); err != nil {
+		return false, fmt.Errorf("unsupported time bucket value: %w", err)
 	}
 
-	buf := new(bytes.Buffer)
-	_, err = storageService.GetObject(getCommand, buf)
+	keyFields, err := NormalizeKeyFields(params.KeyFields)
 	if err != nil {
-		// Check if object doesn't exist
-		if strings.Contains(err.Error(), "status 404") {
-			// Record doesn't exist, create a new one
-			newDedupStoreRecord := DedupStoreRecord{TimeBucket: tb}
-			var uploadBuf bytes.Buffer
-			if err := json.NewEncoder(&uploadBuf).Encode(newDedupStoreRecord); err != nil {
-				logger.Error("failed to encode dedup record", "error", err)
-				return false, fmt.Errorf("failed to encode dedup record: %w", err)
-			}
+		return false, err
+	}
+	params.KeyFields = keyFields
 
-			_, err = storageService.PutObject(&custom_storage.PutObjectParams{
+	deleted := false
+	for _, mode := range []ThrottleMode{ThrottleModeFixed, ThrottleModeSliding} {
+		params.Mode = mode
+		parts, err := throttleKeyParts(params)
+		if err != nil {
+			return false, err
+		}
+
+		keys := []string{createDedupKey(parts...)}
+		if params.ReadLegacyKeys {
+			keys = append(keys, legacyDedupKey(parts...))
+		}
+
+		for _, dedupKey := range keys {
+			_, err = storageService.DeleteObject(&custom_storage.DeleteObjectParams{
 				CollectionName: CollectionNameDedupStore,
 				ObjectKey:      dedupKey,
-				Body:           io.NopCloser(&uploadBuf),
 				Context:        ctx,
 			})
+			err = newStorageError("DeleteObject", err)
 			if err != nil {
-				logger.Error("failed to store dedup record", "error", err)
-				return false, fmt.Errorf("failed to store dedup record: %w", err)
+				if errors.Is(err, ErrNotFound) {
+					continue
+				}
+				logger.Error("failed to delete dedup record", "error", err)
+				return false, fmt.Errorf("failed to delete dedup record: %w", err)
 			}
 
-			return false, nil
+			logger.Info("Reset throttle", "key", dedupKey, "internal_entity_id", params.InternalEntityID, "dedup_obj_type", params.DedupObjType, "dedup_obj_id", params.DedupObjID, "key_fields", keyFields, "time_bucket", params.TimeBucket, "mode", mode)
+			deleted = true
+		}
+	}
+
+	return deleted, nil
+}
+
+// ThrottleKey returns the dedup store key of the current window for a throttled action.
+// Key fields are expected to be normalized with NormalizeKeyFields.
+func ThrottleKey(params ThrottleParams) (string, error) {
+	parts, err := throttleKeyParts(params)
+	if err != nil {
+		return "", err
+	}
+	return createDedupKey(parts...), nil
+}
+
+// throttleKeyParts returns the parts identifying the record of the current window for a throttled action
+func throttleKeyParts(params ThrottleParams) ([]string, error) {
+	tb := TimeBucket(params.TimeBucket)
+
+	var bucket string
+	switch params.Mode {
+	case ThrottleModeFixed, "":
+		// Calculate the current bucket
+		currentBucket, err := calculateTimeBucket(tb)
+		if err != nil {
+			return nil, fmt.Errorf("failed to calculate time bucket: %w", err)
 		}
+		bucket = currentBucket
+	case ThrottleModeSliding:
+		window, err := tb.Window()
+		if err != nil {
+			return nil, fmt.Errorf("unsupported time bucket value: %w", err)
+		}
+		// The window is part of the key, so workflows using different windows don't reset each other
+		bucket = fmt.Sprintf("sliding_%s", window)
+	default:
+		return nil, fmt.Errorf("unsupported throttle mode: %s", params.Mode)
+	}
 
-		return false, fmt.Errorf("failed to check dedup record: %w", err)
+	if len(params.KeyFields) == 0 {
+		return []string{params.InternalEntityID, params.DedupObjType, params.DedupObjID, bucket}, nil
 	}
 
-	// Record exists, unmarshal for validation/logging if needed
-	var dedupStoreRecord DedupStoreRecord
-	if err := json.Unmarshal(buf.Bytes(), &dedupStoreRecord); err != nil {
-		return false, fmt.Errorf("failed to unmarshal dedup record: %w", err)
+	// Fields are hashed in order of their names, so callers may list them in any order
+	names := make([]string, 0, len(params.KeyFields))
+	for name := range params.KeyFields {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	// Record exists, return true
-	return true, nil
+	parts := []string{"key_fields"}
+	for _, name := range names {
+		parts = append(parts, name+"="+params.KeyFields[name])
+	}
+	return append(parts, bucket), nil
 }
 
+// MaxKeyFields is the maximum number of key fields of a throttled action
+const MaxKeyFields = 20
+
+// NormalizeKeyFields trims and case folds the names and values of key fields, so that e.g. "Host" and
+// " host " identify the same action. Names that are empty or only differ in case and whitespace are rejected.
+func NormalizeKeyFields(fields map[string]string) (map[string]string, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	if len(fields) > MaxKeyFields {
+		return nil, fmt.Errorf("invalid key_fields: at most %d key fields are allowed, got %d", MaxKeyFields, len(fields))
+	}
+
+	normalized := make(map[string]string, len(fields))
+	for name, value := range fields {
+		key := normalizeKeyField(name)
+		if key == "" {
+			return nil, errors.New("invalid key_fields: field names must not be empty")
+		}
+		if _, ok := normalized[key]; ok {
+			return nil, fmt.Errorf("invalid key_fields: field %q is given more than once", key)
+		}
+		normalized[key] = normalizeKeyField(value)
+	}
+
+	return normalized, nil
+}
+
+// normalizeKeyField trims and case folds a key field name or value
+func normalizeKeyField(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// createDedupKey hashes the parts identifying a dedup record into its object key
+func createDedupKey(parts ...string) string {
+	combined := strings.Join(parts, ":")
+	hasher := sha256.New()
+	hasher.Write([]byte(combined))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// legacyDedupKey returns the md5 key dedup records were stored under before createDedupKey used SHA-256.
+// It is only used to find records written before the upgrade.
+func legacyDedupKey(parts ...string) string {
+	combined := strings.Join(parts, ":")
+	hasher := md5.New()
+	hasher.Write([]byte(combined))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// putDedupRecord stores a record in the dedup store
+func putDedupRecord(ctx context.Context, storageService StorageService, logger *slog.Logger, dedupKey string, record DedupStoreRecord) error {
+	var uploadBuf bytes.Buffer
+	if err := json.NewEncoder(&uploadBuf).Encode(record); err != nil {
+		logger.Error("failed to encode dedup record", "error", err)
+		return fmt.Errorf("failed to encode dedup record: %w", err)
+	}
+
+	_, err := storageService.PutObject(&custom_storage.PutObjectParams{
+		CollectionName: CollectionNameDedupStore,
+		ObjectKey:      dedupKey,
+		Body:           io.NopCloser(&uploadBuf),
+		Context:        ctx,
+	})
+	err = newStorageError("PutObject", err)
+	if err != nil {
+		logger.Error("failed to store dedup record", "error", err)
+		return fmt.Errorf("failed to store dedup record: %w", err)
+	}
+
+	return nil
+}
+
+// MaxObjectKeyLength is the maximum length of a custom storage object key
+const MaxObjectKeyLength = 1000
+
+// hashedKeyMarker starts the entity part of tracked entity keys that are hashed. Escaped IDs never contain it,
+// as escapes are always followed by two hex digits.
+const hashedKeyMarker = ".H"
+
+// plainSystemIDPattern matches external system IDs that are used in keys as they are
+var plainSystemIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]*$`)
+
 // CreateTrackedEntityKey generates a unique key for tracked entities by combining
-// the external system ID and internal entity ID
+// the external system ID and internal entity ID.
+//
+// The key is "<external system ID>.<escaped internal entity ID>". Bytes of the internal entity ID other than
+// letters, digits, '_' and '-' are escaped as '.' followed by two hex digits, so different IDs always get
+// different keys and the IDs can be read back with parseTrackedEntityKey. Keys that would be longer than
+// MaxObjectKeyLength, or whose external system ID has other characters, end in a SHA-256 hash of both IDs instead.
 func CreateTrackedEntityKey(externalSystemID, internalEntityID string) (string, error) {
-	combined := fmt.Sprintf("%s.%s", externalSystemID, internalEntityID)
-	return sanitizeObjectKey(combined)
+	if plainSystemIDPattern.MatchString(externalSystemID) {
+		key := externalSystemID + "." + escapeKeyPart(internalEntityID)
+		if len(key) <= MaxObjectKeyLength {
+			return key, nil
+		}
+	}
+
+	prefix := ""
+	if plainSystemIDPattern.MatchString(externalSystemID) && len(externalSystemID) <= MaxObjectKeyLength/2 {
+		prefix = externalSystemID
+	}
+	sum := sha256.Sum256([]byte(externalSystemID + "\x00" + internalEntityID))
+	return prefix + "." + hashedKeyMarker + hex.EncodeToString(sum[:]), nil
+}
+
+// legacyTrackedEntityKey returns the key tracked entities were stored under before their IDs were escaped,
+// with every disallowed character replaced by '_'. ok is false when there was no legacy key.
+func legacyTrackedEntityKey(externalSystemID, internalEntityID string) (key string, ok bool) {
+	key, err := sanitizeObjectKey(fmt.Sprintf("%s.%s", externalSystemID, internalEntityID))
+	return key, err == nil
+}
+
+// parseTrackedEntityKey returns the IDs a tracked entity key was created from. Hashed keys can't be parsed.
+func parseTrackedEntityKey(key string) (externalSystemID, internalEntityID string, err error) {
+	externalSystemID, escaped, ok := strings.Cut(key, ".")
+	if !ok || !plainSystemIDPattern.MatchString(externalSystemID) {
+		return "", "", fmt.Errorf("invalid tracked entity key: %s", key)
+	}
+	if strings.HasPrefix(escaped, hashedKeyMarker) {
+		return "", "", fmt.Errorf("tracked entity key is hashed: %s", key)
+	}
+
+	internalEntityID, err = unescapeKeyPart(escaped)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid tracked entity key %s: %w", key, err)
+	}
+	return externalSystemID, internalEntityID, nil
+}
+
+// escapeKeyPart escapes every byte other than letters, digits, '_' and '-' as '.' followed by two hex digits
+func escapeKeyPart(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, ".%02X", c)
+	}
+	return b.String()
+}
+
+// unescapeKeyPart reverses escapeKeyPart
+func unescapeKeyPart(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '.' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("truncated escape at %d", i)
+		}
+		decoded, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil || strings.ToUpper(s[i+1:i+3]) != s[i+1:i+3] {
+			return "", fmt.Errorf("invalid escape %q at %d", s[i:i+3], i)
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
 }
 
 // CheckExternalEntityExists checks if an external entity mapping exists for the given internal entity ID
@@ -109,70 +520,349 @@ func CheckExternalEntityExists(ctx context.Context, storageService StorageServic
 		return false, nil, fmt.Errorf("failed to create tracked entity key: %w", err)
 	}
 
-	getCommand := &custom_storage.GetObjectParams{
-		CollectionName: CollectionNameTrackedEntities,
-		ObjectKey:      key,
-		Context:        ctx,
-	}
-
 	buf := new(bytes.Buffer)
-	_, err = storageService.GetObject(getCommand, buf)
+	found, err := getTrackedEntityObject(ctx, storageService, key, buf)
 	if err != nil {
-		if strings.Contains(err.Error(), "status 404") {
-			return false, nil, nil
-		}
-
 		return false, nil, fmt.Errorf("failed to check if external entity exists: %w", err)
 	}
 
+	// Mappings stored before keys were escaped are found under their sanitized key
+	if legacyKey, ok := legacyTrackedEntityKey(externalSystemID, internalEntityID); !found && ok && legacyKey != key {
+		found, err = getTrackedEntityObject(ctx, storageService, legacyKey, buf)
+		if err != nil {
+			return false, nil, fmt.Errorf("failed to check if external entity exists: %w", err)
+		}
+	}
+	if !found {
+		return false, nil, nil
+	}
+
 	var extRecord ExternalEntityRecord
 	if err := json.Unmarshal(buf.Bytes(), &extRecord); err != nil {
 		return true, nil, fmt.Errorf("failed to unmarshal external entity record: %w", err)
 	}
 
+	// Records of other internal entities can be found where a key is the legacy key of another entity
+	if !extRecord.belongsTo(internalEntityID) {
+		return false, nil, nil
+	}
+
 	// If externalSystemID is provided, check if it matches
 	if externalSystemID != "" && extRecord.ExternalSystemID != externalSystemID {
 		return false, nil, nil
 	}
 
+	// A pending creation lease does not map to a ticket yet
+	if extRecord.IsPending() {
+		return false, nil, nil
+	}
+
 	// Record exists, matches the external system ID (if provided), and was successfully unmarshaled
 	return true, &extRecord, nil
 }
 
-// CreateOrUpdateExternalEntityMapping stores a mapping between internal and external entities in custom storage
+// CreateOrUpdateExternalEntityMapping stores a mapping between internal and external entities in custom storage,
+// replacing any previous mapping for the same internal entity and external system.
+// A previously mapped ticket is kept in the history of the mapping.
 func CreateOrUpdateExternalEntityMapping(ctx context.Context, storageService StorageService, logger *slog.Logger, record ExternalEntityRecord) error {
-	// Store the mapping in the custom storage using the Upload method
+	return ReplaceExternalEntityMapping(ctx, storageService, logger, record, "")
+}
+
+// MaxMappingUpdateAttempts bounds how often UpdateExternalEntityMapping re-applies an update after a concurrent write
+const MaxMappingUpdateAttempts = 5
+
+// ErrMappingConflict is matched by MappingConflictError
+var ErrMappingConflict = fmt.Errorf("entity mapping was modified concurrently: %w", ErrConflict)
+
+// ErrTrackedEntityKeyInUse is matched by TrackedEntityKeyInUseError
+var ErrTrackedEntityKeyInUse = fmt.Errorf("tracked entity key holds the legacy mapping of another entity: %w", ErrConflict)
+
+// TrackedEntityKeyInUseError is returned when the key of an internal entity still holds the mapping another entity
+// was stored under before keys were escaped, e.g. the key of "a_b" holds the mapping of "a:b". The write is refused
+// so that the other mapping is not overwritten. Updating the other mapping moves it to its own key.
+type TrackedEntityKeyInUseError struct {
+	Key              string
+	InternalEntityID string
+	OwnerEntityID    string
+}
+
+func (e *TrackedEntityKeyInUseError) Error() string {
+	return fmt.Sprintf("key %s of entity %s holds the legacy mapping of entity %s, update that mapping to migrate it first",
+		e.Key, e.InternalEntityID, e.OwnerEntityID)
+}
+
+func (e *TrackedEntityKeyInUseError) Unwrap() error {
+	return ErrTrackedEntityKeyInUse
+}
+
+// MappingConflictError is returned when a mapping kept changing underneath an update until the retries ran out
+type MappingConflictError struct {
+	InternalEntityID string
+	ExternalSystemID string
+	Attempts         int
+}
+
+func (e *MappingConflictError) Error() string {
+	return fmt.Sprintf("entity mapping %s for %s was modified concurrently, gave up after %d attempts",
+		e.InternalEntityID, e.ExternalSystemID, e.Attempts)
+}
+
+func (e *MappingConflictError) Unwrap() error {
+	return ErrMappingConflict
+}
+
+// UpdateExternalEntityMapping applies update to the current mapping and stores the result as the next revision.
+// A record that does not exist yet is passed to update with only its IDs set.
+//
+// The mapping is read with its revision and written back on the condition that the stored revision is unchanged.
+// When another execution wrote the mapping in the meantime, the write is rejected with a conflict, and update is
+// re-applied on top of the newer record, up to MaxMappingUpdateAttempts times. update may therefore run more than
+// once and must be idempotent. When the retries run out, a *MappingConflictError is returned.
+func UpdateExternalEntityMapping(
+	ctx context.Context,
+	storageService StorageService,
+	logger *slog.Logger,
+	internalEntityID, externalSystemID string,
+	update func(record *ExternalEntityRecord) error,
+) (*ExternalEntityRecord, error) {
+	key, err := CreateTrackedEntityKey(externalSystemID, internalEntityID)
+	if err != nil {
+		logger.Error("failed to create tracked entity key", "error", err)
+		return nil, fmt.Errorf("error creating tracked entity key: %w", err)
+	}
+
+	for attempt := 1; attempt <= MaxMappingUpdateAttempts; attempt++ {
+		stored, current, legacyKey, err := readVersionedTrackedEntityRecord(ctx, storageService, key, internalEntityID, externalSystemID)
+		if err != nil {
+			return nil, err
+		}
+
+		record := ExternalEntityRecord{InternalEntityID: internalEntityID, ExternalSystemID: externalSystemID}
+		if current != nil {
+			record = *current
+		}
+
+		if err := update(&record); err != nil {
+			return nil, err
+		}
+		record.InternalEntityID = internalEntityID
+		record.ExternalSystemID = externalSystemID
+		record.Revision = stored.nextRevision()
+
+		err = putExternalEntityRecord(ctx, storageService, key, record, stored)
+		if errors.Is(err, ErrConflict) {
+			logger.Warn("entity mapping was modified concurrently, retrying",
+				"internal_id", internalEntityID, "system_id", externalSystemID, "attempt", attempt)
+			continue
+		}
+		if err != nil {
+			logger.Error("failed to upload entity mapping", "error", err)
+			return nil, fmt.Errorf("error storing entity mapping in collection: %w", err)
+		}
+
+		if legacyKey != "" {
+			deleteLegacyTrackedEntity(ctx, storageService, logger, legacyKey, key)
+		}
+
+		logger.Info("successfully stored entity mapping",
+			"internal_id", record.InternalEntityID,
+			"external_id", record.ExternalEntityID,
+			"system_id", record.ExternalSystemID,
+			"revision", record.Revision)
+
+		return &record, nil
+	}
+
+	return nil, &MappingConflictError{
+		InternalEntityID: internalEntityID,
+		ExternalSystemID: externalSystemID,
+		Attempts:         MaxMappingUpdateAttempts,
+	}
+}
+
+// readVersionedTrackedEntityRecord reads the record stored under the tracked entity key of an internal entity at
+// TrackedEntitiesCollectionVersion, for a conditional write to that key. stored is the record found under key,
+// which the write must expect. record is the mapping of the internal entity: stored when it exists, otherwise the
+// record found under the legacy sanitized key, in which case legacyKey is set. Both are nil when they do not exist.
+// When key holds the legacy mapping of another entity, a *TrackedEntityKeyInUseError is returned.
+func readVersionedTrackedEntityRecord(ctx context.Context, storageService StorageService, key, internalEntityID, externalSystemID string) (stored, record *ExternalEntityRecord, legacyKey string, err error) {
+	buf := new(bytes.Buffer)
+	_, err = storageService.GetVersionedObject(&custom_storage.GetVersionedObjectParams{
+		CollectionName:    CollectionNameTrackedEntities,
+		CollectionVersion: TrackedEntitiesCollectionVersion,
+		ObjectKey:         key,
+		Context:           ctx,
+	}, buf)
+	err = newStorageError("GetVersionedObject", err)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, nil, "", fmt.Errorf("failed to read external entity record: %w", err)
+	}
+
+	if err == nil {
+		stored = &ExternalEntityRecord{}
+		if err := json.Unmarshal(buf.Bytes(), stored); err != nil {
+			return nil, nil, "", fmt.Errorf("failed to unmarshal external entity record: %w", err)
+		}
+		// The key may be the legacy key of another entity, e.g. "a_b" for "a:b"
+		if !stored.belongsTo(internalEntityID) {
+			return nil, nil, "", &TrackedEntityKeyInUseError{Key: key, InternalEntityID: internalEntityID, OwnerEntityID: stored.InternalEntityID}
+		}
+		return stored, stored, "", nil
+	}
+
+	record, legacyKey, err = readLegacyTrackedEntityRecord(ctx, storageService, key, internalEntityID, externalSystemID)
+	return nil, record, legacyKey, err
+}
+
+// nextRevision returns the revision of the record written on top of r, where a nil r does not exist yet
+func (r *ExternalEntityRecord) nextRevision() int64 {
+	if r == nil {
+		return 1
+	}
+	return r.Revision + 1
+}
+
+// putExternalEntityRecord writes record under key at TrackedEntitiesCollectionVersion, on the condition that the
+// record stored under key is still expected (or that none exists when expected is nil). A write that lost to a
+// concurrent one fails with an error matching ErrConflict.
+func putExternalEntityRecord(ctx context.Context, storageService StorageService, key string, record ExternalEntityRecord, expected *ExternalEntityRecord) error {
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(record); err != nil {
-		logger.Error("failed to encode entity record", "error", err)
 		return fmt.Errorf("error encoding entity record: %w", err)
 	}
 
-	key, err := CreateTrackedEntityKey(record.ExternalSystemID, record.InternalEntityID)
+	_, err := storageService.PutObjectByVersion(&custom_storage.PutObjectByVersionParams{
+		CollectionName:    CollectionNameTrackedEntities,
+		CollectionVersion: TrackedEntitiesCollectionVersion,
+		ObjectKey:         key,
+		Body:              io.NopCloser(&buf),
+		Context:           ctx,
+	}, ifRevision(expected))
+	return newStorageError("PutObjectByVersion", err)
+}
+
+// ifRevision makes a write conditional on the revision of the stored record: If-Match carries the revision of
+// expected, and If-None-Match requires that no record exists when expected is nil. Custom storage rejects a
+// write whose precondition fails with 412 Precondition Failed.
+func ifRevision(expected *ExternalEntityRecord) custom_storage.ClientOption {
+	return func(op *runtime.ClientOperation) {
+		params := op.Params
+		op.Params = runtime.ClientRequestWriterFunc(func(req runtime.ClientRequest, reg strfmt.Registry) error {
+			var err error
+			if expected == nil {
+				err = req.SetHeaderParam("If-None-Match", "*")
+			} else {
+				err = req.SetHeaderParam("If-Match", revisionETag(expected.Revision))
+			}
+			if err != nil || params == nil {
+				return err
+			}
+			return params.WriteToRequest(req, reg)
+		})
+	}
+}
+
+// revisionETag returns the entity tag of a record revision
+func revisionETag(revision int64) string {
+	return `"` + strconv.FormatInt(revision, 10) + `"`
+}
+
+// readTrackedEntityRecord reads the tracked entity record of an internal entity, falling back to the sanitized key
+// it was stored under before keys were escaped. legacyKey is set when the record was found under that key.
+// Returns a nil record when it does not exist.
+func readTrackedEntityRecord(ctx context.Context, storageService StorageService, internalEntityID, externalSystemID string) (record *ExternalEntityRecord, legacyKey string, err error) {
+	key, err := CreateTrackedEntityKey(externalSystemID, internalEntityID)
 	if err != nil {
-		logger.Error("failed to create tracked entity key", "error", err)
-		return fmt.Errorf("error creating tracked entity key: %w", err)
+		return nil, "", fmt.Errorf("failed to create tracked entity key: %w", err)
+	}
+
+	record, err = readExternalEntityRecord(ctx, storageService, key)
+	if err != nil {
+		return nil, "", err
 	}
+	if record != nil {
+		// The key may be the legacy key of another entity, e.g. "a_b" for "a:b"
+		if !record.belongsTo(internalEntityID) {
+			return nil, "", nil
+		}
+		return record, "", nil
+	}
+
+	return readLegacyTrackedEntityRecord(ctx, storageService, key, internalEntityID, externalSystemID)
+}
 
-	_, err = storageService.PutObject(&custom_storage.PutObjectParams{
+// readLegacyTrackedEntityRecord reads the record of an internal entity stored under its legacy sanitized key,
+// for when nothing is stored under its current key. Returns a nil record when it does not exist.
+func readLegacyTrackedEntityRecord(ctx context.Context, storageService StorageService, key, internalEntityID, externalSystemID string) (*ExternalEntityRecord, string, error) {
+	legacyKey, ok := legacyTrackedEntityKey(externalSystemID, internalEntityID)
+	if !ok || legacyKey == key {
+		return nil, "", nil
+	}
+
+	record, err := readExternalEntityRecord(ctx, storageService, legacyKey)
+	// A sanitized key may be shared by several internal entities, e.g. "a:b" and "a_b"
+	if err != nil || record == nil || !record.belongsTo(internalEntityID) {
+		return nil, "", err
+	}
+	return record, legacyKey, nil
+}
+
+// deleteLegacyTrackedEntity deletes a record that was moved from its legacy key to key.
+// Failures are only logged, as the record under key takes precedence anyway.
+func deleteLegacyTrackedEntity(ctx context.Context, storageService StorageService, logger *slog.Logger, legacyKey, key string) {
+	_, err := storageService.DeleteObject(&custom_storage.DeleteObjectParams{
 		CollectionName: CollectionNameTrackedEntities,
-		ObjectKey:      key,
-		Body:           io.NopCloser(&buf),
+		ObjectKey:      legacyKey,
 		Context:        ctx,
 	})
+	if err = newStorageError("DeleteObject", err); err != nil && !errors.Is(err, ErrNotFound) {
+		logger.Warn("failed to delete migrated legacy entity mapping", "key", legacyKey, "error", err)
+		return
+	}
+	logger.Info("Migrated legacy entity mapping", "legacy_key", legacyKey, "key", key)
+}
+
+// getTrackedEntityObject reads the tracked entity object stored under key into buf, reporting whether it exists
+func getTrackedEntityObject(ctx context.Context, storageService StorageService, key string, buf *bytes.Buffer) (bool, error) {
+	buf.Reset()
+	_, err := storageService.GetObject(&custom_storage.GetObjectParams{
+		CollectionName: CollectionNameTrackedEntities,
+		ObjectKey:      key,
+		Context:        ctx,
+	}, buf)
+	err = newStorageError("GetObject", err)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// readExternalEntityRecord reads a tracked entity record, returning a nil record when it does not exist
+func readExternalEntityRecord(ctx context.Context, storageService StorageService, key string) (*ExternalEntityRecord, error) {
+	buf := new(bytes.Buffer)
+	_, err := storageService.GetObject(&custom_storage.GetObjectParams{
+		CollectionName: CollectionNameTrackedEntities,
+		ObjectKey:      key,
+		Context:        ctx,
+	}, buf)
+	err = newStorageError("GetObject", err)
 	if err != nil {
-		logger.Error("failed to upload entity mapping", "error", err)
-		return fmt.Errorf("error storing entity mapping in collection: %w", err)
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read external entity record: %w", err)
 	}
 
-	logger.Info("successfully stored entity mapping",
-		"internal_id", record.InternalEntityID,
-		"external_id", record.ExternalEntityID,
-		"system_id", record.ExternalSystemID)
+	var record ExternalEntityRecord
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal external entity record: %w", err)
+	}
 
-	return nil
+	return &record, nil
 }
 
+// sanitizeObjectKey replaces disallowed characters with '_'. It is how tracked entity keys were created before
+// IDs were escaped, and is only used to find records stored under such keys.
 func sanitizeObjectKey(input string) (string, error) {
 	// Replace disallowed characters with underscore
 	re := regexp.MustCompile("[^a-zA-Z0-9._-]")
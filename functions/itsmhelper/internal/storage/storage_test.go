@@ -1,16 +1,21 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
+	"net/http"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+	"github.com/go-openapi/runtime"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -46,18 +51,31 @@ func (s *StorageTestSuite) TestCreateTrackedEntityKey() {
 		},
 		{
 			name:             "With special characters",
+			externalSystemID: "servicenow_sir_incident",
+			internalEntityID: "entity@123.a:b",
+			expected:         "servicenow_sir_incident.entity.40123.2Ea.3Ab",
+			expectError:      false,
+		},
+		{
+			name:             "IDs that used to collide",
+			externalSystemID: "servicenow_incident",
+			internalEntityID: "a_b",
+			expected:         "servicenow_incident.a_b",
+			expectError:      false,
+		},
+		{
+			name:             "External system ID with special characters",
 			externalSystemID: "servicenow/sir",
-			internalEntityID: "entity@123",
-			expected:         "servicenow_sir.entity_123",
+			internalEntityID: "entity123",
+			expected:         "..H" + sha256Hex("servicenow/sir\x00entity123"),
 			expectError:      false,
 		},
 		{
 			name:             "Very long IDs",
 			externalSystemID: strings.Repeat("a", 500),
 			internalEntityID: strings.Repeat("b", 600),
-			expected:         "",
-			expectError:      true,
-			errorContains:    "exceeds maximum length",
+			expected:         strings.Repeat("a", 500) + "..H" + sha256Hex(strings.Repeat("a", 500)+"\x00"+strings.Repeat("b", 600)),
+			expectError:      false,
 		},
 	}
 
@@ -78,6 +96,148 @@ func (s *StorageTestSuite) TestCreateTrackedEntityKey() {
 	}
 }
 
+// TestParseTrackedEntityKey tests that tracked entity keys are unique and can be read back
+func (s *StorageTestSuite) TestParseTrackedEntityKey() {
+	ids := []string{"entity123", "a:b", "a_b", "a.b", "a.3Ab", "ind:1234:5678", "key-with-unicode-😀-emoji", "", ".H00"}
+	keys := map[string]string{}
+	for _, id := range ids {
+		key, err := CreateTrackedEntityKey("servicenow_incident", id)
+		s.Require().NoError(err)
+		s.Regexp(`^[a-zA-Z0-9._-]+$`, key)
+		s.NotContains(keys, key, "%q and %q share a key", id, keys[key])
+		keys[key] = id
+
+		externalSystemID, internalEntityID, err := parseTrackedEntityKey(key)
+		s.Require().NoError(err, id)
+		s.Equal("servicenow_incident", externalSystemID)
+		s.Equal(id, internalEntityID)
+	}
+
+	key, err := CreateTrackedEntityKey("servicenow_incident", strings.Repeat("b", 1000))
+	s.Require().NoError(err)
+	_, _, err = parseTrackedEntityKey(key)
+	s.ErrorContains(err, "tracked entity key is hashed")
+
+	for _, key := range []string{"no_separator", "servicenow_incident.a.3", "servicenow_incident.a.ZZ", "servicenow_incident.a.3a"} {
+		_, _, err = parseTrackedEntityKey(key)
+		s.Error(err, key)
+	}
+}
+
+// TestTrackedEntityLegacyKeys tests that mappings stored under sanitized keys are still found
+func (s *StorageTestSuite) TestTrackedEntityLegacyKeys() {
+	memStorage := NewMemoryStorageService()
+	putRecord := func(key string, record ExternalEntityRecord) {
+		data, err := json.Marshal(record)
+		s.Require().NoError(err)
+		_, err = memStorage.PutObject(&custom_storage.PutObjectParams{
+			CollectionName: CollectionNameTrackedEntities,
+			ObjectKey:      key,
+			Body:           io.NopCloser(bytes.NewReader(data)),
+		})
+		s.Require().NoError(err)
+	}
+
+	// Stored by an earlier version for the composite ID "ind:1234"
+	putRecord("servicenow_incident.ind_1234", ExternalEntityRecord{
+		InternalEntityID: "ind:1234",
+		ExternalEntityID: "INC001",
+		ExternalSystemID: "servicenow_incident",
+	})
+
+	exists, record, err := CheckExternalEntityExists(context.Background(), memStorage, s.logger, "ind:1234", "servicenow_incident")
+	s.Require().NoError(err)
+	s.True(exists)
+	s.Equal("INC001", record.ExternalEntityID)
+
+	// The legacy key is not shared with other entities that sanitize to it
+	exists, _, err = CheckExternalEntityExists(context.Background(), memStorage, s.logger, "ind.1234", "servicenow_incident")
+	s.Require().NoError(err)
+	s.False(exists)
+	exists, _, err = CheckExternalEntityExists(context.Background(), memStorage, s.logger, "ind_1234", "servicenow_incident")
+	s.Require().NoError(err)
+	s.False(exists, "the new key of ind_1234 is the legacy key of ind:1234, but the record belongs to ind:1234")
+
+	// An existing mapping is not claimed again
+	claim, err := ClaimExternalEntityCreation(context.Background(), memStorage, s.logger, "ind:1234", "servicenow_incident", "owner", LeaseOptions{})
+	s.Require().NoError(err)
+	s.False(claim.Acquired)
+	s.Equal("INC001", claim.Record.ExternalEntityID)
+
+	// Updating moves the mapping to its new key
+	updated, err := UpdateExternalEntityMapping(context.Background(), memStorage, s.logger, "ind:1234", "servicenow_incident", func(record *ExternalEntityRecord) error {
+		record.ExternalLastKnownStatus = "2"
+		return nil
+	})
+	s.Require().NoError(err)
+	s.Equal("INC001", updated.ExternalEntityID)
+	_, ok := memStorage.Object(CollectionNameTrackedEntities, "servicenow_incident.ind.3A1234")
+	s.True(ok)
+	_, ok = memStorage.Object(CollectionNameTrackedEntities, "servicenow_incident.ind_1234")
+	s.False(ok)
+}
+
+// TestTrackedEntityLegacyKeyCollision tests that the mapping of "a_b" does not overwrite the mapping of "a:b"
+// stored under its legacy key, which is the new key of "a_b"
+func (s *StorageTestSuite) TestTrackedEntityLegacyKeyCollision() {
+	ctx := context.Background()
+	memStorage := NewMemoryStorageService()
+
+	// Stored by an earlier version for "a:b"
+	data, err := json.Marshal(ExternalEntityRecord{InternalEntityID: "a:b", ExternalEntityID: "INC001", ExternalSystemID: "servicenow_incident"})
+	s.Require().NoError(err)
+	_, err = memStorage.PutObject(&custom_storage.PutObjectParams{
+		CollectionName: CollectionNameTrackedEntities,
+		ObjectKey:      "servicenow_incident.a_b",
+		Body:           io.NopCloser(bytes.NewReader(data)),
+	})
+	s.Require().NoError(err)
+
+	err = CreateOrUpdateExternalEntityMapping(ctx, memStorage, s.logger, ExternalEntityRecord{
+		InternalEntityID: "a_b",
+		ExternalEntityID: "INC002",
+		ExternalSystemID: "servicenow_incident",
+	})
+	var inUse *TrackedEntityKeyInUseError
+	s.Require().ErrorAs(err, &inUse)
+	s.Equal("a:b", inUse.OwnerEntityID)
+	s.ErrorIs(err, ErrConflict)
+
+	_, err = ClaimExternalEntityCreation(ctx, memStorage, s.logger, "a_b", "servicenow_incident", "owner", LeaseOptions{})
+	s.ErrorAs(err, &inUse, "a creation lease must not overwrite the legacy mapping either")
+
+	exists, record, err := CheckExternalEntityExists(ctx, memStorage, s.logger, "a:b", "servicenow_incident")
+	s.Require().NoError(err)
+	s.Require().True(exists)
+	s.Equal("INC001", record.ExternalEntityID, "the legacy mapping should be left intact")
+
+	// Once the mapping of "a:b" has been moved to its own key, "a_b" can be mapped
+	_, err = UpdateExternalEntityMapping(ctx, memStorage, s.logger, "a:b", "servicenow_incident", func(record *ExternalEntityRecord) error {
+		return nil
+	})
+	s.Require().NoError(err)
+
+	err = CreateOrUpdateExternalEntityMapping(ctx, memStorage, s.logger, ExternalEntityRecord{
+		InternalEntityID: "a_b",
+		ExternalEntityID: "INC002",
+		ExternalSystemID: "servicenow_incident",
+	})
+	s.Require().NoError(err)
+
+	for id, want := range map[string]string{"a:b": "INC001", "a_b": "INC002"} {
+		exists, record, err := CheckExternalEntityExists(ctx, memStorage, s.logger, id, "servicenow_incident")
+		s.Require().NoError(err, id)
+		s.Require().True(exists, id)
+		s.Equal(want, record.ExternalEntityID, id)
+	}
+}
+
+// sha256Hex returns the hex encoded SHA-256 hash of s
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
 // TestSanitizeObjectKey tests the sanitizeObjectKey function
 func (s *StorageTestSuite) TestSanitizeObjectKey() {
 	tests := []struct {
@@ -170,7 +330,7 @@ func (s *StorageTestSuite) TestCheckThrottlingStore() {
 			timeBucket:       string(TimeBucketFiveMin),
 			mockSetup: func(client *MockStorageService) {
 				client.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 
 				client.PutObjectFunc = func(params *custom_storage.PutObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.PutObjectOK, error) {
@@ -222,7 +382,7 @@ func (s *StorageTestSuite) TestCheckThrottlingStore() {
 			mockSetup: func(client *MockStorageService) {
 				// Mock Get to return 404
 				client.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 
 				// Mock Upload to fail
@@ -285,6 +445,290 @@ func (s *StorageTestSuite) TestCheckThrottlingStore() {
 	}
 }
 
+// TestCheckSlidingThrottle tests the CheckSlidingThrottle function
+func (s *StorageTestSuite) TestCheckSlidingThrottle() {
+	originalTimeNow := timeNow
+	defer func() { timeNow = originalTimeNow }()
+
+	start := time.Date(2023, 5, 15, 10, 4, 50, 0, time.UTC)
+	calls := []struct {
+		name       string
+		timeBucket string
+		at         time.Duration
+		wantDup    bool
+	}{
+		{name: "First call is allowed", timeBucket: "5 minutes", at: 0},
+		{name: "Call across a fixed bucket boundary is suppressed", timeBucket: "5 minutes", at: 10 * time.Second, wantDup: true},
+		{name: "Call just inside the window is suppressed", timeBucket: "5 minutes", at: 5*time.Minute - time.Second, wantDup: true},
+		{name: "Call once the window has passed is allowed", timeBucket: "5 minutes", at: 5 * time.Minute},
+		{name: "Window restarts from the last allowed call", timeBucket: "5 minutes", at: 9 * time.Minute, wantDup: true},
+		{name: "Other windows are tracked separately", timeBucket: "1h", at: 9 * time.Minute},
+		{name: "Forever allows only the first call", timeBucket: "forever", at: 0},
+		{name: "Forever suppresses later calls", timeBucket: "forever", at: 24 * time.Hour, wantDup: true},
+	}
+
+	memStorage := NewMemoryStorageService()
+	for _, call := range calls {
+		timeNow = func() time.Time { return start.Add(call.at) }
+
+		isDuplicate, err := CheckSlidingThrottle(context.Background(), memStorage, s.logger, "entity123", "Host", "host123", call.timeBucket)
+		s.Require().NoError(err, call.name)
+		s.Equal(call.wantDup, isDuplicate, call.name)
+	}
+
+	_, err := CheckSlidingThrottle(context.Background(), memStorage, s.logger, "entity123", "Host", "host123", "10s")
+	s.ErrorContains(err, "unsupported time bucket value")
+
+	s.mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+		return nil, fmt.Errorf("connection error")
+	}
+	_, err = CheckSlidingThrottle(context.Background(), s.mockStorage, s.logger, "entity123", "Host", "host123", "5 minutes")
+	s.ErrorContains(err, "failed to check dedup record")
+}
+
+// TestThrottleMaxAllowed tests counting calls and allowing the first max_allowed of a window
+func (s *StorageTestSuite) TestThrottleMaxAllowed() {
+	originalTimeNow := timeNow
+	defer func() { timeNow = originalTimeNow }()
+
+	start := time.Date(2023, 5, 15, 10, 0, 0, 0, time.UTC)
+	calls := []struct {
+		name           string
+		mode           ThrottleMode
+		at             time.Duration
+		wantAllowed    bool
+		wantCount      int64
+		wantSuppressed int64
+	}{
+		{name: "Fixed: first call", mode: ThrottleModeFixed, at: 0, wantAllowed: true, wantCount: 1},
+		{name: "Fixed: second call", mode: ThrottleModeFixed, at: time.Minute, wantAllowed: true, wantCount: 2},
+		{name: "Fixed: third call", mode: ThrottleModeFixed, at: 2 * time.Minute, wantAllowed: true, wantCount: 3},
+		{name: "Fixed: fourth call is suppressed", mode: ThrottleModeFixed, at: 3 * time.Minute, wantCount: 4, wantSuppressed: 1},
+		{name: "Fixed: fifth call is suppressed", mode: ThrottleModeFixed, at: 59 * time.Minute, wantCount: 5, wantSuppressed: 2},
+		{name: "Fixed: next bucket starts over", mode: ThrottleModeFixed, at: time.Hour, wantAllowed: true, wantCount: 1},
+		{name: "Sliding: first call", mode: ThrottleModeSliding, at: 30 * time.Minute, wantAllowed: true, wantCount: 1},
+		{name: "Sliding: calls across the bucket boundary are counted together", mode: ThrottleModeSliding, at: 61 * time.Minute, wantAllowed: true, wantCount: 2},
+		{name: "Sliding: third call", mode: ThrottleModeSliding, at: 62 * time.Minute, wantAllowed: true, wantCount: 3},
+		{name: "Sliding: fourth call is suppressed", mode: ThrottleModeSliding, at: 89 * time.Minute, wantCount: 4, wantSuppressed: 1},
+		{name: "Sliding: window ends an hour after the first call", mode: ThrottleModeSliding, at: 90 * time.Minute, wantAllowed: true, wantCount: 1},
+	}
+
+	memStorage := NewMemoryStorageService()
+	for _, call := range calls {
+		timeNow = func() time.Time { return start.Add(call.at) }
+
+		result, err := Throttle(context.Background(), memStorage, s.logger, ThrottleParams{
+			InternalEntityID: "entity123",
+			DedupObjType:     "Host",
+			DedupObjID:       "host123",
+			TimeBucket:       "1h",
+			Mode:             call.mode,
+			MaxAllowed:       3,
+		})
+		s.Require().NoError(err, call.name)
+		s.Equal(call.wantAllowed, result.Allowed, call.name)
+		s.Equal(call.wantCount, result.Count, call.name)
+		s.Equal(call.wantSuppressed, result.Suppressed, call.name)
+	}
+
+	// The record keeps the first and last seen times of the window
+	key := createDedupKey("entity123", "Host", "host123", "sliding_1h0m0s")
+	data, ok := memStorage.Object(CollectionNameDedupStore, key)
+	s.Require().True(ok)
+	var record DedupStoreRecord
+	s.Require().NoError(json.Unmarshal(data, &record))
+	s.Equal(start.Add(90*time.Minute).UnixMilli(), record.FirstSeenAt)
+	s.Equal(start.Add(90*time.Minute).UnixMilli(), record.LastSeenAt)
+}
+
+// TestThrottleKeyFields tests identifying a throttled action by key fields
+func (s *StorageTestSuite) TestThrottleKeyFields() {
+	memStorage := NewMemoryStorageService()
+	throttle := func(keyFields map[string]string) *ThrottleResult {
+		result, err := Throttle(context.Background(), memStorage, s.logger, ThrottleParams{
+			KeyFields:  keyFields,
+			TimeBucket: "forever",
+		})
+		s.Require().NoError(err)
+		return result
+	}
+
+	first := throttle(map[string]string{"tactic": "Credential Access", "technique": "T1003", "host": "host1", "user": "alice"})
+	s.True(first.Allowed)
+
+	// Names and values are trimmed and case folded, and the order of the fields doesn't matter
+	second := throttle(map[string]string{" USER": "Alice ", "Host": "HOST1", "technique": "t1003", "Tactic": "credential access"})
+	s.False(second.Allowed)
+	s.Equal(first.Key, second.Key)
+
+	// A different value is a different action
+	other := throttle(map[string]string{"tactic": "Credential Access", "technique": "T1003", "host": "host2", "user": "alice"})
+	s.True(other.Allowed)
+	s.NotEqual(first.Key, other.Key)
+
+	// The record is stored under the returned key and keeps the normalized fields
+	data, ok := memStorage.Object(CollectionNameDedupStore, first.Key)
+	s.Require().True(ok)
+	var record DedupStoreRecord
+	s.Require().NoError(json.Unmarshal(data, &record))
+	s.Equal(map[string]string{"tactic": "credential access", "technique": "t1003", "host": "host1", "user": "alice"}, record.KeyFields)
+
+	// Without key fields the ids are used as before
+	result, err := Throttle(context.Background(), memStorage, s.logger, ThrottleParams{
+		InternalEntityID: "entity123",
+		DedupObjType:     "Host",
+		DedupObjID:       "host123",
+		TimeBucket:       "forever",
+	})
+	s.Require().NoError(err)
+	s.Equal(createDedupKey("entity123", "Host", "host123", "forever_bucket"), result.Key)
+
+	// Resetting by key fields allows the action again
+	reset, err := ResetThrottle(context.Background(), memStorage, s.logger, ThrottleParams{
+		KeyFields:  map[string]string{"tactic": "credential access", "technique": "t1003", "host": "host1", "user": "alice"},
+		TimeBucket: "forever",
+	})
+	s.Require().NoError(err)
+	s.True(reset)
+}
+
+// TestThrottleLegacyKeys tests that records stored under md5 keys are found and moved to SHA-256 keys
+func (s *StorageTestSuite) TestThrottleLegacyKeys() {
+	params := ThrottleParams{
+		InternalEntityID: "entity123",
+		DedupObjType:     "Host",
+		DedupObjID:       "host123",
+		TimeBucket:       "forever",
+	}
+	legacyKey := legacyDedupKey("entity123", "Host", "host123", "forever_bucket")
+	newKey := createDedupKey("entity123", "Host", "host123", "forever_bucket")
+	s.Len(newKey, 64)
+
+	newStorage := func() *MemoryStorageService {
+		memStorage := NewMemoryStorageService()
+		_, err := memStorage.PutObject(&custom_storage.PutObjectParams{
+			CollectionName: CollectionNameDedupStore,
+			ObjectKey:      legacyKey,
+			Body:           io.NopCloser(strings.NewReader(`{"time_bucket":"forever"}`)),
+		})
+		s.Require().NoError(err)
+		return memStorage
+	}
+
+	// Outside the migration window the legacy record is not seen
+	memStorage := newStorage()
+	result, err := Throttle(context.Background(), memStorage, s.logger, params)
+	s.Require().NoError(err)
+	s.True(result.Allowed)
+
+	// Peeking finds the legacy record but leaves it in place
+	memStorage = newStorage()
+	params.ReadLegacyKeys = true
+	params.Peek = true
+	result, err = Throttle(context.Background(), memStorage, s.logger, params)
+	s.Require().NoError(err)
+	s.False(result.Allowed)
+	_, ok := memStorage.Object(CollectionNameDedupStore, legacyKey)
+	s.True(ok)
+
+	// During the migration window the forever throttle carries on under the new key
+	params.Peek = false
+	result, err = Throttle(context.Background(), memStorage, s.logger, params)
+	s.Require().NoError(err)
+	s.False(result.Allowed)
+	s.Equal(int64(2), result.Count)
+	s.Equal(newKey, result.Key)
+	_, ok = memStorage.Object(CollectionNameDedupStore, newKey)
+	s.True(ok)
+	_, ok = memStorage.Object(CollectionNameDedupStore, legacyKey)
+	s.False(ok, "the legacy record should be deleted once migrated")
+
+	// A failed legacy lookup is an error like any other
+	s.mockStorage.GetObjectFunc = func(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+		if params.ObjectKey == legacyKey {
+			return nil, custom_storage.NewGetObjectInternalServerError()
+		}
+		return nil, runtime.NewAPIError("GetObject", nil, 404)
+	}
+	_, err = Throttle(context.Background(), s.mockStorage, s.logger, params)
+	s.ErrorContains(err, "failed to check legacy dedup record")
+	s.ErrorIs(err, ErrUnavailable)
+}
+
+// TestNormalizeKeyFields tests the validation of key fields
+func (s *StorageTestSuite) TestNormalizeKeyFields() {
+	fields, err := NormalizeKeyFields(nil)
+	s.NoError(err)
+	s.Nil(fields)
+
+	_, err = NormalizeKeyFields(map[string]string{" ": "value"})
+	s.EqualError(err, "invalid key_fields: field names must not be empty")
+
+	_, err = NormalizeKeyFields(map[string]string{"Host": "host1", "host ": "host2"})
+	s.EqualError(err, `invalid key_fields: field "host" is given more than once`)
+
+	tooMany := map[string]string{}
+	for i := range MaxKeyFields + 1 {
+		tooMany[fmt.Sprintf("field%d", i)] = "value"
+	}
+	_, err = NormalizeKeyFields(tooMany)
+	s.ErrorContains(err, "at most 20 key fields are allowed")
+}
+
+// TestThrottlePeekAndReset tests peeking at a throttle and resetting it
+func (s *StorageTestSuite) TestThrottlePeekAndReset() {
+	originalTimeNow := timeNow
+	defer func() { timeNow = originalTimeNow }()
+	timeNow = func() time.Time { return time.Date(2023, 5, 15, 10, 0, 0, 0, time.UTC) }
+
+	memStorage := NewMemoryStorageService()
+	throttle := func(mode ThrottleMode, peek bool) *ThrottleResult {
+		result, err := Throttle(context.Background(), memStorage, s.logger, ThrottleParams{
+			InternalEntityID: "entity123",
+			DedupObjType:     "Host",
+			DedupObjID:       "host123",
+			TimeBucket:       "1h",
+			Mode:             mode,
+			Peek:             peek,
+		})
+		s.Require().NoError(err)
+		s.NotEmpty(result.Key)
+		result.Key = ""
+		return result
+	}
+
+	// Peeking does not consume the slot
+	s.Equal(&ThrottleResult{Allowed: true}, throttle(ThrottleModeFixed, true))
+	s.Equal(&ThrottleResult{Allowed: true}, throttle(ThrottleModeFixed, true))
+	s.Equal(&ThrottleResult{Allowed: true, Count: 1}, throttle(ThrottleModeFixed, false))
+	s.Equal(&ThrottleResult{Allowed: false, Count: 1}, throttle(ThrottleModeFixed, true))
+	s.Equal(&ThrottleResult{Allowed: false, Count: 2, Suppressed: 1}, throttle(ThrottleModeFixed, false))
+	s.Equal(&ThrottleResult{Allowed: false, Count: 2, Suppressed: 1}, throttle(ThrottleModeFixed, true))
+	throttle(ThrottleModeSliding, false)
+
+	// Resetting removes the records of both modes
+	reset, err := ResetThrottle(context.Background(), memStorage, s.logger, ThrottleParams{InternalEntityID: "entity123", DedupObjType: "Host", DedupObjID: "host123", TimeBucket: "1h"})
+	s.NoError(err)
+	s.True(reset)
+	s.Equal(&ThrottleResult{Allowed: true, Count: 1}, throttle(ThrottleModeFixed, false))
+	s.Equal(&ThrottleResult{Allowed: true, Count: 1}, throttle(ThrottleModeSliding, false))
+
+	// Other combinations are not affected
+	reset, err = ResetThrottle(context.Background(), memStorage, s.logger, ThrottleParams{InternalEntityID: "entity123", DedupObjType: "Host", DedupObjID: "host456", TimeBucket: "1h"})
+	s.NoError(err)
+	s.False(reset)
+
+	_, err = ResetThrottle(context.Background(), memStorage, s.logger, ThrottleParams{InternalEntityID: "entity123", DedupObjType: "Host", DedupObjID: "host123", TimeBucket: "invalid"})
+	s.ErrorContains(err, "unsupported time bucket value")
+
+	s.mockStorage.DeleteFunc = func(params *custom_storage.DeleteObjectParams, opts ...custom_storage.ClientOption) (*custom_storage.DeleteObjectOK, error) {
+		return nil, custom_storage.NewDeleteObjectInternalServerError()
+	}
+	_, err = ResetThrottle(context.Background(), s.mockStorage, s.logger, ThrottleParams{InternalEntityID: "entity123", DedupObjType: "Host", DedupObjID: "host123", TimeBucket: "1h"})
+	s.ErrorContains(err, "failed to delete dedup record")
+	s.ErrorIs(err, ErrUnavailable)
+}
+
 // TestCheckExternalEntityExists tests the CheckExternalEntityExists function
 func (s *StorageTestSuite) TestCheckExternalEntityExists() {
 	tests := []struct {
@@ -311,7 +755,7 @@ func (s *StorageTestSuite) TestCheckExternalEntityExists() {
 						return nil, err
 					}
 					s.Equal(expectedKey, params.ObjectKey, "ObjectKey should match expected value")
-					return nil, fmt.Errorf("status 404")
+					return nil, runtime.NewAPIError("GetObject", nil, 404)
 				}
 			},
 			expectedExists: false,
@@ -485,6 +929,117 @@ func (s *StorageTestSuite) TestCreateOrUpdateExternalEntityMapping() {
 	}
 }
 
+// racingStorageService lets another writer store a record right after the next GetObject or GetVersionedObject
+type racingStorageService struct {
+	*MemoryStorageService
+	race func(s *MemoryStorageService)
+}
+
+func (r *racingStorageService) GetObject(params *custom_storage.GetObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetObjectOK, error) {
+	resp, err := r.MemoryStorageService.GetObject(params, writer, opts...)
+	r.runRace()
+	return resp, err
+}
+
+func (r *racingStorageService) GetVersionedObject(params *custom_storage.GetVersionedObjectParams, writer io.Writer, opts ...custom_storage.ClientOption) (*custom_storage.GetVersionedObjectOK, error) {
+	resp, err := r.MemoryStorageService.GetVersionedObject(params, writer, opts...)
+	r.runRace()
+	return resp, err
+}
+
+func (r *racingStorageService) runRace() {
+	if race := r.race; race != nil {
+		r.race = nil
+		race(r.MemoryStorageService)
+	}
+}
+
+// TestUpdateExternalEntityMapping tests the UpdateExternalEntityMapping function
+func (s *StorageTestSuite) TestUpdateExternalEntityMapping() {
+	ctx := context.Background()
+	addAttachment := func(hash string) func(*ExternalEntityRecord) error {
+		return func(record *ExternalEntityRecord) error {
+			if _, ok := record.FindAttachment(hash); !ok {
+				record.Attachments = append(record.Attachments, AttachmentRecord{ContentHash: hash})
+			}
+			return nil
+		}
+	}
+
+	s.Run("Applies the update to the stored mapping", func() {
+		mem := NewMemoryStorageService()
+		s.Require().NoError(CreateOrUpdateExternalEntityMapping(ctx, mem, s.logger, ExternalEntityRecord{
+			InternalEntityID: "entity123",
+			ExternalEntityID: "sys123",
+			ExternalSystemID: "servicenow_incident",
+		}))
+
+		record, err := UpdateExternalEntityMapping(ctx, mem, s.logger, "entity123", "servicenow_incident", addAttachment("ours"))
+		s.Require().NoError(err)
+		s.Equal(int64(2), record.Revision)
+		s.Equal("sys123", record.ExternalEntityID)
+		s.Require().Len(record.Attachments, 1)
+
+		_, stored, err := CheckExternalEntityExists(ctx, mem, s.logger, "entity123", "servicenow_incident")
+		s.Require().NoError(err)
+		s.Equal(*record, *stored)
+	})
+
+	s.Run("Concurrent updates are merged", func() {
+		mem := NewMemoryStorageService()
+		s.Require().NoError(CreateOrUpdateExternalEntityMapping(ctx, mem, s.logger, ExternalEntityRecord{
+			InternalEntityID: "entity123",
+			ExternalEntityID: "sys123",
+			ExternalSystemID: "servicenow_incident",
+		}))
+
+		racing := &racingStorageService{MemoryStorageService: mem}
+		racing.race = func(m *MemoryStorageService) {
+			_, err := UpdateExternalEntityMapping(ctx, m, s.logger, "entity123", "servicenow_incident", addAttachment("theirs"))
+			s.Require().NoError(err)
+		}
+
+		record, err := UpdateExternalEntityMapping(ctx, racing, s.logger, "entity123", "servicenow_incident", addAttachment("ours"))
+		s.Require().NoError(err)
+		s.Equal(int64(3), record.Revision, "the update should be re-applied on top of the concurrent one")
+
+		_, stored, err := CheckExternalEntityExists(ctx, mem, s.logger, "entity123", "servicenow_incident")
+		s.Require().NoError(err)
+		s.Equal(*record, *stored)
+		s.Require().Len(stored.Attachments, 2, "both updates should survive")
+		s.Equal("theirs", stored.Attachments[0].ContentHash)
+		s.Equal("ours", stored.Attachments[1].ContentHash)
+	})
+
+	s.Run("Gives up with a conflict error", func() {
+		s.SetupTest()
+		var writes int
+		s.mockStorage.PutObjectByVersionFunc = func(params *custom_storage.PutObjectByVersionParams, opts ...custom_storage.ClientOption) (*custom_storage.PutObjectByVersionOK, error) {
+			writes++
+			return nil, runtime.NewAPIError("PutObjectByVersion", nil, http.StatusPreconditionFailed)
+		}
+
+		_, err := UpdateExternalEntityMapping(ctx, s.mockStorage, s.logger, "entity123", "servicenow_incident", addAttachment("ours"))
+		var conflictErr *MappingConflictError
+		s.Require().ErrorAs(err, &conflictErr)
+		s.Equal(MaxMappingUpdateAttempts, conflictErr.Attempts)
+		s.Equal(MaxMappingUpdateAttempts, writes)
+		s.ErrorIs(err, ErrConflict)
+	})
+
+	s.Run("Update error aborts without writing", func() {
+		mem := NewMemoryStorageService()
+		_, err := UpdateExternalEntityMapping(ctx, mem, s.logger, "entity123", "servicenow_incident", func(*ExternalEntityRecord) error {
+			return fmt.Errorf("boom")
+		})
+		s.EqualError(err, "boom")
+
+		key, _ := CreateTrackedEntityKey("servicenow_incident", "entity123")
+		_, ok := mem.Object(CollectionNameTrackedEntities, key)
+		s.False(ok)
+	})
+}
+
 // TestStorageSuite runs the storage test suite
 func TestStorageSuite(t *testing.T) {
 	suite.Run(t, new(StorageTestSuite))
@@ -2,49 +2,141 @@ package storage
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // timeNow is a variable that can be replaced in tests
 var timeNow = time.Now
 
-// calculateTimeBucket generates a time bucket string based on current time and bucket type
+// Bounds for throttle windows given as durations
+const (
+	MinThrottleWindow = time.Minute
+	MaxThrottleWindow = 366 * 24 * time.Hour
+)
+
+// legacyTimeBuckets maps the original named time buckets to their windows
+var legacyTimeBuckets = map[TimeBucket]time.Duration{
+	TimeBucketFiveMin:   5 * time.Minute,
+	TimeBucketThirtyMin: 30 * time.Minute,
+}
+
+var (
+	// dayDurationPattern matches Go-style durations with a leading day component, e.g. "7d" or "1d12h"
+	dayDurationPattern = regexp.MustCompile(`^(\d+)d(.*)$`)
+	// isoPeriodPattern matches ISO-8601 periods made of weeks, days, hours, minutes and seconds, e.g. "PT4H" or "P1W"
+	isoPeriodPattern = regexp.MustCompile(`^P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+)
+
+// Window returns the length of the time bucket, or 0 for TimeBucketForever.
+// Besides the named buckets, Go-style durations ("4h", "7d") and ISO-8601 periods ("PT1H", "P7D")
+// between MinThrottleWindow and MaxThrottleWindow are accepted.
+func (tb TimeBucket) Window() (time.Duration, error) {
+	if tb == TimeBucketForever {
+		return 0, nil
+	}
+	if window, ok := legacyTimeBuckets[tb]; ok {
+		return window, nil
+	}
+
+	window, err := parseWindow(strings.TrimSpace(string(tb)))
+	if err != nil {
+		return 0, err
+	}
+
+	if window < MinThrottleWindow || window > MaxThrottleWindow {
+		return 0, fmt.Errorf("time bucket %q must be between %s and %s", tb, MinThrottleWindow, MaxThrottleWindow)
+	}
+	if window%time.Second != 0 {
+		return 0, fmt.Errorf("time bucket %q must be a whole number of seconds", tb)
+	}
+
+	return window, nil
+}
+
+// parseWindow parses a Go-style duration, optionally starting with days, or an ISO-8601 period
+func parseWindow(s string) (time.Duration, error) {
+	if strings.HasPrefix(strings.ToUpper(s), "P") {
+		return parseISOPeriod(strings.ToUpper(s))
+	}
+
+	var days time.Duration
+	if m := dayDurationPattern.FindStringSubmatch(s); m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a valid window: %w", s, err)
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		if s = m[2]; s == "" {
+			return days, nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a valid window, use forever, a duration such as 4h or 7d, or an ISO-8601 period such as PT4H", s)
+	}
+
+	return days + d, nil
+}
+
+// parseISOPeriod parses an ISO-8601 period. Years and months are rejected because their length varies.
+func parseISOPeriod(s string) (time.Duration, error) {
+	m := isoPeriodPattern.FindStringSubmatch(s)
+	if m == nil || s == "P" || strings.HasSuffix(s, "T") {
+		return 0, fmt.Errorf("%q is not a valid ISO-8601 window, only weeks, days, hours, minutes and seconds are supported", s)
+	}
+
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var window time.Duration
+	for i, unit := range units {
+		if m[i+1] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(m[i+1])
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a valid ISO-8601 window: %w", s, err)
+		}
+		window += time.Duration(n) * unit
+	}
+
+	return window, nil
+}
+
+// calculateTimeBucket generates a time bucket string based on current time and bucket type.
+// Buckets are aligned to the Unix epoch, so every caller computes the same bucket for any window length.
 func calculateTimeBucket(tb TimeBucket) (string, error) {
-	// Validate bucket type first
-	switch tb {
-	case TimeBucketForever, TimeBucketFiveMin, TimeBucketThirtyMin:
-		// Valid bucket type
-	default:
+	window, err := tb.Window()
+	if err != nil {
 		return "", fmt.Errorf("invalid time bucket: %s", tb)
 	}
 
 	// For "forever" type, no time division is needed
-	if tb == TimeBucketForever {
+	if window == 0 {
 		return "forever_bucket", nil
 	}
 
-	// Get current time
-	now := timeNow().UTC()
-
-	// Format the date part (same for all time-based buckets)
-	datePart := now.Format("2006-01-02")
+	start := bucketStart(timeNow(), window)
 
-	// Calculate hour and rounded minutes based on bucket type
-	hour := now.Hour()
-	var minutePart string
+	// 5 and 30 minute windows keep the original key format, whether given by name or as a duration,
+	// so existing dedup records stay valid. Other windows include their length so that buckets of
+	// different windows starting at the same time don't share a record.
+	if window == 5*time.Minute || window == 30*time.Minute {
+		return start.Format("2006-01-02_15:04"), nil
+	}
 
-	switch tb {
-	case TimeBucketFiveMin:
-		// Round down to the nearest 5-minute interval
-		minuteInterval := (now.Minute() / 5) * 5
-		minutePart = fmt.Sprintf("%02d:%02d", hour, minuteInterval)
+	return fmt.Sprintf("%s_%s", start.Format("2006-01-02_15:04:05"), window), nil
+}
 
-	case TimeBucketThirtyMin:
-		// Round down to the nearest 30-minute interval
-		minuteInterval := (now.Minute() / 30) * 30
-		minutePart = fmt.Sprintf("%02d:%02d", hour, minuteInterval)
-	}
+// bucketStart returns the start of the epoch-aligned bucket of the given window that contains t
+func bucketStart(t time.Time, window time.Duration) time.Time {
+	seconds := int64(window / time.Second)
+	return time.Unix(t.Unix()-mod(t.Unix(), seconds), 0).UTC()
+}
 
-	// Combine into final bucket string
-	return fmt.Sprintf("%s_%s", datePart, minutePart), nil
+// mod returns a modulo b with the sign of b, so timestamps before the epoch round down as well
+func mod(a, b int64) int64 {
+	return ((a % b) + b) % b
 }
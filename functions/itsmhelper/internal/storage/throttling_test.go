@@ -228,6 +228,90 @@ func (s *ThrottlingTestSuite) TestCalculateTimeBucket_EdgeCases() {
 	}
 }
 
+// TestTimeBucketWindow tests parsing of time buckets into windows
+func (s *ThrottlingTestSuite) TestTimeBucketWindow() {
+	tests := []struct {
+		bucket  TimeBucket
+		want    time.Duration
+		wantErr string
+	}{
+		{bucket: TimeBucketForever, want: 0},
+		{bucket: TimeBucketFiveMin, want: 5 * time.Minute},
+		{bucket: TimeBucketThirtyMin, want: 30 * time.Minute},
+		{bucket: "1h", want: time.Hour},
+		{bucket: "4h", want: 4 * time.Hour},
+		{bucket: "24h", want: 24 * time.Hour},
+		{bucket: "7d", want: 7 * 24 * time.Hour},
+		{bucket: "1d12h", want: 36 * time.Hour},
+		{bucket: "PT1H", want: time.Hour},
+		{bucket: "PT4H", want: 4 * time.Hour},
+		{bucket: "P1D", want: 24 * time.Hour},
+		{bucket: "P1W", want: 7 * 24 * time.Hour},
+		{bucket: "P1DT12H30M", want: 36*time.Hour + 30*time.Minute},
+		{bucket: "pt15m", want: 15 * time.Minute},
+		{bucket: "", wantErr: "is not a valid window"},
+		{bucket: "123", wantErr: "is not a valid window"},
+		{bucket: "30s", wantErr: "must be between 1m0s and 8784h0m0s"},
+		{bucket: "400d", wantErr: "must be between 1m0s and 8784h0m0s"},
+		{bucket: "90.5s", wantErr: "must be a whole number of seconds"},
+		{bucket: "P1M", wantErr: "is not a valid ISO-8601 window"},
+		{bucket: "P1Y", wantErr: "is not a valid ISO-8601 window"},
+		{bucket: "P", wantErr: "is not a valid ISO-8601 window"},
+		{bucket: "P1DT", wantErr: "is not a valid ISO-8601 window"},
+	}
+
+	for _, tc := range tests {
+		s.Run(string(tc.bucket), func() {
+			window, err := tc.bucket.Window()
+			if tc.wantErr != "" {
+				s.ErrorContains(err, tc.wantErr)
+				return
+			}
+			s.NoError(err)
+			s.Equal(tc.want, window)
+		})
+	}
+}
+
+// TestCalculateTimeBucket_Windows tests epoch-aligned buckets for arbitrary windows
+func (s *ThrottlingTestSuite) TestCalculateTimeBucket_Windows() {
+	mockTime := time.Date(2023, 5, 15, 10, 17, 30, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		bucket   TimeBucket
+		expected string
+	}{
+		{name: "Five minutes as duration matches legacy key", bucket: "5m", expected: "2023-05-15_10:15"},
+		{name: "Thirty minutes as ISO period matches legacy key", bucket: "PT30M", expected: "2023-05-15_10:00"},
+		{name: "One hour", bucket: "1h", expected: "2023-05-15_10:00:00_1h0m0s"},
+		{name: "Four hours", bucket: "4h", expected: "2023-05-15_08:00:00_4h0m0s"},
+		{name: "One day", bucket: "24h", expected: "2023-05-15_00:00:00_24h0m0s"},
+		{name: "Seven days aligned to the epoch", bucket: "7d", expected: "2023-05-11_00:00:00_168h0m0s"},
+		{name: "Window that does not divide a day", bucket: "7m", expected: "2023-05-15_10:17:00_7m0s"},
+	}
+
+	for _, tc := range tests {
+		s.Run(tc.name, func() {
+			s.withMockedTime(mockTime, func() {
+				result, err := calculateTimeBucket(tc.bucket)
+				s.NoError(err)
+				s.Equal(tc.expected, result)
+			})
+		})
+	}
+
+	// Every moment within a window maps to the same bucket
+	s.withMockedTime(time.Date(2023, 5, 11, 0, 0, 0, 0, time.UTC), func() {
+		first, err := calculateTimeBucket("7d")
+		s.NoError(err)
+		timeNow = func() time.Time { return time.Date(2023, 5, 17, 23, 59, 59, 0, time.UTC) }
+		last, err := calculateTimeBucket("7d")
+		s.NoError(err)
+		s.Equal(first, last)
+	})
+}
+
 // TestThrottlingSuite runs the throttling test suite
 func TestThrottlingSuite(t *testing.T) {
 	suite.Run(t, new(ThrottlingTestSuite))
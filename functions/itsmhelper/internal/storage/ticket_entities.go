@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+)
+
+// Defaults and limits for listing the entities mapped to a ticket
+const (
+	DefaultEntitySearchLimit = 100
+	MaxEntitySearchLimit     = 500
+)
+
+// EntitySearchOptions selects a page of the entities mapped to a ticket
+type EntitySearchOptions struct {
+	// ExternalSystemID restricts the search to mappings of one external system; empty for all
+	ExternalSystemID string
+	Offset           int
+	Limit            int
+}
+
+// EntitySearchResult is a page of the entities mapped to a ticket
+type EntitySearchResult struct {
+	Records []ExternalEntityRecord
+	// Total is the number of matching mappings reported by the search
+	Total int
+	// NextOffset is the offset of the next page, or 0 once all pages were read
+	NextOffset int
+}
+
+// ListEntitiesForTicket returns the mappings of all internal entities mapped to an external ticket, using the
+// index on external_entity_id. Search results only carry object keys, so every mapping on the page is read;
+// mappings that were changed or deleted since they were indexed are left out.
+func ListEntitiesForTicket(ctx context.Context, storageService StorageService, logger *slog.Logger, externalEntityID string, opts EntitySearchOptions) (*EntitySearchResult, error) {
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultEntitySearchLimit
+	}
+	opts.Limit = min(opts.Limit, MaxEntitySearchLimit)
+
+	filter := fmt.Sprintf("external_entity_id:%s", fqlString(externalEntityID))
+	if opts.ExternalSystemID != "" {
+		filter += fmt.Sprintf("+external_system_id:%s", fqlString(opts.ExternalSystemID))
+	}
+
+	searchResp, err := storageService.SearchObjects(&custom_storage.SearchObjectsParams{
+		CollectionName: CollectionNameTrackedEntities,
+		Filter:         filter,
+		Offset:         int64(opts.Offset),
+		Limit:          int64(opts.Limit),
+		Context:        ctx,
+	})
+	err = newStorageError("SearchObjects", err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search entity mappings: %w", err)
+	}
+
+	result := &EntitySearchResult{}
+	if searchResp == nil || searchResp.Payload == nil {
+		return result, nil
+	}
+
+	resources := searchResp.Payload.Resources
+	for _, resource := range resources {
+		if resource == nil || resource.ObjectKey == nil {
+			continue
+		}
+
+		record, err := readExternalEntityRecord(ctx, storageService, *resource.ObjectKey)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil || record.ExternalEntityID != externalEntityID ||
+			(opts.ExternalSystemID != "" && record.ExternalSystemID != opts.ExternalSystemID) {
+			logger.Debug("skipping stale entity mapping search result", "key", *resource.ObjectKey)
+			continue
+		}
+		result.Records = append(result.Records, *record)
+	}
+
+	result.Total = opts.Offset + len(resources)
+	if meta := searchResp.Payload.Meta; meta != nil && meta.Pagination != nil && meta.Pagination.Total != nil {
+		result.Total = int(*meta.Pagination.Total)
+	}
+	if next := opts.Offset + len(resources); len(resources) > 0 && next < result.Total {
+		result.NextOffset = next
+	}
+
+	return result, nil
+}
+
+// fqlString quotes a value for an FQL filter
+func fqlString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return "'" + strings.ReplaceAll(s, "'", `\'`) + "'"
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/crowdstrike/gofalcon/falcon/client/custom_storage"
+	"github.com/crowdstrike/gofalcon/falcon/models"
+)
+
+// TestListEntitiesForTicket tests the ListEntitiesForTicket function
+func (s *StorageTestSuite) TestListEntitiesForTicket() {
+	memStorage := NewMemoryStorageService()
+	for _, record := range []ExternalEntityRecord{
+		{InternalEntityID: "ind:1", ExternalEntityID: "sys'1", ExternalSystemID: "servicenow_incident"},
+		{InternalEntityID: "ind:2", ExternalEntityID: "sys'1", ExternalSystemID: "servicenow_incident"},
+		{InternalEntityID: "ind:3", ExternalEntityID: "sys2", ExternalSystemID: "servicenow_incident"},
+	} {
+		key, err := CreateTrackedEntityKey(record.ExternalSystemID, record.InternalEntityID)
+		s.Require().NoError(err)
+		data, err := json.Marshal(record)
+		s.Require().NoError(err)
+		_, err = memStorage.PutObject(&custom_storage.PutObjectParams{
+			CollectionName: CollectionNameTrackedEntities,
+			ObjectKey:      key,
+			Body:           io.NopCloser(bytes.NewReader(data)),
+		})
+		s.Require().NoError(err)
+	}
+
+	// The index still lists ind:3 and a deleted mapping for the ticket
+	indexed := []string{"servicenow_incident.ind.3A1", "servicenow_incident.ind.3A2", "servicenow_incident.ind.3A3", "servicenow_incident.deleted"}
+	var filters []string
+	memStorage.SearchObjectsFunc = func(params *custom_storage.SearchObjectsParams, opts ...custom_storage.ClientOption) (*custom_storage.SearchObjectsOK, error) {
+		s.Equal(CollectionNameTrackedEntities, params.CollectionName)
+		filters = append(filters, params.Filter)
+		total := int64(len(indexed))
+		var resources []*models.APIObjectMetadata
+		for _, key := range indexed[min(params.Offset, total):min(params.Offset+params.Limit, total)] {
+			resources = append(resources, &models.APIObjectMetadata{ObjectKey: &key})
+		}
+		return &custom_storage.SearchObjectsOK{Payload: &models.CustomStorageResponse{
+			Resources: resources,
+			Meta:      &models.APIMetaInfo{Pagination: &models.APIResponsePagination{Total: &total}},
+		}}, nil
+	}
+
+	result, err := ListEntitiesForTicket(context.Background(), memStorage, s.logger, "sys'1", EntitySearchOptions{Limit: 3})
+	s.Require().NoError(err)
+	s.Len(result.Records, 2)
+	s.Equal("ind:1", result.Records[0].InternalEntityID)
+	s.Equal("ind:2", result.Records[1].InternalEntityID)
+	s.Equal(4, result.Total)
+	s.Equal(3, result.NextOffset)
+
+	result, err = ListEntitiesForTicket(context.Background(), memStorage, s.logger, "sys'1", EntitySearchOptions{Offset: 3, Limit: 3, ExternalSystemID: "servicenow_incident"})
+	s.Require().NoError(err)
+	s.Empty(result.Records)
+	s.Zero(result.NextOffset)
+
+	s.Equal([]string{
+		`external_entity_id:'sys\'1'`,
+		`external_entity_id:'sys\'1'+external_system_id:'servicenow_incident'`,
+	}, filters)
+
+	s.mockStorage.SearchObjectsFunc = func(params *custom_storage.SearchObjectsParams, opts ...custom_storage.ClientOption) (*custom_storage.SearchObjectsOK, error) {
+		return nil, custom_storage.NewSearchObjectsInternalServerError()
+	}
+	_, err = ListEntitiesForTicket(context.Background(), s.mockStorage, s.logger, "sys1", EntitySearchOptions{})
+	s.ErrorContains(err, "failed to search entity mappings")
+	s.ErrorIs(err, ErrUnavailable)
+}
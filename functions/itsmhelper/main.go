@@ -2,7 +2,11 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"net/url"
+	"strings"
+	"time"
 
 	"itsmhelper/internal/handler"
 	"itsmhelper/internal/service"
@@ -15,16 +19,105 @@ func main() {
 }
 
 type config struct {
-	IsProd bool `json:"is_production"`
+	IsProd     bool                   `json:"is_production"`
+	CloseCodes handler.CloseCodeTable `json:"close_codes"`
+
+	MaxAttachmentBytes int `json:"max_attachment_bytes"`
+
+	ServiceNowRetry *retryConfig `json:"servicenow_retry"`
+	// ServiceNowRetryByHandler overrides the retry policy per handler API path, see handler.WithHandlerRetryPolicy
+	ServiceNowRetryByHandler map[string]retryConfig `json:"servicenow_retry_by_handler"`
+
+	ThrottleFailurePolicy handler.ThrottleFailurePolicy `json:"throttle_failure_policy"`
+	// LegacyDedupKeysUntil ends the lookup of dedup records under their md5 keys (RFC 3339)
+	LegacyDedupKeysUntil time.Time `json:"legacy_dedup_keys_until"`
+
+	// ServiceNowWebhookSecret is the shared secret ServiceNow signs /servicenow_webhook payloads with
+	ServiceNowWebhookSecret string `json:"servicenow_webhook_secret"`
+	// ServiceNowInstanceURL is the base URL tickets are linked with in Falcon alert comments
+	ServiceNowInstanceURL string `json:"servicenow_instance_url"`
 }
 
-func (c config) OK() error {
+// retryConfig is the function configuration of a handler.RetryPolicy
+type retryConfig struct {
+	MaxAttempts int `json:"max_attempts"`
+	BaseDelayMs int `json:"base_delay_ms"`
+	MaxDelayMs  int `json:"max_delay_ms"`
+}
+
+func (c retryConfig) OK() error {
+	if c.MaxAttempts < 0 || c.BaseDelayMs < 0 || c.MaxDelayMs < 0 {
+		return fmt.Errorf("retry settings must not be negative: %+v", c)
+	}
 	return nil
 }
 
+// policy returns the retry policy, keeping the defaults for unset values
+func (c retryConfig) policy() handler.RetryPolicy {
+	policy := handler.DefaultRetryPolicy()
+	if c.MaxAttempts > 0 {
+		policy.MaxAttempts = c.MaxAttempts
+	}
+	if c.BaseDelayMs > 0 {
+		policy.BaseDelay = time.Duration(c.BaseDelayMs) * time.Millisecond
+	}
+	if c.MaxDelayMs > 0 {
+		policy.MaxDelay = time.Duration(c.MaxDelayMs) * time.Millisecond
+	}
+	return policy
+}
+
+func (c config) OK() error {
+	if c.MaxAttachmentBytes < 0 {
+		return fmt.Errorf("max_attachment_bytes must not be negative: %d", c.MaxAttachmentBytes)
+	}
+
+	if c.ServiceNowRetry != nil {
+		if err := c.ServiceNowRetry.OK(); err != nil {
+			return fmt.Errorf("servicenow_retry: %w", err)
+		}
+	}
+	for path, retry := range c.ServiceNowRetryByHandler {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("servicenow_retry_by_handler keys must be API paths such as /create_incident: %s", path)
+		}
+		if err := retry.OK(); err != nil {
+			return fmt.Errorf("servicenow_retry_by_handler %s: %w", path, err)
+		}
+	}
+
+	if err := c.ThrottleFailurePolicy.Validate(); err != nil {
+		return fmt.Errorf("throttle_failure_policy: %w", err)
+	}
+
+	if c.ServiceNowInstanceURL != "" {
+		u, err := url.Parse(c.ServiceNowInstanceURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("servicenow_instance_url must be an https URL: %s", c.ServiceNowInstanceURL)
+		}
+	}
+
+	return handler.DefaultCloseCodes().Merge(c.CloseCodes).Validate()
+}
+
 func newHandler(ctx context.Context, logger *slog.Logger, cfg config) fdk.Handler {
+	opts := []handler.Option{
+		handler.WithCloseCodes(cfg.CloseCodes),
+		handler.WithMaxAttachmentBytes(cfg.MaxAttachmentBytes),
+		handler.WithThrottleFailurePolicy(cfg.ThrottleFailurePolicy),
+		handler.WithLegacyDedupKeysUntil(cfg.LegacyDedupKeysUntil),
+		handler.WithWebhookSecret(cfg.ServiceNowWebhookSecret),
+		handler.WithServiceNowInstanceURL(cfg.ServiceNowInstanceURL),
+	}
+	if cfg.ServiceNowRetry != nil {
+		opts = append(opts, handler.WithRetryPolicy(cfg.ServiceNowRetry.policy()))
+	}
+	for path, retry := range cfg.ServiceNowRetryByHandler {
+		opts = append(opts, handler.WithHandlerRetryPolicy(path, retry.policy()))
+	}
+
 	m := fdk.NewMux()
-	h := handler.NewHandler(logger, service.NewFalconClient)
+	h := handler.NewHandler(logger, service.NewFalconClient, opts...)
 
 	m.Post("/check_if_ext_entity_exists", fdk.HandleFnOf(func(ctx context.Context, r fdk.RequestOf[handler.CheckIfExtExistsReq]) fdk.Response {
 		return h.HandleCheckIfExtEntityExists(ctx, r)
@@ -44,9 +137,60 @@ func newHandler(ctx context.Context, logger *slog.Logger, cfg config) fdk.Handle
 			return h.HandleCreateSIRIncident(ctx, r, wrkCtx)
 		})))
 
+	m.Post("/update_incident", fdk.HandleWorkflowOf(service.WithPanicRecoveryWorkflow(logger,
+		func(ctx context.Context, r fdk.RequestOf[handler.UpdateIncidentRequest], wrkCtx fdk.WorkflowCtx) fdk.Response {
+			return h.HandleUpdateIncident(ctx, r, wrkCtx)
+		})))
+
+	m.Post("/update_sir_incident", fdk.HandleWorkflowOf(service.WithPanicRecoveryWorkflow(logger,
+		func(ctx context.Context, r fdk.RequestOf[handler.UpdateIncidentRequest], wrkCtx fdk.WorkflowCtx) fdk.Response {
+			return h.HandleUpdateSIRIncident(ctx, r, wrkCtx)
+		})))
+
+	m.Post("/close_ticket", fdk.HandleWorkflowOf(service.WithPanicRecoveryWorkflow(logger,
+		func(ctx context.Context, r fdk.RequestOf[handler.CloseTicketRequest], wrkCtx fdk.WorkflowCtx) fdk.Response {
+			return h.HandleCloseTicket(ctx, r, wrkCtx)
+		})))
+
+	m.Post("/add_sir_observables", fdk.HandleWorkflowOf(service.WithPanicRecoveryWorkflow(logger,
+		func(ctx context.Context, r fdk.RequestOf[handler.AddSIRObservablesRequest], wrkCtx fdk.WorkflowCtx) fdk.Response {
+			return h.HandleAddSIRObservables(ctx, r, wrkCtx)
+		})))
+
+	m.Post("/add_attachment", fdk.HandleWorkflowOf(service.WithPanicRecoveryWorkflow(logger,
+		func(ctx context.Context, r fdk.RequestOf[handler.AddAttachmentRequest], wrkCtx fdk.WorkflowCtx) fdk.Response {
+			return h.HandleAddAttachment(ctx, r, wrkCtx)
+		})))
+
 	m.Post("/throttle", fdk.HandleFnOf(func(ctx context.Context, r fdk.RequestOf[handler.ThrottleFunctionRequest]) fdk.Response {
 		return h.HandleThrottle(ctx, r)
 	}))
 
+	m.Post("/throttle_reset", fdk.HandleFnOf(func(ctx context.Context, r fdk.RequestOf[handler.ThrottleResetRequest]) fdk.Response {
+		return h.HandleThrottleReset(ctx, r)
+	}))
+
+	m.Post("/gc_dedup_store", fdk.HandleFnOf(func(ctx context.Context, r fdk.RequestOf[handler.GCDedupStoreRequest]) fdk.Response {
+		return h.HandleGCDedupStore(ctx, r)
+	}))
+
+	m.Post("/list_entities_for_ticket", fdk.HandleFnOf(func(ctx context.Context, r fdk.RequestOf[handler.ListEntitiesForTicketRequest]) fdk.Response {
+		return h.HandleListEntitiesForTicket(ctx, r)
+	}))
+
+	m.Post("/get_entity_mapping_history", fdk.HandleFnOf(func(ctx context.Context, r fdk.RequestOf[handler.GetEntityMappingHistoryRequest]) fdk.Response {
+		return h.HandleGetEntityMappingHistory(ctx, r)
+	}))
+
+	m.Post("/sync_ticket_states", fdk.HandleWorkflowOf(service.WithPanicRecoveryWorkflow(logger,
+		func(ctx context.Context, r fdk.RequestOf[handler.SyncTicketStatesRequest], wrkCtx fdk.WorkflowCtx) fdk.Response {
+			return h.HandleSyncTicketStates(ctx, r, wrkCtx)
+		})))
+
+	// The webhook reads the raw body, since its signature covers the exact bytes that were sent
+	m.Post("/servicenow_webhook", fdk.HandlerFn(func(ctx context.Context, r fdk.Request) fdk.Response {
+		return h.HandleServiceNowWebhook(ctx, r)
+	}))
+
 	return m
 }